@@ -0,0 +1,223 @@
+package prommy
+
+import (
+	"encoding/binary"
+	"math"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// WebSocket subprotocols selecting the encoding of the metrics feed.
+// Clients that do not ask for a subprotocol get the bare JSON metrics array
+// that /ws sent before snapshots had envelopes, so existing consumers keep
+// working.
+const (
+	subprotocolJSON = "prommy.json"
+	subprotocolCBOR = "prommy.cbor"
+)
+
+// wireEncoding is the encoding a client negotiated for its frames.
+type wireEncoding int
+
+const (
+	encodingJSON  wireEncoding = iota
+	encodingCBOR               // Binary envelopes, see wireSchema
+	encodingArray              // Bare metrics array without sequence metadata
+	encodingCount
+)
+
+// encodingFor maps a negotiated subprotocol to its wire encoding.
+func encodingFor(subprotocol string) wireEncoding {
+	switch subprotocol {
+	case subprotocolJSON:
+		return encodingJSON
+	case subprotocolCBOR:
+		return encodingCBOR
+	}
+	return encodingArray
+}
+
+// wireSchema describes the binary frame layout. Every message is a CBOR
+// array holding the envelope fields in order; metrics and errors are arrays
+// too, and metric names, types, help texts and labels are indices into the
+// per-frame string table. It must match static/protocol.json, which the
+// dashboard uses to decode frames.
+var wireSchema = struct {
+	Subprotocol string   `json:"subprotocol"`
+	Version     int      `json:"version"`
+	Envelope    []string `json:"envelope"`
+	Metric      []string `json:"metric"`
+	Error       []string `json:"error"`
+}{
+	Subprotocol: subprotocolCBOR,
+	Version:     1,
+	Envelope:    []string{"version", "seq", "ts", "epoch", "resync", "errors", "strings", "metrics"},
+	Metric:      []string{"name", "type", "help", "labels", "value"},
+	Error:       []string{"collector", "kind", "message"},
+}
+
+// CBOR major types (RFC 8949, section 3.1).
+const (
+	cborUint  = 0 << 5
+	cborText  = 3 << 5
+	cborArray = 4 << 5
+
+	cborFalse   = 0xf4
+	cborTrue    = 0xf5
+	cborNull    = 0xf6
+	cborFloat64 = 0xfb
+)
+
+// appendCBORHead appends the initial bytes of an item of the given major type
+// with argument n, using the shortest form.
+func appendCBORHead(dst []byte, major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return append(dst, major|byte(n))
+	case n <= math.MaxUint8:
+		return append(dst, major|24, byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(dst, major|25), uint16(n))
+	case n <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(dst, major|26), uint32(n))
+	default:
+		return binary.BigEndian.AppendUint64(append(dst, major|27), n)
+	}
+}
+
+// appendCBORText appends s as a CBOR text string.
+func appendCBORText(dst []byte, s string) []byte {
+	dst = appendCBORHead(dst, cborText, uint64(len(s)))
+	return append(dst, s...)
+}
+
+// appendCBORBool appends b as a CBOR simple value.
+func appendCBORBool(dst []byte, b bool) []byte {
+	if b {
+		return append(dst, cborTrue)
+	}
+	return append(dst, cborFalse)
+}
+
+// appendCBORFloat appends f as a double-precision float. Unlike JSON, CBOR
+// represents NaN and the infinities natively.
+func appendCBORFloat(dst []byte, f float64) []byte {
+	return binary.BigEndian.AppendUint64(append(dst, cborFloat64), math.Float64bits(f))
+}
+
+// appendCBOREnvelope appends the binary frame for snap. metrics is the
+// string table and metrics array produced by binaryEncoder.
+func appendCBOREnvelope(dst []byte, epoch string, snap *snapshot, resync bool, metrics []byte) []byte {
+	dst = appendCBORHead(dst, cborArray, uint64(len(wireSchema.Envelope)))
+	dst = appendCBORHead(dst, cborUint, uint64(wireSchema.Version))
+	dst = appendCBORHead(dst, cborUint, snap.seq)
+	dst = appendCBORHead(dst, cborUint, uint64(snap.ts))
+	dst = appendCBORText(dst, epoch)
+	dst = appendCBORBool(dst, resync)
+	if len(snap.tick.errors) == 0 {
+		dst = append(dst, cborNull)
+	} else {
+		dst = appendCBORHead(dst, cborArray, uint64(len(snap.tick.errors)))
+		for _, ge := range snap.tick.errors {
+			dst = appendCBORHead(dst, cborArray, uint64(len(wireSchema.Error)))
+			dst = appendCBORText(dst, ge.Collector)
+			dst = appendCBORText(dst, string(ge.Kind))
+			dst = appendCBORText(dst, ge.Message)
+		}
+	}
+	return append(dst, metrics...)
+}
+
+// binaryEncoder converts gathered metric families into the string table and
+// metrics array of a binary frame. Each frame carries its own string table
+// so that it can be decoded on its own, but the table is built from scratch
+// buffers reused between ticks.
+//
+// A binaryEncoder is not safe for concurrent use.
+type binaryEncoder struct {
+	buf    []byte   // Encoded metrics array entries
+	table  []byte   // Encoded string table entries
+	key    []byte   // Scratch space for building metric names
+	labels []uint64 // Scratch space for the label indices of one series
+
+	// String table indices of the frame being built
+	strings map[string]uint64
+
+	// Formatted "le" values keyed by bucket upper bound
+	bounds boundCache
+
+	// Number of series in the frame being built
+	count int
+}
+
+// newBinaryEncoder creates an encoder with empty caches.
+func newBinaryEncoder() *binaryEncoder {
+	return &binaryEncoder{
+		strings: make(map[string]uint64),
+		bounds:  make(boundCache),
+	}
+}
+
+// encode returns the string table followed by the metrics array for mfs.
+// The returned slice is owned by the caller.
+func (e *binaryEncoder) encode(mfs []*dto.MetricFamily) []byte {
+	clear(e.strings)
+	e.buf = e.buf[:0]
+	e.table = e.table[:0]
+	e.count = 0
+
+	forEachSeries(mfs, e.bounds, e.series)
+
+	out := make([]byte, 0, len(e.table)+len(e.buf)+18)
+	out = appendCBORHead(out, cborArray, uint64(len(e.strings)))
+	out = append(out, e.table...)
+	out = appendCBORHead(out, cborArray, uint64(e.count))
+	return append(out, e.buf...)
+}
+
+// series appends one metric entry.
+func (e *binaryEncoder) series(mf *dto.MetricFamily, suffix string, pairs []*dto.LabelPair, le string, value float64) {
+	e.key = append(append(e.key[:0], mf.GetName()...), suffix...)
+	name := e.intern(e.key)
+	typ := e.internString(metricTypeToString(mf.GetType()))
+	help := e.internString(mf.GetHelp())
+
+	e.labels = e.labels[:0]
+	forEachLabel(pairs, le, func(k, v string) {
+		e.labels = append(e.labels, e.internString(k), e.internString(v))
+	})
+
+	e.buf = appendCBORHead(e.buf, cborArray, uint64(len(wireSchema.Metric)))
+	e.buf = appendCBORHead(e.buf, cborUint, name)
+	e.buf = appendCBORHead(e.buf, cborUint, typ)
+	e.buf = appendCBORHead(e.buf, cborUint, help)
+	e.buf = appendCBORHead(e.buf, cborArray, uint64(len(e.labels)))
+	for _, idx := range e.labels {
+		e.buf = appendCBORHead(e.buf, cborUint, idx)
+	}
+	e.buf = appendCBORFloat(e.buf, value)
+	e.count++
+}
+
+// intern returns the string table index of s, adding it if needed.
+func (e *binaryEncoder) intern(s []byte) uint64 {
+	if idx, ok := e.strings[string(s)]; ok {
+		return idx
+	}
+	idx := uint64(len(e.strings))
+	e.strings[string(s)] = idx
+	e.table = appendCBORHead(e.table, cborText, uint64(len(s)))
+	e.table = append(e.table, s...)
+	return idx
+}
+
+// internString is intern for strings that are already allocated.
+func (e *binaryEncoder) internString(s string) uint64 {
+	if idx, ok := e.strings[s]; ok {
+		return idx
+	}
+	idx := uint64(len(e.strings))
+	e.strings[s] = idx
+	e.table = appendCBORText(e.table, s)
+	return idx
+}
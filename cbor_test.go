@@ -0,0 +1,177 @@
+package prommy
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io/fs"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// decodeTestCBOR decodes the subset of CBOR produced by the binary encoder,
+// mirroring the decoder in static/app.js.
+func decodeTestCBOR(t *testing.T, data []byte) interface{} {
+	t.Helper()
+	v, rest := decodeTestCBORItem(t, data)
+	if len(rest) != 0 {
+		t.Fatalf("%d trailing bytes after CBOR item", len(rest))
+	}
+	return v
+}
+
+func decodeTestCBORItem(t *testing.T, data []byte) (interface{}, []byte) {
+	t.Helper()
+	major, info := data[0]>>5, data[0]&0x1f
+	data = data[1:]
+
+	if major == 7 {
+		switch info {
+		case 20:
+			return false, data
+		case 21:
+			return true, data
+		case 22:
+			return nil, data
+		case 27:
+			return math.Float64frombits(binary.BigEndian.Uint64(data)), data[8:]
+		}
+		t.Fatalf("unsupported simple value %d", info)
+	}
+
+	n := uint64(info)
+	switch info {
+	case 24:
+		n, data = uint64(data[0]), data[1:]
+	case 25:
+		n, data = uint64(binary.BigEndian.Uint16(data)), data[2:]
+	case 26:
+		n, data = uint64(binary.BigEndian.Uint32(data)), data[4:]
+	case 27:
+		n, data = binary.BigEndian.Uint64(data), data[8:]
+	}
+
+	switch major {
+	case 0:
+		return n, data
+	case 3:
+		return string(data[:n]), data[n:]
+	case 4:
+		items := make([]interface{}, n)
+		for i := range items {
+			items[i], data = decodeTestCBORItem(t, data)
+		}
+		return items, data
+	}
+	t.Fatalf("unsupported major type %d", major)
+	return nil, nil
+}
+
+// decodeTestMetrics turns the strings and metrics fields of a binary
+// envelope back into Metric values.
+func decodeTestMetrics(strings, entries []interface{}) []Metric {
+	metrics := make([]Metric, 0, len(entries))
+	for _, e := range entries {
+		entry := e.([]interface{})
+		m := Metric{
+			Name:  strings[entry[0].(uint64)].(string),
+			Type:  strings[entry[1].(uint64)].(string),
+			Help:  strings[entry[2].(uint64)].(string),
+			Value: entry[4].(float64),
+		}
+		if labels := entry[3].([]interface{}); len(labels) > 0 {
+			m.Labels = make(map[string]string)
+			for i := 0; i < len(labels); i += 2 {
+				m.Labels[strings[labels[i].(uint64)].(string)] = strings[labels[i+1].(uint64)].(string)
+			}
+		}
+		metrics = append(metrics, m)
+	}
+	return metrics
+}
+
+func TestWireSchemaMatchesStatic(t *testing.T) {
+	data, err := fs.ReadFile(embeddedFiles, "protocol.json")
+	if err != nil {
+		t.Fatalf("read protocol.json: %v", err)
+	}
+	got := wireSchema
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("parse protocol.json: %v", err)
+	}
+	if !reflect.DeepEqual(got, wireSchema) {
+		t.Errorf("static/protocol.json = %+v, want %+v", got, wireSchema)
+	}
+}
+
+func TestBinaryEncoderMatchesJSON(t *testing.T) {
+	mfs := testFamilies(t, 200)
+	encoder := newBinaryEncoder()
+
+	// Round-trip the reference through JSON so empty labels compare equal
+	reference, err := json.Marshal(convertMetrics(mfs))
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	var want []Metric
+	if err := json.Unmarshal(reference, &want); err != nil {
+		t.Fatalf("unmarshal reference: %v", err)
+	}
+
+	for pass := 0; pass < 2; pass++ {
+		payload := encoder.encode(mfs)
+		// The payload is two consecutive items, so wrap it to decode both
+		fields := decodeTestCBOR(t, append([]byte{cborArray | 2}, payload...)).([]interface{})
+		got := decodeTestMetrics(fields[0].([]interface{}), fields[1].([]interface{}))
+
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("pass %d: binary encoder output differs from convertMetrics", pass)
+		}
+		if len(payload) >= len(reference) {
+			t.Errorf("pass %d: binary payload is %d bytes, JSON is %d", pass, len(payload), len(reference))
+		}
+	}
+}
+
+func TestBinaryEnvelope(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_ratio"})
+	reg.MustRegister(gauge)
+	gauge.Set(math.Inf(-1))
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("gather: %v", err)
+	}
+
+	hub := newHub(&Config{})
+	hub.mu.Lock()
+	snap := hub.record(&tick{
+		json:   []byte(`[]`),
+		cbor:   newBinaryEncoder().encode(mfs),
+		errors: []GatherError{{Collector: "db", Kind: GatherErrorCollector, Message: "down"}},
+	})
+	resync := hub.envelope(snap, encodingCBOR, true)
+	hub.mu.Unlock()
+
+	if f := snap.frame(encodingCBOR); f.messageType != websocket.BinaryMessage {
+		t.Errorf("binary frame message type = %d, want binary", f.messageType)
+	}
+	fields := decodeTestCBOR(t, resync.data).([]interface{})
+	if len(fields) != len(wireSchema.Envelope) {
+		t.Fatalf("envelope has %d fields, want %d", len(fields), len(wireSchema.Envelope))
+	}
+	if fields[0] != uint64(wireSchema.Version) || fields[1] != snap.seq || fields[3] != hub.epoch || fields[4] != true {
+		t.Errorf("envelope header = %v", fields[:5])
+	}
+	wantErrors := []interface{}{[]interface{}{"db", "collector", "down"}}
+	if !reflect.DeepEqual(fields[5], wantErrors) {
+		t.Errorf("errors = %v, want %v", fields[5], wantErrors)
+	}
+	metrics := decodeTestMetrics(fields[6].([]interface{}), fields[7].([]interface{}))
+	if len(metrics) != 1 || !math.IsInf(metrics[0].Value, -1) {
+		t.Errorf("metrics = %+v, want one -Inf gauge", metrics)
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/anyproto/prommy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// How often the child's metrics endpoint is probed while it starts up.
+const readyPollInterval = 100 * time.Millisecond
+
+// runExec starts a command, serves a dashboard of its metrics and process
+// statistics, and returns the command's exit code once prommy is told to
+// stop. Signals are forwarded to the command while it runs.
+func runExec(args []string) (int, error) {
+	flags := flag.NewFlagSet("prommy exec", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: prommy exec [flags] -- command [args...]")
+		flags.PrintDefaults()
+	}
+	port := flags.Int("metrics-port", 0, "port the command serves Prometheus metrics on, 0 for process statistics only")
+	path := flags.String("metrics-path", "/metrics", "path of the command's metrics endpoint")
+	wait := flags.Duration("wait", 30*time.Second, "how long to wait for the metrics endpoint to come up")
+	exitWithChild := flags.Bool("exit", false, "exit as soon as the command does instead of keeping the dashboard up")
+	server := addServerFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return 0, err
+	}
+	command := flags.Args()
+	if len(command) == 0 {
+		flags.Usage()
+		return 0, errors.New("no command given")
+	}
+
+	// Listen before starting the command so a busy port fails fast
+	listener, err := net.Listen("tcp", *server.listen)
+	if err != nil {
+		return 0, err
+	}
+
+	// The command stays in prommy's process group, so it can read from and
+	// write to the terminal like any foreground job
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, forwardedSignals...)
+	defer signal.Stop(signals)
+
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+	child := newChildGatherer(cmd.Process.Pid)
+
+	var scraper *prommy.Scraper
+	if *port > 0 {
+		target := "http://" + net.JoinHostPort("127.0.0.1", strconv.Itoa(*port)) + *path
+		if scraper, err = prommy.NewScraper([]string{target}, 0); err != nil {
+			cmd.Process.Kill()
+			return 0, err
+		}
+	}
+
+	opts, err := server.options(child)
+	if err == nil {
+		var handler http.Handler
+		if handler, err = prommy.New(opts...); err == nil {
+			go http.Serve(listener, handler)
+		}
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		return 0, err
+	}
+	fmt.Fprintf(os.Stderr, "prommy: dashboard for %s on %s\n", command[0], listener.Addr())
+
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		child.exit(exitCode(cmd.ProcessState))
+		close(exited)
+	}()
+
+	if scraper != nil {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), *wait)
+			defer cancel()
+			go func() {
+				select {
+				case <-exited:
+					cancel()
+				case <-ctx.Done():
+				}
+			}()
+			if err := waitReady(ctx, scraper); err != nil {
+				fmt.Fprintf(os.Stderr, "prommy: metrics endpoint not ready: %v\n", err)
+			}
+			// Scrape from now on so a missing endpoint shows up on the dashboard
+			child.addSource(scraper)
+		}()
+	}
+
+	for {
+		select {
+		case sig := <-signals:
+			if child.exited() {
+				return child.code(), nil
+			}
+			// A Ctrl-C typed at the terminal already reached the command,
+			// forwarding it as well would deliver it twice
+			if !fromTerminal(sig) {
+				cmd.Process.Signal(sig)
+			}
+		case <-exited:
+			fmt.Fprintf(os.Stderr, "prommy: %s exited with code %d\n", command[0], child.code())
+			if *exitWithChild {
+				return child.code(), nil
+			}
+			fmt.Fprintln(os.Stderr, "prommy: keeping the dashboard up, interrupt to exit")
+			exited = nil
+		}
+	}
+}
+
+// waitReady scrapes until the endpoint answers or ctx is done.
+func waitReady(ctx context.Context, scraper *prommy.Scraper) error {
+	ticker := time.NewTicker(readyPollInterval)
+	defer ticker.Stop()
+	for {
+		_, err := scraper.Gather()
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-ticker.C:
+		}
+	}
+}
+
+// childGatherer gathers a child process's statistics and its own metrics
+// while it runs. Once it exits, the last gather is served unchanged so the
+// dashboard keeps showing its final state, together with its exit code.
+type childGatherer struct {
+	status   *prometheus.Registry
+	up       prometheus.Gauge
+	exitCode prometheus.Gauge
+
+	mu      sync.Mutex
+	sources prometheus.Gatherers
+	last    []*dto.MetricFamily
+
+	done atomic.Bool
+	rc   atomic.Int64
+}
+
+// newChildGatherer collects CPU, memory and file descriptor statistics of
+// the process pid from /proc as child_process_* metrics.
+func newChildGatherer(pid int) *childGatherer {
+	process := prometheus.NewRegistry()
+	process.MustRegister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{
+		PidFn:     func() (int, error) { return pid, nil },
+		Namespace: "child",
+	}))
+
+	g := &childGatherer{
+		status: prometheus.NewRegistry(),
+		up: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "child_up",
+			Help: "Whether the command started by prommy exec is running.",
+		}),
+		exitCode: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "child_exit_code",
+			Help: "Exit code of the command started by prommy exec, 128 plus the signal number if it was killed.",
+		}),
+		sources: prometheus.Gatherers{process},
+	}
+	g.up.Set(1)
+	g.status.MustRegister(g.up)
+	return g
+}
+
+// addSource starts gathering src as well, such as the child's metrics endpoint.
+func (g *childGatherer) addSource(src prometheus.Gatherer) {
+	g.mu.Lock()
+	g.sources = append(g.sources, src)
+	g.mu.Unlock()
+}
+
+// exit records that the child exited with code.
+func (g *childGatherer) exit(code int) {
+	g.rc.Store(int64(code))
+	g.done.Store(true)
+	g.up.Set(0)
+	g.exitCode.Set(float64(code))
+	g.status.MustRegister(g.exitCode)
+}
+
+func (g *childGatherer) exited() bool {
+	return g.done.Load()
+}
+
+func (g *childGatherer) code() int {
+	return int(g.rc.Load())
+}
+
+// Gather implements prometheus.Gatherer.
+func (g *childGatherer) Gather() ([]*dto.MetricFamily, error) {
+	return prometheus.Gatherers{prometheus.GathererFunc(g.gatherChild), g.status}.Gather()
+}
+
+// gatherChild gathers the child's sources, or returns the last complete
+// result once the child has exited.
+func (g *childGatherer) gatherChild() ([]*dto.MetricFamily, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.done.Load() {
+		return g.last, nil
+	}
+	mfs, err := g.sources.Gather()
+	if err == nil {
+		g.last = mfs
+	}
+	return mfs, err
+}
@@ -0,0 +1,20 @@
+//go:build !unix
+
+package main
+
+import (
+	"os"
+)
+
+// Signals passed on to the command started by prommy exec.
+var forwardedSignals = []os.Signal{os.Interrupt}
+
+// fromTerminal reports false, every signal is forwarded.
+func fromTerminal(sig os.Signal) bool {
+	return false
+}
+
+// exitCode returns the command's exit code.
+func exitCode(state *os.ProcessState) int {
+	return state.ExitCode()
+}
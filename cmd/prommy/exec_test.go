@@ -0,0 +1,224 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func TestExitCode(t *testing.T) {
+	for script, want := range map[string]int{
+		"exit 3":        3,
+		"kill -TERM $$": 143,
+	} {
+		cmd := exec.Command("sh", "-c", script)
+		cmd.Run()
+		if got := exitCode(cmd.ProcessState); got != want {
+			t.Errorf("exitCode(%q) = %d, want %d", script, got, want)
+		}
+	}
+}
+
+func TestChildGathererKeepsLastGather(t *testing.T) {
+	cmd := exec.Command("sleep", "10")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	g := newChildGatherer(cmd.Process.Pid)
+
+	names := func() map[string]float64 {
+		t.Helper()
+		mfs, err := g.Gather()
+		if err != nil {
+			t.Fatalf("Gather: %v", err)
+		}
+		values := map[string]float64{}
+		for _, mf := range mfs {
+			m := mf.GetMetric()[0]
+			values[mf.GetName()] = m.GetGauge().GetValue() + m.GetCounter().GetValue()
+		}
+		return values
+	}
+
+	running := names()
+	if running["child_up"] != 1 || running["child_process_start_time_seconds"] == 0 {
+		t.Fatalf("while running = %v, want child_up and process statistics", running)
+	}
+
+	cmd.Process.Kill()
+	cmd.Wait()
+	g.exit(exitCode(cmd.ProcessState))
+
+	exited := names()
+	if exited["child_up"] != 0 || exited["child_exit_code"] != 137 {
+		t.Errorf("after exit child_up, child_exit_code = %v, %v; want 0, 137", exited["child_up"], exited["child_exit_code"])
+	}
+	if exited["child_process_start_time_seconds"] != running["child_process_start_time_seconds"] {
+		t.Errorf("process statistics changed after exit: %v, want the last gather %v", exited, running)
+	}
+}
+
+// TestExecInteractive runs prommy exec in a session of its own with a
+// pseudo-terminal, and checks that the command can read from it.
+func TestExecInteractive(t *testing.T) {
+	if os.Getenv("PROMMY_EXEC_HELPER") == "interactive" {
+		code, err := runExec([]string{"-exit", "-listen", "127.0.0.1:0", "--", "sh", "-c", "read line; echo got:$line"})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		os.Exit(code)
+	}
+
+	ptm, pts, err := openPTY()
+	if err != nil {
+		t.Skipf("no pseudo-terminal: %v", err)
+	}
+	defer ptm.Close()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestExecInteractive$")
+	cmd.Env = append(os.Environ(), "PROMMY_EXEC_HELPER=interactive")
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = pts, pts, pts
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	pts.Close()
+	defer cmd.Process.Kill()
+
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(ptm)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				t.Fatal("terminal closed before the command read its input")
+			}
+			if strings.HasPrefix(line, "prommy: dashboard for") {
+				fmt.Fprintln(ptm, "hello")
+			}
+			if strings.TrimSpace(line) == "got:hello" {
+				return
+			}
+		case <-timeout:
+			t.Fatal("command did not read from the terminal")
+		}
+	}
+}
+
+// TestExecForwardsSignals starts prommy exec as a background job of a
+// terminal and signals it directly, as another shell or a supervisor would.
+// The terminal did not send the signal, so prommy must pass it on.
+func TestExecForwardsSignals(t *testing.T) {
+	switch os.Getenv("PROMMY_EXEC_HELPER") {
+	case "job":
+		// The session leader in the foreground, starting prommy as a background job
+		cmd := exec.Command(os.Args[0], "-test.run=^TestExecForwardsSignals$")
+		cmd.Env = append(os.Environ(), "PROMMY_EXEC_HELPER=exec")
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+		cmd.Run()
+		os.Exit(exitCode(cmd.ProcessState))
+	case "exec":
+		code, err := runExec([]string{"-exit", "-listen", "127.0.0.1:0", "--", "sh", "-c",
+			`trap 'echo got:INT; exit 7' INT; echo ready:$PPID; while :; do sleep 0.05; done`})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		os.Exit(code)
+	}
+
+	ptm, pts, err := openPTY()
+	if err != nil {
+		t.Skipf("no pseudo-terminal: %v", err)
+	}
+	defer ptm.Close()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestExecForwardsSignals$")
+	cmd.Env = append(os.Environ(), "PROMMY_EXEC_HELPER=job")
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = pts, pts, pts
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	pts.Close()
+	defer cmd.Process.Kill()
+
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(ptm)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				t.Fatal("terminal closed before the command got the signal")
+			}
+			line = strings.TrimSpace(line)
+			if pid, ok := strings.CutPrefix(line, "ready:"); ok {
+				n, err := strconv.Atoi(pid)
+				if err != nil {
+					t.Fatalf("prommy pid %q: %v", pid, err)
+				}
+				// prommy leads its own process group, which holds the command
+				defer syscall.Kill(-n, syscall.SIGKILL)
+				if err := syscall.Kill(n, syscall.SIGINT); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if line == "got:INT" {
+				return
+			}
+		case <-timeout:
+			t.Fatal("signal sent to prommy did not reach the command")
+		}
+	}
+}
+
+// openPTY opens a pseudo-terminal pair.
+func openPTY() (ptm, pts *os.File, err error) {
+	ptm, err = os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	var unlock int32
+	var n uint32
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, ptm.Fd(), syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); errno != 0 {
+		ptm.Close()
+		return nil, nil, errno
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, ptm.Fd(), syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n))); errno != 0 {
+		ptm.Close()
+		return nil, nil, errno
+	}
+	pts, err = os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		ptm.Close()
+		return nil, nil, err
+	}
+	return ptm, pts, nil
+}
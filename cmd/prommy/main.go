@@ -0,0 +1,206 @@
+// Command prommy serves the prommy dashboard over metrics scraped from other
+// processes, so any Prometheus-instrumented service can be watched without
+// changing its code.
+//
+// Usage:
+//
+//	prommy [flags] [target URL...]
+//	prommy exec [flags] -- command [args...]
+//
+// For example, to watch a service exposing metrics on port 9100:
+//
+//	prommy -listen :8080 http://localhost:9100/metrics
+//
+// to combine the dashboards of services that embed prommy:
+//
+//	prommy -peer ws://orders:8080 -peer ws://billing:8080
+//
+// to show what batch jobs send with Prometheus remote_write or push like
+// to a Pushgateway:
+//
+//	prommy -remote-write -push
+//
+// to show what legacy services send as StatsD or DogStatsD over UDP:
+//
+//	prommy -statsd :8125 -statsd-mapping mapping.yml
+//
+// or to start it and watch it for as long as it runs:
+//
+//	prommy exec --metrics-port 9100 -- ./service
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/anyproto/prommy"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// stringList is a flag that may be given several times.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+func main() {
+	args := os.Args[1:]
+	if len(args) > 0 && args[0] == "exec" {
+		code, err := runExec(args[1:])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "prommy exec:", err)
+			os.Exit(1)
+		}
+		os.Exit(code)
+	}
+	if err := run(args); err != nil {
+		fmt.Fprintln(os.Stderr, "prommy:", err)
+		os.Exit(1)
+	}
+}
+
+// serverFlags are the dashboard settings shared by every mode.
+type serverFlags struct {
+	listen    *string
+	interval  *time.Duration
+	auth      *string
+	dashboard *string
+	config    *string
+	forward   *string
+}
+
+// addServerFlags defines the dashboard flags on flags.
+func addServerFlags(flags *flag.FlagSet) *serverFlags {
+	return &serverFlags{
+		listen:    flags.String("listen", ":8080", "address to serve the dashboard on"),
+		interval:  flags.Duration("interval", time.Second, "how often metrics are scraped"),
+		auth:      flags.String("auth", "", "basic auth credentials for the dashboard as user:password"),
+		dashboard: flags.String("dashboard", "", "JSON file with the dashboard layout"),
+		config:    flags.String("config", "", "YAML or JSON config file, watched for changes"),
+		forward:   flags.String("remote-write-to", "", "remote_write URL to forward the samples of every interval to"),
+	}
+}
+
+// options turns the flags into prommy options serving the metrics of source.
+func (f *serverFlags) options(source prometheus.Gatherer) ([]prommy.Option, error) {
+	opts := []prommy.Option{
+		// An empty registry keeps prommy's own runtime metrics out of the dashboard
+		prommy.WithRegistry(prometheus.NewRegistry()),
+		prommy.WithGatherer(source),
+		prommy.WithTickerInterval(*f.interval),
+		prommy.WithStrict(),
+	}
+	if *f.auth != "" {
+		user, pass, ok := strings.Cut(*f.auth, ":")
+		if !ok {
+			return nil, errors.New("-auth must be user:password")
+		}
+		opts = append(opts, prommy.WithBasicAuth(user, pass))
+	}
+	if *f.dashboard != "" {
+		layout, err := os.ReadFile(*f.dashboard)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, prommy.WithDashboardJSON(string(layout)))
+	}
+	if *f.config != "" {
+		opts = append(opts, prommy.WithConfigFile(*f.config))
+	}
+	if *f.forward != "" {
+		opts = append(opts, prommy.WithRemoteWriteTo(prommy.RemoteWriteConfig{URL: *f.forward}))
+	}
+	return opts, nil
+}
+
+// run parses the command line and serves the dashboard until the listener fails.
+func run(args []string) error {
+	flags := flag.NewFlagSet("prommy", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: prommy [flags] [target URL...]")
+		fmt.Fprintln(flags.Output(), "       prommy exec [flags] -- command [args...]")
+		flags.PrintDefaults()
+	}
+	var targets stringList
+	var targetFiles stringList
+	var peers stringList
+	flags.Var(&targets, "target", "metrics URL to scrape, may be repeated")
+	flags.Var(&targetFiles, "file-sd", "Prometheus file_sd JSON or YAML file listing targets, watched for changes, may be repeated")
+	flags.Var(&peers, "peer", "prommy dashboard to federate, ws:// to stream or http:// to poll, may be repeated")
+	timeout := flags.Duration("timeout", 0, "scrape timeout, 0 for the default of 5s")
+	remoteWrite := flags.Bool("remote-write", false, "accept Prometheus remote_write requests on /api/v1/write")
+	pushes := flags.Bool("push", false, "accept metrics pushed to /metrics/job/<job> like a Pushgateway")
+	pushTTL := flags.Duration("push-ttl", 0, "forget pushed groups not pushed again for this long, 0 keeps them until deleted")
+	statsdAddr := flags.String("statsd", "", "UDP address to receive StatsD and DogStatsD metrics on, such as :8125")
+	statsdMapping := flags.String("statsd-mapping", "", "YAML or JSON file of mappings naming StatsD metrics")
+	server := addServerFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	targets = append(targets, flags.Args()...)
+	if len(targets) == 0 && len(targetFiles) == 0 && len(peers) == 0 && !*remoteWrite && !*pushes && *statsdAddr == "" {
+		flags.Usage()
+		return errors.New("no targets to scrape, peers to federate, -remote-write, -push or -statsd")
+	}
+	scraper, err := prommy.NewScraper(targets, *timeout)
+	if err != nil {
+		return err
+	}
+	if len(targetFiles) > 0 {
+		if err := scraper.WatchTargetFiles(context.Background(), targetFiles, nil); err != nil {
+			return err
+		}
+	}
+
+	federator, err := prommy.NewFederator(peers, *server.interval)
+	if err != nil {
+		return err
+	}
+	federator.Start(context.Background(), nil)
+
+	var mappings []prommy.StatsDMapping
+	if *statsdMapping != "" {
+		if mappings, err = prommy.LoadStatsDMappings(*statsdMapping); err != nil {
+			return err
+		}
+	}
+	statsd, err := prommy.NewStatsD(mappings)
+	if err != nil {
+		return err
+	}
+	if *statsdAddr != "" {
+		if _, err := statsd.Listen(context.Background(), *statsdAddr, nil); err != nil {
+			return err
+		}
+	}
+
+	opts, err := server.options(prometheus.Gatherers{scraper, federator, statsd})
+	if err != nil {
+		return err
+	}
+	if *remoteWrite {
+		opts = append(opts, prommy.WithRemoteWrite(0))
+	}
+	if *pushes {
+		opts = append(opts, prommy.WithPush(*pushTTL))
+	}
+	handler, err := prommy.New(opts...)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "prommy: serving %d target(s) and %d peer(s) on %s\n", len(scraper.Targets()), len(peers), *server.listen)
+	return http.ListenAndServe(*server.listen, handler)
+}
@@ -0,0 +1,265 @@
+package prommy
+
+import (
+	"compress/flate"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// FieldError describes one invalid configuration setting.
+type FieldError struct {
+	Field  string // Config field or environment variable, e.g. "Dashboard[1][0]" or "PROMMY_INTERVAL"
+	Reason string // What is wrong with the value
+	Err    error  // Underlying parse error, if any
+}
+
+func (e *FieldError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %s: %v", e.Field, e.Reason, e.Err)
+	}
+	return e.Field + ": " + e.Reason
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// ConfigError is returned by New when the configuration is invalid. It lists
+// every problem found rather than only the first, and unwraps to the
+// individual *FieldError values for errors.As.
+type ConfigError struct {
+	Errors []*FieldError
+}
+
+func (e *ConfigError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		msgs[i] = err.Error()
+	}
+	return "invalid prommy configuration: " + strings.Join(msgs, "; ")
+}
+
+func (e *ConfigError) Unwrap() []error {
+	errs := make([]error, len(e.Errors))
+	for i, err := range e.Errors {
+		errs[i] = err
+	}
+	return errs
+}
+
+// defaultConfig returns the configuration that options and environment
+// variables are applied on top of.
+func defaultConfig() *Config {
+	return &Config{
+		Registry:       prometheus.DefaultRegisterer.(*prometheus.Registry),
+		TickerInterval: time.Second,
+	}
+}
+
+// optionError records a value that an option or environment variable could
+// not parse. Outside strict mode the setting keeps its previous value.
+func (c *Config) optionError(field, reason string, err error) {
+	c.optionErrors = append(c.optionErrors, &FieldError{Field: field, Reason: reason, Err: err})
+}
+
+// check validates the configuration once all options and environment
+// variables are applied. Option errors are only fatal in strict mode;
+// otherwise they are logged and the affected settings keep their defaults.
+// A config file that cannot be loaded is always fatal, since running
+// without it would silently ignore every setting it holds.
+func (c *Config) check() error {
+	errs := append(c.fileErrors, c.validate()...)
+	if c.Strict {
+		errs = append(c.optionErrors, errs...)
+	} else {
+		for _, err := range c.optionErrors {
+			c.logger().Warn("Ignoring invalid option", "field", err.Field, "error", err)
+		}
+	}
+	if len(errs) > 0 {
+		return &ConfigError{Errors: errs}
+	}
+	return nil
+}
+
+// validate checks the settings that cannot be given a sensible default when
+// they are wrong.
+func (c *Config) validate() []*FieldError {
+	var errs []*FieldError
+	invalid := func(field, format string, args ...interface{}) {
+		errs = append(errs, &FieldError{Field: field, Reason: fmt.Sprintf(format, args...)})
+	}
+
+	if c.Registry == nil {
+		invalid("Registry", "must not be nil")
+	}
+	for i, g := range c.Gatherers {
+		if g == nil {
+			invalid(fmt.Sprintf("Gatherers[%d]", i), "must not be nil")
+		}
+	}
+	for name, collector := range c.TimedCollectors {
+		switch {
+		case name == "":
+			invalid("TimedCollectors", "collector names must not be empty")
+		case collector == nil:
+			invalid(fmt.Sprintf("TimedCollectors[%q]", name), "must not be nil")
+		}
+	}
+	for i, rule := range c.Relabel {
+		if _, err := rule.compile(); err != nil {
+			invalid(fmt.Sprintf("Relabel[%d]", i), "%v", err)
+		}
+	}
+	if c.TickerInterval <= 0 {
+		invalid("TickerInterval", "must be positive, got %v", c.TickerInterval)
+	}
+	for _, d := range []struct {
+		field string
+		value time.Duration
+	}{
+		{"GatherTimeout", c.GatherTimeout},
+		{"SnapshotMaxAge", c.SnapshotMaxAge},
+		{"MinInterval", c.MinInterval},
+		{"MaxInterval", c.MaxInterval},
+		{"RemoteWriteRetention", c.RemoteWriteRetention},
+		{"PushTTL", c.PushTTL},
+	} {
+		if d.value < 0 {
+			invalid(d.field, "must not be negative, got %v", d.value)
+		}
+	}
+	if c.MinInterval > 0 && c.MaxInterval > 0 && c.MinInterval > c.MaxInterval {
+		invalid("MinInterval", "%v is longer than MaxInterval %v", c.MinInterval, c.MaxInterval)
+	}
+
+	for _, n := range []struct {
+		field string
+		value int
+	}{
+		{"ReplayBufferSize", c.ReplayBufferSize},
+		{"ClientBufferSize", c.ClientBufferSize},
+		{"MaxConnections", c.MaxConnections},
+		{"MaxConnectionsPerIP", c.MaxConnectionsPerIP},
+		{"MaxConnectionsPerUser", c.MaxConnectionsPerUser},
+		{"CompressionThreshold", c.CompressionThreshold},
+	} {
+		if n.value < 0 {
+			invalid(n.field, "must not be negative, got %d", n.value)
+		}
+	}
+	if c.CompressionLevel < flate.HuffmanOnly || c.CompressionLevel > flate.BestCompression {
+		invalid("CompressionLevel", "must be between %d and %d, got %d", flate.HuffmanOnly, flate.BestCompression, c.CompressionLevel)
+	}
+
+	switch c.SlowClientPolicy {
+	case "", SlowClientDisconnect, SlowClientDropOldest, SlowClientCoalesce:
+	default:
+		invalid("SlowClientPolicy", "unknown policy %q", c.SlowClientPolicy)
+	}
+
+	if c.BasicAuth != nil && c.BasicAuth.Username == "" {
+		invalid("BasicAuth", "username must not be empty")
+	}
+
+	if p := c.PrefixURI; p != "" {
+		switch {
+		case !strings.HasPrefix(p, "/"):
+			invalid("PrefixURI", "%q must start with /", p)
+		case strings.ContainsAny(p, "?# \t\r\n"):
+			invalid("PrefixURI", "%q must be a plain path without query, fragment or whitespace", p)
+		}
+	}
+
+	for i, row := range c.Dashboard {
+		for j, item := range row {
+			if reason := dashboardItemError(item); reason != "" {
+				invalid(fmt.Sprintf("Dashboard[%d][%d]", i, j), "%s", reason)
+			}
+		}
+	}
+
+	if rw := c.RemoteWriteTo; rw != nil {
+		if u, err := url.Parse(rw.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			invalid("RemoteWriteTo.URL", "%q must be an http or https URL", rw.URL)
+		}
+		if rw.BasicAuth != nil && rw.BasicAuth.Username == "" {
+			invalid("RemoteWriteTo.BasicAuth", "username must not be empty")
+		}
+		if rw.BatchSize < 0 {
+			invalid("RemoteWriteTo.BatchSize", "must not be negative, got %d", rw.BatchSize)
+		}
+		if rw.BufferSize < 0 {
+			invalid("RemoteWriteTo.BufferSize", "must not be negative, got %d", rw.BufferSize)
+		}
+		if rw.Timeout < 0 {
+			invalid("RemoteWriteTo.Timeout", "must not be negative, got %v", rw.Timeout)
+		}
+	}
+
+	return errs
+}
+
+// dashboardItemError explains why item is neither a metric name nor an
+// object with a name and optional short and section labels, or returns ""
+// for a valid item. Objects may also compare the metric across the values
+// of a label with "compare", "values", "view" and "delta".
+func dashboardItemError(item interface{}) string {
+	switch v := item.(type) {
+	case string:
+		if v == "" {
+			return "metric name must not be empty"
+		}
+	case map[string]string:
+		if v["name"] == "" {
+			return `missing "name"`
+		}
+		return comparisonError(v["view"], v["delta"])
+	case map[string]interface{}:
+		for _, key := range []string{"name", "short", "section", "compare", "view", "delta"} {
+			if value, ok := v[key]; ok {
+				if _, ok := value.(string); !ok {
+					return fmt.Sprintf("%q must be a string, got %T", key, value)
+				}
+			}
+		}
+		if name, _ := v["name"].(string); name == "" {
+			return `missing "name"`
+		}
+		if values, ok := v["values"]; ok {
+			list, ok := values.([]interface{})
+			if !ok {
+				return fmt.Sprintf(`"values" must be a list of label values, got %T`, values)
+			}
+			for _, value := range list {
+				if _, ok := value.(string); !ok {
+					return fmt.Sprintf(`"values" must be a list of label values, got %T in it`, value)
+				}
+			}
+			if _, ok := v["compare"]; !ok {
+				return `"values" needs "compare" to name the label`
+			}
+		}
+		view, _ := v["view"].(string)
+		delta, _ := v["delta"].(string)
+		return comparisonError(view, delta)
+	default:
+		return fmt.Sprintf("must be a metric name or an object with a name, got %T", item)
+	}
+	return ""
+}
+
+// comparisonError checks the view and delta of a comparison item.
+func comparisonError(view, delta string) string {
+	switch {
+	case view != "" && view != "overlay" && view != "split":
+		return fmt.Sprintf(`"view" must be "overlay" or "split", got %q`, view)
+	case delta != "" && delta != "difference" && delta != "ratio":
+		return fmt.Sprintf(`"delta" must be "difference" or "ratio", got %q`, delta)
+	}
+	return ""
+}
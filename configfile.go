@@ -0,0 +1,262 @@
+package prommy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configPollInterval is how often the config file is checked for changes.
+// Polling works the same on every platform and filesystem, including
+// ConfigMap volumes whose files are replaced through symlink swaps.
+const configPollInterval = 2 * time.Second
+
+// fileConfig is the schema of a config file. Settings left out keep the
+// value given by options and environment variables.
+type fileConfig struct {
+	Interval  *fileDuration    `json:"interval" yaml:"interval"`
+	BasicAuth *fileBasicAuth   `json:"basic_auth" yaml:"basic_auth"`
+	Dashboard [][]interface{}  `json:"dashboard" yaml:"dashboard"`
+	Prefix    *string          `json:"prefix" yaml:"prefix"`
+	Limits    *fileLimitConfig `json:"limits" yaml:"limits"`
+	Relabel   []RelabelConfig  `json:"relabel" yaml:"relabel"`
+}
+
+type fileBasicAuth struct {
+	Username string `json:"username" yaml:"username"`
+	Password string `json:"password" yaml:"password"`
+}
+
+type fileLimitConfig struct {
+	MaxConnections        *int          `json:"max_connections" yaml:"max_connections"`
+	MaxConnectionsPerIP   *int          `json:"max_connections_per_ip" yaml:"max_connections_per_ip"`
+	MaxConnectionsPerUser *int          `json:"max_connections_per_user" yaml:"max_connections_per_user"`
+	MinInterval           *fileDuration `json:"min_interval" yaml:"min_interval"`
+	MaxInterval           *fileDuration `json:"max_interval" yaml:"max_interval"`
+}
+
+// fileDuration accepts either a Go duration string such as "1.5s" or a
+// number of milliseconds, matching PROMMY_INTERVAL.
+type fileDuration time.Duration
+
+func (d *fileDuration) parse(s string) error {
+	if ms, err := strconv.ParseInt(s, 10, 64); err == nil {
+		*d = fileDuration(time.Duration(ms) * time.Millisecond)
+		return nil
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q, want milliseconds or a duration like \"2s\"", s)
+	}
+	*d = fileDuration(v)
+	return nil
+}
+
+func (d *fileDuration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		s = string(data)
+	}
+	return d.parse(s)
+}
+
+func (d *fileDuration) UnmarshalYAML(node *yaml.Node) error {
+	return d.parse(node.Value)
+}
+
+// parseConfigFile decodes a config file, as JSON if its name ends in .json
+// and as YAML otherwise. Unknown keys are rejected so that typos are not
+// silently ignored.
+func parseConfigFile(path string, data []byte) (*fileConfig, error) {
+	var fc fileConfig
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&fc); err != nil {
+			return nil, err
+		}
+		return &fc, nil
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&fc); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	return &fc, nil
+}
+
+// apply overrides the settings of c that the file sets.
+func (fc *fileConfig) apply(c *Config) {
+	if fc.Interval != nil {
+		c.TickerInterval = time.Duration(*fc.Interval)
+	}
+	if fc.BasicAuth != nil {
+		c.BasicAuth = &BasicAuth{Username: fc.BasicAuth.Username, Password: fc.BasicAuth.Password}
+	}
+	if fc.Dashboard != nil {
+		c.Dashboard = fc.Dashboard
+	}
+	if fc.Prefix != nil {
+		c.PrefixURI = *fc.Prefix
+	}
+	if fc.Relabel != nil {
+		c.Relabel = fc.Relabel
+	}
+	if l := fc.Limits; l != nil {
+		if l.MaxConnections != nil {
+			c.MaxConnections = *l.MaxConnections
+		}
+		if l.MaxConnectionsPerIP != nil {
+			c.MaxConnectionsPerIP = *l.MaxConnectionsPerIP
+		}
+		if l.MaxConnectionsPerUser != nil {
+			c.MaxConnectionsPerUser = *l.MaxConnectionsPerUser
+		}
+		if l.MinInterval != nil {
+			c.MinInterval = time.Duration(*l.MinInterval)
+		}
+		if l.MaxInterval != nil {
+			c.MaxInterval = time.Duration(*l.MaxInterval)
+		}
+	}
+}
+
+// loadConfigFile applies c.ConfigFile on top of the options and environment.
+// The configuration without the file is kept so that a reload can drop
+// settings removed from it. A file that cannot be read or parsed makes New
+// fail, unlike on a reload, which keeps the running configuration.
+func (c *Config) loadConfigFile() {
+	base := *c
+	c.fileBase = &base
+	if c.ConfigFile == "" {
+		return
+	}
+	data, err := os.ReadFile(c.ConfigFile)
+	if err != nil {
+		c.fileErrors = append(c.fileErrors, &FieldError{Field: "ConfigFile", Reason: "cannot read config file", Err: err})
+		return
+	}
+	fc, err := parseConfigFile(c.ConfigFile, data)
+	if err != nil {
+		c.fileErrors = append(c.fileErrors, &FieldError{Field: "ConfigFile", Reason: "cannot parse " + c.ConfigFile, Err: err})
+		return
+	}
+	fc.apply(c)
+	c.fileData = data
+}
+
+// watchConfig polls the config file and applies changes while the server runs.
+func (s *Server) watchConfig() {
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+
+	var lastMod time.Time
+	var lastSize int64 = -1
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		info, err := os.Stat(s.config.ConfigFile)
+		if err != nil {
+			continue
+		}
+		if info.ModTime().Equal(lastMod) && info.Size() == lastSize {
+			continue
+		}
+		lastMod, lastSize = info.ModTime(), info.Size()
+		s.reloadConfig()
+	}
+}
+
+// reloadConfig re-reads the config file and applies the dashboard, interval,
+// relabel and basic auth settings without a restart. Connected clients are told to
+// fetch the new layout. An invalid file is logged and the running
+// configuration is kept.
+func (s *Server) reloadConfig() {
+	path := s.config.ConfigFile
+	data, err := os.ReadFile(path)
+	if err != nil {
+		s.logger.Warn("Cannot read config file", "path", path, "error", err)
+		return
+	}
+
+	s.liveMu.Lock()
+	if bytes.Equal(data, s.fileData) {
+		s.liveMu.Unlock()
+		return
+	}
+	s.fileData = data
+	s.liveMu.Unlock()
+
+	fc, err := parseConfigFile(path, data)
+	if err != nil {
+		s.logger.Warn("Ignoring invalid config file", "path", path, "error", err)
+		return
+	}
+	next := *s.config.fileBase
+	fc.apply(&next)
+	if errs := next.validate(); len(errs) > 0 {
+		s.logger.Warn("Ignoring invalid config file", "path", path, "error", &ConfigError{Errors: errs})
+		return
+	}
+
+	// Everything else is wired into the listener and hub at startup. Compare
+	// with the last applied file so that each change is reported once.
+	s.liveMu.Lock()
+	prev := s.applied
+	s.applied = &next
+	s.liveMu.Unlock()
+	for _, setting := range []struct {
+		field   string
+		changed bool
+	}{
+		{"PrefixURI", next.PrefixURI != prev.PrefixURI},
+		{"MaxConnections", next.MaxConnections != prev.MaxConnections},
+		{"MaxConnectionsPerIP", next.MaxConnectionsPerIP != prev.MaxConnectionsPerIP},
+		{"MaxConnectionsPerUser", next.MaxConnectionsPerUser != prev.MaxConnectionsPerUser},
+		{"MinInterval", next.MinInterval != prev.MinInterval},
+		{"MaxInterval", next.MaxInterval != prev.MaxInterval},
+	} {
+		if setting.changed {
+			s.logger.Warn("Config change needs a restart", "path", path, "field", setting.field)
+		}
+	}
+
+	s.liveMu.Lock()
+	s.auth = next.BasicAuth
+	layoutChanged := !reflect.DeepEqual(next.Dashboard, s.dashboard)
+	s.dashboard = next.Dashboard
+	intervalChanged := next.TickerInterval != s.interval
+	s.interval = next.TickerInterval
+	// Validated above, so this cannot fail
+	s.relabel, _ = compileRelabel(next.Relabel)
+	s.liveMu.Unlock()
+
+	if intervalChanged {
+		s.hub.setDefaultInterval(next.TickerInterval)
+		// The snapshot cache follows the gather interval, which may have moved with the default
+		s.gather.setMaxAge(s.snapshotMaxAge(s.hub.updateGatherInterval()))
+		s.hub.announce(intervalEvent(next.TickerInterval))
+	}
+	if layoutChanged {
+		s.hub.announce([]byte(`{"event":"dashboard"}`))
+	}
+	s.logger.Info("Reloaded config file", "path", path, "dashboard", layoutChanged, "interval", next.TickerInterval)
+}
+
+// intervalEvent tells clients the new default update interval in milliseconds.
+func intervalEvent(d time.Duration) []byte {
+	return []byte(`{"event":"interval","interval":` + strconv.FormatInt(d.Milliseconds(), 10) + `}`)
+}
@@ -0,0 +1,210 @@
+package prommy
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestConfigFile(t *testing.T) {
+	t.Setenv("PROMMY_INTERVAL", "3000")
+	t.Setenv("PROMMY_CONFIG", "")
+	dir := t.TempDir()
+
+	yamlPath := filepath.Join(dir, "prommy.yaml")
+	yamlData := `
+interval: 1.5s
+basic_auth:
+  username: ops
+  password: secret
+dashboard:
+  - [go_goroutines, {name: process_open_fds, short: FDS}]
+prefix: /metrics
+limits:
+  max_connections: 8
+  min_interval: 500
+relabel:
+  - {source_labels: [__name__], regex: "go_.*", action: drop}
+`
+	if err := os.WriteFile(yamlPath, []byte(yamlData), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	jsonPath := filepath.Join(dir, "prommy.json")
+	jsonData := `{"interval": 1500, "basic_auth": {"username": "ops", "password": "secret"},
+		"dashboard": [["go_goroutines", {"name": "process_open_fds", "short": "FDS"}]],
+		"prefix": "/metrics", "limits": {"max_connections": 8, "min_interval": "500ms"},
+		"relabel": [{"source_labels": ["__name__"], "regex": "go_.*", "action": "drop"}]}`
+	if err := os.WriteFile(jsonPath, []byte(jsonData), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{yamlPath, jsonPath} {
+		t.Run(filepath.Ext(path), func(t *testing.T) {
+			// The file overrides both options and PROMMY_INTERVAL
+			s, _ := newTestServer(t, WithNopLogger(), WithConfigFile(path), WithMaxConnections(2))
+			cfg := s.config
+			if cfg.TickerInterval != 1500*time.Millisecond {
+				t.Errorf("TickerInterval = %v, want 1.5s", cfg.TickerInterval)
+			}
+			if cfg.BasicAuth == nil || *cfg.BasicAuth != (BasicAuth{Username: "ops", Password: "secret"}) {
+				t.Errorf("BasicAuth = %+v", cfg.BasicAuth)
+			}
+			wantDashboard := [][]interface{}{{"go_goroutines", map[string]interface{}{"name": "process_open_fds", "short": "FDS"}}}
+			if !reflect.DeepEqual(cfg.Dashboard, wantDashboard) {
+				t.Errorf("Dashboard = %#v, want %#v", cfg.Dashboard, wantDashboard)
+			}
+			if cfg.PrefixURI != "/metrics" || cfg.MaxConnections != 8 || cfg.MinInterval != 500*time.Millisecond {
+				t.Errorf("PrefixURI, MaxConnections, MinInterval = %q, %d, %v", cfg.PrefixURI, cfg.MaxConnections, cfg.MinInterval)
+			}
+			wantRelabel := []RelabelConfig{{SourceLabels: []string{"__name__"}, Regex: "go_.*", Action: RelabelDrop}}
+			if !reflect.DeepEqual(cfg.Relabel, wantRelabel) || len(s.relabel) != 1 {
+				t.Errorf("Relabel = %+v, want %+v", cfg.Relabel, wantRelabel)
+			}
+		})
+	}
+
+	t.Run("unknown key", func(t *testing.T) {
+		path := filepath.Join(dir, "typo.yaml")
+		if err := os.WriteFile(path, []byte("intervall: 2s\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		// A file that cannot be loaded is fatal even outside strict mode
+		_, err := New(WithNopLogger(), WithConfigFile(path))
+		if err == nil || !strings.Contains(err.Error(), "ConfigFile") {
+			t.Errorf("New() error = %v, want ConfigFile error", err)
+		}
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		_, err := New(WithNopLogger(), WithConfigFile(filepath.Join(dir, "missing.yaml")))
+		if err == nil || !strings.Contains(err.Error(), "ConfigFile") {
+			t.Errorf("New() error = %v, want ConfigFile error", err)
+		}
+	})
+
+	t.Run("invalid values", func(t *testing.T) {
+		path := filepath.Join(dir, "invalid.yaml")
+		if err := os.WriteFile(path, []byte("prefix: metrics\ndashboard: [[1]]\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		// Validation errors are fatal even outside strict mode
+		_, err := New(WithNopLogger(), WithConfigFile(path))
+		if err == nil || !strings.Contains(err.Error(), "PrefixURI") || !strings.Contains(err.Error(), "Dashboard[0][0]") {
+			t.Errorf("New() error = %v, want PrefixURI and dashboard errors", err)
+		}
+	})
+}
+
+func TestConfigReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "prommy.yaml")
+	write := func(data string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("dashboard: [[metric_a]]\n")
+
+	s, srv := newTestServer(t, WithNopLogger(), WithConfigFile(path), WithBinaryEncoding())
+	dialer := websocket.Dialer{Subprotocols: []string{subprotocolCBOR}}
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	waitForClients(t, s.hub, 1)
+
+	dashboard := func(user, pass string) (int, [][]interface{}) {
+		t.Helper()
+		req, _ := http.NewRequest("GET", srv.URL+"/dashboard", nil)
+		if user != "" {
+			req.SetBasicAuth(user, pass)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET /dashboard: %v", err)
+		}
+		defer resp.Body.Close()
+		var layout [][]interface{}
+		json.NewDecoder(resp.Body).Decode(&layout)
+		return resp.StatusCode, layout
+	}
+
+	write("interval: 250ms\nbasic_auth: {username: ops, password: secret}\ndashboard: [[metric_b]]\n")
+	s.reloadConfig()
+
+	// Binary clients get announcements as JSON text frames, interval first
+	for _, want := range []string{`{"event":"interval","interval":250}`, `{"event":"dashboard"}`} {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if messageType != websocket.TextMessage || string(data) != want {
+			t.Errorf("announcement = %d %s, want text %s", messageType, data, want)
+		}
+	}
+
+	if code, _ := dashboard("", ""); code != http.StatusUnauthorized {
+		t.Errorf("GET /dashboard without credentials = %d, want 401", code)
+	}
+	if code, layout := dashboard("ops", "secret"); code != http.StatusOK || !reflect.DeepEqual(layout, [][]interface{}{{"metric_b"}}) {
+		t.Errorf("GET /dashboard = %d %v, want metric_b", code, layout)
+	}
+	if d := s.hub.updateGatherInterval(); d != 250*time.Millisecond {
+		t.Errorf("gather interval = %v, want 250ms", d)
+	}
+
+	// An invalid file leaves the running configuration alone
+	write("dashboard: [[{short: X}]]\n")
+	s.reloadConfig()
+	if code, layout := dashboard("ops", "secret"); code != http.StatusOK || !reflect.DeepEqual(layout, [][]interface{}{{"metric_b"}}) {
+		t.Errorf("after invalid reload GET /dashboard = %d %v, want metric_b", code, layout)
+	}
+
+	// Dropping a setting from the file restores the value from options
+	write("dashboard: [[metric_c]]\n")
+	s.reloadConfig()
+	if code, layout := dashboard("", ""); code != http.StatusOK || !reflect.DeepEqual(layout, [][]interface{}{{"metric_c"}}) {
+		t.Errorf("after removing auth GET /dashboard = %d %v, want metric_c", code, layout)
+	}
+}
+
+func TestConfigReloadRestartWarning(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "prommy.yaml")
+	write := func(data string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("interval: 1h\nlimits: {max_connections: 10}\n")
+
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil))
+	s, _ := newTestServer(t, WithLogger(logger), WithConfigFile(path), WithSnapshotCache(time.Minute))
+
+	write("interval: 1h\nlimits: {max_connections: 20}\n")
+	s.reloadConfig()
+	write("interval: 10s\nlimits: {max_connections: 20}\n")
+	s.reloadConfig()
+
+	if n := strings.Count(buf.String(), "Config change needs a restart"); n != 1 {
+		t.Errorf("logged %d restart warnings, want 1:\n%s", n, buf.String())
+	}
+	s.gather.mu.Lock()
+	maxAge := s.gather.maxAge
+	s.gather.mu.Unlock()
+	if maxAge != 5*time.Second {
+		t.Errorf("snapshot max age after reload = %v, want 5s", maxAge)
+	}
+}
@@ -0,0 +1,207 @@
+package prommy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Labels of a file_sd target group that configure the scrape instead of
+// being attached to series, as in Prometheus.
+const (
+	schemeLabel      = "__scheme__"
+	metricsPathLabel = "__metrics_path__"
+	paramLabelPrefix = "__param_"
+)
+
+// labelNamePattern matches valid Prometheus label names.
+var labelNamePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// targetGroup is one entry of a Prometheus file_sd file.
+type targetGroup struct {
+	Targets []string          `json:"targets" yaml:"targets"`
+	Labels  map[string]string `json:"labels" yaml:"labels"`
+}
+
+// LoadTargetFile reads targets from a Prometheus file_sd file: a JSON or
+// YAML list of groups, each with "targets" in host:port form and optional
+// "labels". The __scheme__ and __metrics_path__ labels choose the URL, which
+// defaults to http and /metrics, and __param_<name> labels add query
+// parameters. Other labels starting with "__" are dropped; the rest are
+// added to every series scraped from the group's targets.
+func LoadTargetFile(path string) ([]Target, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseTargetFile(path, data)
+}
+
+// parseTargetFile decodes file_sd data, as YAML if the name ends in .yml or
+// .yaml and as JSON otherwise.
+func parseTargetFile(path string, data []byte) ([]Target, error) {
+	var groups []targetGroup
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yml", ".yaml":
+		if err := yaml.Unmarshal(data, &groups); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	default:
+		if err := json.Unmarshal(data, &groups); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	var targets []Target
+	for i, group := range groups {
+		scheme, metricsPath := "http", "/metrics"
+		query := url.Values{}
+		labels := make(map[string]string)
+		for name, value := range group.Labels {
+			switch {
+			case name == schemeLabel:
+				scheme = value
+			case name == metricsPathLabel:
+				metricsPath = value
+			case strings.HasPrefix(name, paramLabelPrefix):
+				query.Set(strings.TrimPrefix(name, paramLabelPrefix), value)
+			case strings.HasPrefix(name, "__"):
+				// Reserved for Prometheus internals
+			case !labelNamePattern.MatchString(name):
+				return nil, fmt.Errorf("%s: group %d: invalid label name %q", path, i, name)
+			default:
+				labels[name] = value
+			}
+		}
+
+		for _, host := range group.Targets {
+			if host == "" || strings.Contains(host, "/") {
+				return nil, fmt.Errorf("%s: group %d: invalid target %q, want host:port", path, i, host)
+			}
+			u := scheme + "://" + host + metricsPath
+			if len(query) > 0 {
+				u += "?" + query.Encode()
+			}
+			if err := validateTargetURL(u); err != nil {
+				return nil, fmt.Errorf("%s: group %d: %w", path, i, err)
+			}
+			targets = append(targets, Target{URL: u, Labels: labels})
+		}
+	}
+	return targets, nil
+}
+
+// WatchTargetFiles keeps the scraper's targets in sync with the given
+// file_sd files until ctx is done; targets the scraper already has are kept
+// alongside those of the files. The files are loaded before it returns,
+// and an error is returned if any of them cannot be; afterwards they are
+// polled for changes, and a file that becomes unreadable or invalid is
+// logged to logger while its last good targets keep being scraped.
+func (s *Scraper) WatchTargetFiles(ctx context.Context, paths []string, logger *slog.Logger) error {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	w := &targetFileWatcher{scraper: s, logger: logger, static: s.Targets(), files: make([]targetFile, len(paths))}
+	for i, path := range paths {
+		w.files[i].path = path
+		if _, err := w.load(&w.files[i]); err != nil {
+			return err
+		}
+	}
+	if err := w.apply(); err != nil {
+		return err
+	}
+	go w.run(ctx)
+	return nil
+}
+
+// targetFileWatcher polls a set of file_sd files for a scraper.
+type targetFileWatcher struct {
+	scraper *Scraper
+	logger  *slog.Logger
+	static  []Target // Targets given to the scraper before watching began
+	files   []targetFile
+}
+
+// targetFile is one watched file and the targets it last listed.
+type targetFile struct {
+	path    string
+	data    []byte
+	targets []Target
+	failure string // Last error loading the file, so it is logged only once
+}
+
+// load re-reads f and reports whether its targets changed.
+func (w *targetFileWatcher) load(f *targetFile) (bool, error) {
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return false, err
+	}
+	if f.data != nil && bytes.Equal(data, f.data) {
+		return false, nil
+	}
+	targets, err := parseTargetFile(f.path, data)
+	if err != nil {
+		return false, err
+	}
+	f.data, f.targets = data, targets
+	return true, nil
+}
+
+// apply hands the targets of every file to the scraper.
+func (w *targetFileWatcher) apply() error {
+	targets := append([]Target(nil), w.static...)
+	for _, f := range w.files {
+		targets = append(targets, f.targets...)
+	}
+	return w.scraper.SetTargets(targets)
+}
+
+func (w *targetFileWatcher) run(ctx context.Context) {
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.poll()
+		}
+	}
+}
+
+// poll reloads changed files and updates the scraper if any changed.
+func (w *targetFileWatcher) poll() {
+	changed := false
+	for i := range w.files {
+		f := &w.files[i]
+		ok, err := w.load(f)
+		if err != nil {
+			if err.Error() != f.failure {
+				f.failure = err.Error()
+				w.logger.Warn("Keeping previous scrape targets", "path", f.path, "error", err)
+			}
+			continue
+		}
+		f.failure = ""
+		changed = changed || ok
+	}
+	if !changed {
+		return
+	}
+	if err := w.apply(); err != nil {
+		w.logger.Warn("Keeping previous scrape targets", "error", err)
+		return
+	}
+	w.logger.Info("Updated scrape targets", "targets", len(w.scraper.Targets()))
+}
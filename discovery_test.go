@@ -0,0 +1,123 @@
+package prommy
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadTargetFile(t *testing.T) {
+	dir := t.TempDir()
+	want := []Target{
+		{URL: "http://10.0.0.1:9100/metrics", Labels: map[string]string{"job": "node", "env": "prod"}},
+		{URL: "http://10.0.0.2:9100/metrics", Labels: map[string]string{"job": "node", "env": "prod"}},
+		{URL: "https://api:8443/internal/metrics?format=text", Labels: map[string]string{}},
+	}
+
+	files := map[string]string{
+		"targets.json": `[
+			{"targets": ["10.0.0.1:9100", "10.0.0.2:9100"], "labels": {"job": "node", "env": "prod", "__meta_zone": "a"}},
+			{"targets": ["api:8443"], "labels": {"__scheme__": "https", "__metrics_path__": "/internal/metrics", "__param_format": "text"}}
+		]`,
+		"targets.yaml": `
+- targets: [10.0.0.1:9100, 10.0.0.2:9100]
+  labels: {job: node, env: prod, __meta_zone: a}
+- targets: [api:8443]
+  labels:
+    __scheme__: https
+    __metrics_path__: /internal/metrics
+    __param_format: text
+`,
+	}
+	for name, data := range files {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, name)
+			if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := LoadTargetFile(path)
+			if err != nil {
+				t.Fatalf("LoadTargetFile: %v", err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("LoadTargetFile() = %+v, want %+v", got, want)
+			}
+		})
+	}
+
+	for name, data := range map[string]string{
+		"url target": `[{"targets": ["http://host:9100"]}]`,
+		"label name": `[{"targets": ["host:9100"], "labels": {"bad-name": "x"}}]`,
+		"bad scheme": `[{"targets": ["host:9100"], "labels": {"__scheme__": "ftp"}}]`,
+		"not a list": `{"targets": ["host:9100"]}`,
+		"empty host": `[{"targets": [""]}]`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, "invalid.json")
+			if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := LoadTargetFile(path); err == nil {
+				t.Errorf("LoadTargetFile(%s) succeeded, want error", data)
+			}
+		})
+	}
+}
+
+func TestTargetFileWatcher(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "targets.json")
+	write := func(data string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	urls := func(s *Scraper) []string {
+		var result []string
+		for _, target := range s.Targets() {
+			result = append(result, target.URL)
+		}
+		return result
+	}
+
+	scraper, err := NewScraper([]string{"http://static:9000/metrics"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(`[{"targets": ["a:9100"]}]`)
+	w := &targetFileWatcher{scraper: scraper, logger: slog.New(discardHandler{}), static: scraper.Targets(), files: []targetFile{{path: path}}}
+	if _, err := w.load(&w.files[0]); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if err := w.apply(); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if got := urls(scraper); !reflect.DeepEqual(got, []string{"http://static:9000/metrics", "http://a:9100/metrics"}) {
+		t.Errorf("targets = %v, want static and file targets", got)
+	}
+
+	write(`[{"targets": ["a:9100", "b:9100"]}]`)
+	w.poll()
+	if got := urls(scraper); len(got) != 3 || got[2] != "http://b:9100/metrics" {
+		t.Errorf("after adding a target = %v", got)
+	}
+
+	// A broken file keeps the targets it listed before
+	write(`[{"targets": [`)
+	w.poll()
+	if got := urls(scraper); len(got) != 3 {
+		t.Errorf("after breaking the file = %v, want previous targets", got)
+	}
+	if !strings.Contains(w.files[0].failure, "unexpected end") {
+		t.Errorf("failure = %q, want the parse error", w.files[0].failure)
+	}
+
+	write(`[]`)
+	w.poll()
+	if got := urls(scraper); !reflect.DeepEqual(got, []string{"http://static:9000/metrics"}) {
+		t.Errorf("after emptying the file = %v, want only the static target", got)
+	}
+}
@@ -0,0 +1,301 @@
+package prommy
+
+import (
+	"math"
+	"strconv"
+	"unicode/utf8"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// metricEncoder converts gathered metric families straight into the JSON
+// payload sent to dashboard clients, producing the same document as
+// marshaling the []Metric built by convertMetrics. It keeps its scratch
+// buffers and the encoded form of every label set between ticks, so a
+// steady-state tick allocates little beyond the returned payload.
+//
+// A metricEncoder is not safe for concurrent use.
+type metricEncoder struct {
+	buf  []byte // Payload being built
+	key  []byte // Scratch space for label set cache keys
+	head []byte // Encoded name, type and help of the series being written
+
+	// Encoded label sets keyed by their name/value pairs
+	labels map[string]*labelSet
+
+	// Formatted "le" values keyed by bucket upper bound
+	bounds boundCache
+
+	// Incremented on every encode; label sets not seen for a whole encode are evicted
+	gen  uint64
+	live int
+
+	// Series written by the current encode
+	count int
+}
+
+// labelSet is the interned JSON encoding of one set of labels.
+type labelSet struct {
+	json []byte // `,"labels":{...}` or empty for series without labels
+	gen  uint64 // Last encode that used this label set
+}
+
+// newMetricEncoder creates an encoder with empty caches.
+func newMetricEncoder() *metricEncoder {
+	return &metricEncoder{
+		labels: make(map[string]*labelSet),
+		bounds: make(boundCache),
+	}
+}
+
+// encode returns the JSON payload for mfs and the number of series it contains.
+// The returned slice is owned by the caller.
+func (e *metricEncoder) encode(mfs []*dto.MetricFamily) ([]byte, int) {
+	e.gen++
+	e.live = 0
+	e.buf = append(e.buf[:0], '[')
+	e.count = 0
+
+	forEachSeries(mfs, e.bounds, e.series)
+
+	if len(e.buf) > 1 {
+		// Replace the trailing comma
+		e.buf[len(e.buf)-1] = ']'
+	} else {
+		e.buf = append(e.buf, ']')
+	}
+	e.evict()
+
+	payload := make([]byte, len(e.buf))
+	copy(payload, e.buf)
+	return payload, e.count
+}
+
+// series appends one Metric object. le is the bucket bound, empty for
+// anything but histogram buckets.
+func (e *metricEncoder) series(mf *dto.MetricFamily, suffix string, pairs []*dto.LabelPair, le string, value float64) {
+	e.head = append(e.head[:0], `{"name":`...)
+	e.head = appendJSONString(e.head, mf.GetName(), suffix)
+	e.head = append(e.head, `,"type":"`...)
+	e.head = append(e.head, metricTypeToString(mf.GetType())...)
+	e.head = append(e.head, '"')
+	if help := mf.GetHelp(); help != "" {
+		e.head = append(e.head, `,"help":`...)
+		e.head = appendJSONString(e.head, help, "")
+	}
+
+	e.buf = append(e.buf, e.head...)
+	e.buf = append(e.buf, e.labelSet(pairs, le)...)
+	e.buf = append(e.buf, `,"value":`...)
+	e.buf = appendJSONFloat(e.buf, value)
+	e.buf = append(e.buf, '}', ',')
+	e.count++
+}
+
+// forEachSeries flattens mfs exactly like convertMetrics, calling fn for
+// every series in order. suffix is appended to the family name and le is
+// the formatted bucket bound for histogram buckets, empty otherwise.
+func forEachSeries(mfs []*dto.MetricFamily, bounds boundCache, fn func(mf *dto.MetricFamily, suffix string, pairs []*dto.LabelPair, le string, value float64)) {
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				fn(mf, "", m.GetLabel(), "", m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				fn(mf, "", m.GetLabel(), "", m.GetGauge().GetValue())
+			case dto.MetricType_SUMMARY:
+				summary := m.GetSummary()
+				fn(mf, "_count", m.GetLabel(), "", float64(summary.GetSampleCount()))
+				fn(mf, "", m.GetLabel(), "", summary.GetSampleSum())
+			case dto.MetricType_HISTOGRAM:
+				histogram := m.GetHistogram()
+				fn(mf, "_count", m.GetLabel(), "", float64(histogram.GetSampleCount()))
+				for _, bucket := range histogram.GetBucket() {
+					fn(mf, "_bucket", m.GetLabel(), bounds.format(bucket.GetUpperBound()), float64(bucket.GetCumulativeCount()))
+				}
+				fn(mf, "", m.GetLabel(), "", histogram.GetSampleSum())
+			default:
+				// Skip unsupported types
+			}
+		}
+	}
+}
+
+// labelSet returns the interned encoding of pairs with an optional le label.
+func (e *metricEncoder) labelSet(pairs []*dto.LabelPair, le string) []byte {
+	if len(pairs) == 0 && le == "" {
+		return nil
+	}
+
+	e.key = e.key[:0]
+	forEachLabel(pairs, le, func(name, value string) {
+		e.key = append(e.key, name...)
+		e.key = append(e.key, 0xff)
+		e.key = append(e.key, value...)
+		e.key = append(e.key, 0xff)
+	})
+
+	// Looking up with string(e.key) does not allocate
+	if set, ok := e.labels[string(e.key)]; ok {
+		if set.gen != e.gen {
+			set.gen = e.gen
+			e.live++
+		}
+		return set.json
+	}
+
+	encoded := []byte(`,"labels":{`)
+	forEachLabel(pairs, le, func(name, value string) {
+		encoded = appendJSONString(encoded, name, "")
+		encoded = append(encoded, ':')
+		encoded = appendJSONString(encoded, value, "")
+		encoded = append(encoded, ',')
+	})
+	encoded[len(encoded)-1] = '}'
+
+	e.labels[string(e.key)] = &labelSet{json: encoded, gen: e.gen}
+	e.live++
+	return encoded
+}
+
+// boundCache interns formatted "le" label values by bucket upper bound.
+type boundCache map[float64]string
+
+// format returns the "le" label value for a bucket upper bound, formatted
+// like fmt's %g as convertMetrics does.
+func (c boundCache) format(upper float64) string {
+	if s, ok := c[upper]; ok {
+		return s
+	}
+	s := strconv.FormatFloat(upper, 'g', -1, 64)
+	if math.IsInf(upper, 1) {
+		s = "+Inf"
+	}
+	if len(c) > 1024 {
+		// Bucket layouts rarely change; start over rather than grow without bound
+		clear(c)
+	}
+	c[upper] = s
+	return s
+}
+
+// evict drops label sets that were not used by the last encode once they
+// make up more than half of the cache.
+func (e *metricEncoder) evict() {
+	if len(e.labels) <= 2*e.live {
+		return
+	}
+	for key, set := range e.labels {
+		if set.gen != e.gen {
+			delete(e.labels, key)
+		}
+	}
+}
+
+// forEachLabel calls fn for every label in name order, merging le in as if
+// it were one of pairs. Gather returns label pairs sorted by name.
+func forEachLabel(pairs []*dto.LabelPair, le string, fn func(name, value string)) {
+	pending := le != ""
+	for _, lp := range pairs {
+		if pending && lp.GetName() > "le" {
+			fn("le", le)
+			pending = false
+		}
+		if lp.GetName() == "le" && le != "" {
+			continue // The bucket bound replaces any existing le label
+		}
+		fn(lp.GetName(), lp.GetValue())
+	}
+	if pending {
+		fn("le", le)
+	}
+}
+
+// appendJSONString appends s+suffix as a quoted JSON string, escaping it
+// the way encoding/json does.
+func appendJSONString(dst []byte, s, suffix string) []byte {
+	dst = append(dst, '"')
+	dst = appendJSONStringBody(dst, s)
+	dst = appendJSONStringBody(dst, suffix)
+	return append(dst, '"')
+}
+
+const hexDigits = "0123456789abcdef"
+
+// appendJSONStringBody appends s escaped for use inside a JSON string.
+func appendJSONStringBody(dst []byte, s string) []byte {
+	start := 0
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c < utf8.RuneSelf {
+			if c >= 0x20 && c != '"' && c != '\\' && c != '<' && c != '>' && c != '&' {
+				i++
+				continue
+			}
+			dst = append(dst, s[start:i]...)
+			switch c {
+			case '"', '\\':
+				dst = append(dst, '\\', c)
+			case '\n':
+				dst = append(dst, '\\', 'n')
+			case '\r':
+				dst = append(dst, '\\', 'r')
+			case '\t':
+				dst = append(dst, '\\', 't')
+			default:
+				// Control characters and HTML-sensitive characters, as encoding/json does
+				dst = append(dst, '\\', 'u', '0', '0', hexDigits[c>>4], hexDigits[c&0xf])
+			}
+			i++
+			start = i
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			dst = append(dst, s[start:i]...)
+			dst = append(dst, `\ufffd`...)
+			i += size
+			start = i
+			continue
+		}
+		if r == '\u2028' || r == '\u2029' {
+			// Line and paragraph separators are escaped for JavaScript, as encoding/json does
+			dst = append(dst, s[start:i]...)
+			dst = append(dst, '\\', 'u', '2', '0', '2', hexDigits[r&0xf])
+			i += size
+			start = i
+			continue
+		}
+		i += size
+	}
+	return append(dst, s[start:]...)
+}
+
+// appendJSONFloat appends f formatted like encoding/json. NaN and the
+// infinities, which JSON numbers cannot express, are written as the
+// strings "NaN", "+Inf" and "-Inf" as in the Prometheus text format.
+func appendJSONFloat(dst []byte, f float64) []byte {
+	switch {
+	case math.IsNaN(f):
+		return append(dst, `"NaN"`...)
+	case math.IsInf(f, 1):
+		return append(dst, `"+Inf"`...)
+	case math.IsInf(f, -1):
+		return append(dst, `"-Inf"`...)
+	}
+
+	format := byte('f')
+	if abs := math.Abs(f); abs != 0 && (abs < 1e-6 || abs >= 1e21) {
+		format = 'e'
+	}
+	dst = strconv.AppendFloat(dst, f, format, -1, 64)
+	if format == 'e' {
+		// Clean up e-09 to e-9
+		n := len(dst)
+		if n >= 4 && dst[n-4] == 'e' && dst[n-3] == '-' && dst[n-2] == '0' {
+			dst[n-2] = dst[n-1]
+			dst = dst[:n-1]
+		}
+	}
+	return dst
+}
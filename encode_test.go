@@ -0,0 +1,136 @@
+package prommy
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// testFamilies gathers a registry with every supported metric type and
+// roughly n series, including labels that need escaping.
+func testFamilies(t testing.TB, n int) []*dto.MetricFamily {
+	t.Helper()
+	reg := prometheus.NewRegistry()
+
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_requests_total", Help: "Requests \"served\" <by> & handler."}, []string{"handler", "code"})
+	gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_temperature", Help: "Temperature\nin degrees."}, []string{"room"})
+	summary := prometheus.NewSummaryVec(prometheus.SummaryOpts{Name: "test_latency_seconds", Help: "Latency."}, []string{"zone"})
+	histogram := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "test_size_bytes", Help: "Sizes.", Buckets: prometheus.ExponentialBuckets(100, 2, 8)}, []string{"a_path", "method"})
+	plain := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_unlabeled"})
+	reg.MustRegister(counter, gauge, summary, histogram, plain)
+
+	plain.Set(1e-9)
+	gauge.WithLabelValues("kitchen\t\"main\"").Set(21.5)
+	gauge.WithLabelValues("cellar ünïcode").Set(-3e22)
+	summary.WithLabelValues("eu").Observe(0.25)
+	// Each iteration adds one counter series and a histogram of 11 series
+	for i := 0; i < n/12+1; i++ {
+		counter.WithLabelValues("/api/"+strconv.Itoa(i), strconv.Itoa(200+i%5)).Add(float64(i))
+		histogram.WithLabelValues("/files/"+strconv.Itoa(i), "GET").Observe(float64(i * 37))
+	}
+
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("gather: %v", err)
+	}
+	return mfs
+}
+
+func TestMetricEncoderMatchesJSON(t *testing.T) {
+	mfs := testFamilies(t, 200)
+	encoder := newMetricEncoder()
+
+	reference, err := json.Marshal(convertMetrics(mfs))
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	var want []Metric
+	if err := json.Unmarshal(reference, &want); err != nil {
+		t.Fatalf("unmarshal reference: %v", err)
+	}
+
+	// Encode twice so the second pass is served from the label set cache
+	for pass := 0; pass < 2; pass++ {
+		payload, series := encoder.encode(mfs)
+
+		var got []Metric
+		if err := json.Unmarshal(payload, &got); err != nil {
+			t.Fatalf("pass %d: invalid JSON: %v\n%s", pass, err, payload)
+		}
+		if series != len(want) {
+			t.Errorf("pass %d: series = %d, want %d", pass, series, len(want))
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("pass %d: encoder output differs from convertMetrics", pass)
+		}
+		if string(payload) != string(reference) {
+			t.Errorf("pass %d: encoder output is not byte-identical to encoding/json", pass)
+		}
+	}
+}
+
+func TestMetricEncoderNonFinite(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_ratio"}, []string{"kind"})
+	reg.MustRegister(gauge)
+	gauge.WithLabelValues("nan").Set(math.NaN())
+	gauge.WithLabelValues("pos").Set(math.Inf(1))
+	gauge.WithLabelValues("neg").Set(math.Inf(-1))
+	mfs, _ := reg.Gather()
+
+	payload, _ := newMetricEncoder().encode(mfs)
+	var got []struct {
+		Labels map[string]string `json:"labels"`
+		Value  interface{}       `json:"value"`
+	}
+	if err := json.Unmarshal(payload, &got); err != nil {
+		t.Fatalf("invalid JSON: %v\n%s", err, payload)
+	}
+	want := map[string]string{"nan": "NaN", "pos": "+Inf", "neg": "-Inf"}
+	for _, m := range got {
+		if m.Value != want[m.Labels["kind"]] {
+			t.Errorf("%s encoded as %v, want %q", m.Labels["kind"], m.Value, want[m.Labels["kind"]])
+		}
+	}
+}
+
+func TestMetricEncoderEvictsStaleLabelSets(t *testing.T) {
+	encoder := newMetricEncoder()
+	encoder.encode(testFamilies(t, 200))
+	before := len(encoder.labels)
+
+	encoder.encode(testFamilies(t, 10))
+	if len(encoder.labels) >= before {
+		t.Errorf("label cache has %d entries after shrinking, had %d", len(encoder.labels), before)
+	}
+}
+
+// BenchmarkEncodeMetrics compares the original convert-and-marshal path with
+// metricEncoder on a registry of about 20k series.
+func BenchmarkEncodeMetrics(b *testing.B) {
+	mfs := testFamilies(b, 20000)
+
+	b.Run("convert+json.Marshal", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := json.Marshal(convertMetrics(mfs)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("metricEncoder", func(b *testing.B) {
+		encoder := newMetricEncoder()
+		encoder.encode(mfs) // Warm the label set cache as on every tick after the first
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			encoder.encode(mfs)
+		}
+	})
+}
@@ -0,0 +1,96 @@
+package prommy
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Kinds of problems reported by Registry.Gather.
+const (
+	GatherErrorCollector = "collector" // A collector failed or produced an invalid metric
+	GatherErrorDuplicate = "duplicate" // The same series was collected twice, usually a duplicate registration
+	GatherErrorMismatch  = "mismatch"  // Help text or type disagrees between collectors of one family
+	GatherErrorTimeout   = "timeout"   // Gathering took longer than the gather timeout
+	GatherErrorScrape    = "scrape"    // A Scraper target could not be scraped
+	GatherErrorPeer      = "peer"      // A Federator peer's feed is unavailable
+	GatherErrorOther     = "other"
+)
+
+// GatherError describes one problem reported while gathering metrics.
+// Gathering continues past these errors, so the rest of the snapshot is still sent.
+type GatherError struct {
+	Collector string `json:"collector,omitempty"` // Metric family identifying the failing collector, if known
+	Kind      string `json:"kind"`
+	Message   string `json:"message"`
+}
+
+var (
+	// Matches the descriptor printed by "error collecting metric Desc{fqName: ...}"
+	descNamePattern = regexp.MustCompile(`fqName: "([^"]+)"`)
+
+	// Matches the family name in "collected metric ..." and "gathered metric family ..." errors
+	metricNamePattern = regexp.MustCompile(`(?:collected metric|metric family) "?([a-zA-Z_:][a-zA-Z0-9_:]*)`)
+)
+
+// gatherErrors splits the error returned by Gather into classified entries.
+func gatherErrors(err error) []GatherError {
+	if err == nil {
+		return nil
+	}
+
+	var errs []error
+	var multi prometheus.MultiError
+	if errors.As(err, &multi) {
+		errs = multi
+	} else {
+		errs = []error{err}
+	}
+
+	result := make([]GatherError, 0, len(errs))
+	for _, e := range errs {
+		result = append(result, classifyGatherError(e))
+	}
+	return result
+}
+
+// classifyGatherError works out which collector failed and how from the
+// error text, since client_golang does not expose structured gather errors.
+func classifyGatherError(err error) GatherError {
+	msg := err.Error()
+	ge := GatherError{Kind: GatherErrorOther, Message: msg}
+
+	var slow *slowGatherError
+	if errors.As(err, &slow) {
+		ge.Kind = GatherErrorTimeout
+		ge.Collector = slow.collector
+		return ge
+	}
+	var scrape *ScrapeError
+	if errors.As(err, &scrape) {
+		// Name the target rather than the gatherer it was merged through
+		return GatherError{Collector: scrape.Target, Kind: GatherErrorScrape, Message: scrape.Error()}
+	}
+	var peer *PeerError
+	if errors.As(err, &peer) {
+		return GatherError{Collector: peer.Peer, Kind: GatherErrorPeer, Message: peer.Error()}
+	}
+
+	switch {
+	case strings.Contains(msg, "collected before with the same name and label values"):
+		ge.Kind = GatherErrorDuplicate
+	case strings.Contains(msg, "but should have") || strings.Contains(msg, "inconsistent"):
+		ge.Kind = GatherErrorMismatch
+	case strings.Contains(msg, "error collecting metric") || strings.Contains(msg, "collected metric"):
+		ge.Kind = GatherErrorCollector
+	}
+
+	if m := descNamePattern.FindStringSubmatch(msg); m != nil {
+		ge.Collector = m[1]
+	} else if m := metricNamePattern.FindStringSubmatch(msg); m != nil {
+		ge.Collector = m[1]
+	}
+	return ge
+}
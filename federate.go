@@ -0,0 +1,468 @@
+package prommy
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// Default rate at which federated peers send or are polled for snapshots.
+const defaultPeerInterval = time.Second
+
+// Reconnect backoff for federated peers, doubling from the minimum.
+const (
+	peerRetryMin = time.Second
+	peerRetryMax = 30 * time.Second
+)
+
+// peerStallGrace is added to the expected time between snapshots before a
+// silent peer is considered gone. prommy does not ping its clients, so
+// a missed deadline is the only sign of a peer that vanished without
+// closing the connection.
+const peerStallGrace = 5 * time.Second
+
+// errPeerConnecting is reported for peers that have not sent a snapshot yet.
+var errPeerConnecting = errors.New("not connected yet")
+
+// PeerError reports a federated prommy instance whose feed is unavailable.
+type PeerError struct {
+	Peer string // URL of the peer, without credentials
+	Err  error
+}
+
+func (e *PeerError) Error() string {
+	return fmt.Sprintf("peer %s: %v", e.Peer, e.Err)
+}
+
+func (e *PeerError) Unwrap() error {
+	return e.Err
+}
+
+// Federator is a prometheus.Gatherer that follows the dashboard feeds of
+// other prommy instances, so one aggregate dashboard can show the metrics
+// of many embedded servers. Pass it to WithGatherer and call Start.
+//
+// Peers given as ws:// or wss:// URLs are followed over a WebSocket, and
+// http:// or https:// peers are polled through /api/snapshot for networks
+// that do not pass WebSockets. Either URL points at the peer's dashboard,
+// including its prefix, and may carry basic auth credentials as
+// user:password@host.
+//
+// Every series gets an instance label naming its peer's host and port; an
+// instance label the peer already sent is kept as exported_instance. A
+// peer that goes away is reconnected with backoff while its series are
+// left out, peer_up is 0 for it and a *PeerError is returned from Gather.
+type Federator struct {
+	client   *http.Client
+	dialer   *websocket.Dialer
+	interval time.Duration
+	peers    []*peer
+}
+
+// peer is one federated prommy instance and its latest snapshot.
+type peer struct {
+	url      string      // Peer URL without credentials, for errors and logs
+	endpoint string      // URL of the feed
+	header   http.Header // Authorization for the feed
+	instance string
+	poll     bool
+
+	mu      sync.Mutex
+	metrics []feedMetric // Latest snapshot, nil while the feed is down
+	epoch   string
+	seq     uint64
+	err     error // Why the feed is down, nil while it is live
+}
+
+// NewFederator creates a federator for the given peer URLs. Peers are asked
+// to send a snapshot every interval, or polled that often; 0 uses one
+// second.
+func NewFederator(urls []string, interval time.Duration) (*Federator, error) {
+	if interval <= 0 {
+		interval = defaultPeerInterval
+	}
+	f := &Federator{
+		client:   &http.Client{Timeout: interval + peerStallGrace},
+		dialer:   &websocket.Dialer{HandshakeTimeout: peerStallGrace, Subprotocols: []string{subprotocolJSON}},
+		interval: interval,
+	}
+	for _, raw := range urls {
+		p, err := newPeer(raw, interval)
+		if err != nil {
+			return nil, err
+		}
+		f.peers = append(f.peers, p)
+	}
+	return f, nil
+}
+
+// newPeer works out the feed endpoint of a peer URL.
+func newPeer(raw string, interval time.Duration) (*peer, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid peer %q: %w", raw, err)
+	}
+	p := &peer{header: make(http.Header), instance: u.Host, err: errPeerConnecting}
+	route := "/ws"
+	switch u.Scheme {
+	case "ws", "wss":
+	case "http", "https":
+		p.poll = true
+		route = "/api/snapshot"
+	default:
+		return nil, fmt.Errorf("invalid peer %q: want a ws, wss, http or https URL", raw)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid peer %q: missing host", raw)
+	}
+
+	// The WebSocket dialer rejects credentials in the URL
+	if u.User != nil {
+		password, _ := u.User.Password()
+		credentials := u.User.Username() + ":" + password
+		p.header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(credentials)))
+		u.User = nil
+	}
+	p.url = u.String()
+
+	u.Path = strings.TrimSuffix(u.Path, "/") + route
+	u.RawPath = ""
+	if !p.poll {
+		u.RawQuery = url.Values{"interval": {strconv.FormatInt(interval.Milliseconds(), 10)}}.Encode()
+	}
+	p.endpoint = u.String()
+	return p, nil
+}
+
+// Start follows every peer until ctx is done, logging connections and
+// disconnections to logger, or slog.Default() if it is nil. It returns
+// immediately and must be called once.
+func (f *Federator) Start(ctx context.Context, logger *slog.Logger) {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	for _, p := range f.peers {
+		go f.follow(ctx, p, logger)
+	}
+}
+
+// follow keeps a peer's feed connected, retrying with backoff.
+func (f *Federator) follow(ctx context.Context, p *peer, logger *slog.Logger) {
+	retry := peerRetryMin
+	lastFailure := ""
+	for {
+		var err error
+		if p.poll {
+			err = f.poll(ctx, p, logger)
+		} else {
+			err = f.stream(ctx, p, logger)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if p.fail(err) {
+			logger.Warn("Lost federated peer", "peer", p.url, "error", err)
+			retry = peerRetryMin
+		} else if err.Error() != lastFailure {
+			logger.Warn("Cannot reach federated peer", "peer", p.url, "error", err)
+		}
+		lastFailure = err.Error()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retry):
+		}
+		retry = min(retry*2, peerRetryMax)
+	}
+}
+
+// stream follows a peer over a WebSocket until the connection fails.
+func (f *Federator) stream(ctx context.Context, p *peer, logger *slog.Logger) error {
+	conn, _, err := f.dialer.DialContext(ctx, p.endpoint, p.header)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(2*f.interval + peerStallGrace))
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		if err := f.apply(p, data, logger); err != nil {
+			return err
+		}
+	}
+}
+
+// poll fetches a peer's latest snapshot every interval until a request fails.
+func (f *Federator) poll(ctx context.Context, p *peer, logger *slog.Logger) error {
+	ticker := time.NewTicker(f.interval)
+	defer ticker.Stop()
+	for {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.endpoint, nil)
+		if err != nil {
+			return err
+		}
+		req.Header = p.header.Clone()
+		p.mu.Lock()
+		if p.epoch != "" {
+			// The peer answers 204 until it has a newer snapshot
+			req.URL.RawQuery = url.Values{"since": {strconv.FormatUint(p.seq, 10)}, "epoch": {p.epoch}}.Encode()
+		}
+		p.mu.Unlock()
+
+		resp, err := f.client.Do(req)
+		if err != nil {
+			return err
+		}
+		data, err := io.ReadAll(io.LimitReader(resp.Body, maxScrapeSize))
+		resp.Body.Close()
+		switch {
+		case err != nil:
+			return err
+		case resp.StatusCode == http.StatusOK:
+			if err := f.apply(p, data, logger); err != nil {
+				return err
+			}
+		case resp.StatusCode != http.StatusNoContent:
+			return fmt.Errorf("unexpected status %s", resp.Status)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// feedEnvelope is a message of the dashboard feed.
+type feedEnvelope struct {
+	Event   string       `json:"event"` // Set on announcements, which carry no snapshot
+	Seq     uint64       `json:"seq"`
+	Epoch   string       `json:"epoch"`
+	Metrics []feedMetric `json:"metrics"`
+}
+
+// feedMetric is a Metric as encoded in the feed.
+type feedMetric struct {
+	Name   string            `json:"name"`
+	Type   string            `json:"type"`
+	Help   string            `json:"help"`
+	Labels map[string]string `json:"labels"`
+	Value  feedValue         `json:"value"`
+}
+
+// feedValue is a sample value, sent as a string when it is not finite.
+type feedValue float64
+
+func (v *feedValue) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		s = string(data)
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return fmt.Errorf("invalid sample value %s", data)
+	}
+	*v = feedValue(f)
+	return nil
+}
+
+// apply stores a snapshot received from p.
+func (f *Federator) apply(p *peer, data []byte, logger *slog.Logger) error {
+	var envelope feedEnvelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return fmt.Errorf("invalid snapshot: %w", err)
+	}
+	if envelope.Event != "" {
+		return nil
+	}
+	p.mu.Lock()
+	connected := p.err != nil
+	p.metrics, p.epoch, p.seq, p.err = envelope.Metrics, envelope.Epoch, envelope.Seq, nil
+	p.mu.Unlock()
+	if connected {
+		logger.Info("Connected to federated peer", "peer", p.url, "series", len(envelope.Metrics))
+	}
+	return nil
+}
+
+// fail marks the feed of p as down and reports whether it was live.
+func (p *peer) fail(err error) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	live := p.err == nil
+	// Forget the position so the next poll is answered with the latest snapshot
+	p.metrics, p.epoch, p.err = nil, "", err
+	return live
+}
+
+// Gather implements prometheus.Gatherer. Peers whose feed is down are
+// reported as *PeerError values in the returned prometheus.MultiError
+// alongside the families of the others.
+func (f *Federator) Gather() ([]*dto.MetricFamily, error) {
+	var multi prometheus.MultiError
+	up := &dto.MetricFamily{
+		Name: proto.String("peer_up"),
+		Help: proto.String("Whether the feed of the federated prommy instance is live."),
+		Type: dto.MetricType_GAUGE.Enum(),
+	}
+	sources := make([][]*dto.MetricFamily, 0, len(f.peers)+1)
+	for _, p := range f.peers {
+		p.mu.Lock()
+		metrics, err := p.metrics, p.err
+		p.mu.Unlock()
+
+		value := 1.0
+		if err != nil {
+			multi.Append(&PeerError{Peer: p.url, Err: err})
+			value = 0
+		}
+		up.Metric = append(up.Metric, &dto.Metric{
+			Label: []*dto.LabelPair{{Name: proto.String("instance"), Value: proto.String(p.instance)}},
+			Gauge: &dto.Gauge{Value: proto.Float64(value)},
+		})
+		// Built afresh every time, since merging appends to the families
+		sources = append(sources, feedFamilies(metrics, p.instance))
+	}
+	if len(f.peers) > 0 {
+		sources = append(sources, []*dto.MetricFamily{up})
+	}
+	return mergeFamilies(sources), multi.MaybeUnwrap()
+}
+
+// feedFamilies rebuilds metric families from a feed snapshot, reversing the
+// flattening of convertMetrics: the _count, _bucket and sum series of a
+// histogram or summary are put back together. Quantiles are not part of
+// the feed, so summaries come back with their count and sum only.
+func feedFamilies(metrics []feedMetric, instance string) []*dto.MetricFamily {
+	families := make(map[string]*dto.MetricFamily)
+	series := make(map[string]*dto.Metric)
+	var result []*dto.MetricFamily
+
+	for _, m := range metrics {
+		var metricType dto.MetricType
+		switch m.Type {
+		case "counter":
+			metricType = dto.MetricType_COUNTER
+		case "gauge":
+			metricType = dto.MetricType_GAUGE
+		case "summary":
+			metricType = dto.MetricType_SUMMARY
+		case "histogram":
+			metricType = dto.MetricType_HISTOGRAM
+		default:
+			continue
+		}
+
+		name, part := m.Name, ""
+		labels := make(map[string]string, len(m.Labels)+1)
+		for k, v := range m.Labels {
+			labels[k] = v
+		}
+		if metricType == dto.MetricType_SUMMARY || metricType == dto.MetricType_HISTOGRAM {
+			switch {
+			case strings.HasSuffix(name, "_count"):
+				name, part = strings.TrimSuffix(name, "_count"), "count"
+			case metricType == dto.MetricType_HISTOGRAM && strings.HasSuffix(name, "_bucket"):
+				name, part = strings.TrimSuffix(name, "_bucket"), "bucket"
+				delete(labels, "le")
+			default:
+				part = "sum"
+			}
+		}
+		if v, ok := labels["instance"]; ok {
+			labels["exported_instance"] = v
+		}
+		labels["instance"] = instance
+
+		family, ok := families[name]
+		if !ok {
+			family = &dto.MetricFamily{Name: proto.String(name), Type: metricType.Enum()}
+			if m.Help != "" {
+				family.Help = proto.String(m.Help)
+			}
+			families[name] = family
+			result = append(result, family)
+		} else if family.GetType() != metricType {
+			continue
+		}
+
+		pairs := labelPairs(labels)
+		key := seriesKey(name, pairs)
+		metric, ok := series[key]
+		if !ok {
+			metric = &dto.Metric{Label: pairs}
+			switch metricType {
+			case dto.MetricType_SUMMARY:
+				metric.Summary = &dto.Summary{}
+			case dto.MetricType_HISTOGRAM:
+				metric.Histogram = &dto.Histogram{}
+			}
+			series[key] = metric
+			family.Metric = append(family.Metric, metric)
+		}
+
+		value := float64(m.Value)
+		switch {
+		case metricType == dto.MetricType_COUNTER:
+			metric.Counter = &dto.Counter{Value: proto.Float64(value)}
+		case metricType == dto.MetricType_GAUGE:
+			metric.Gauge = &dto.Gauge{Value: proto.Float64(value)}
+		case metricType == dto.MetricType_SUMMARY && part == "count":
+			metric.Summary.SampleCount = proto.Uint64(uint64(value))
+		case metricType == dto.MetricType_SUMMARY:
+			metric.Summary.SampleSum = proto.Float64(value)
+		case part == "count":
+			metric.Histogram.SampleCount = proto.Uint64(uint64(value))
+		case part == "bucket":
+			bound, err := strconv.ParseFloat(m.Labels["le"], 64)
+			if err != nil {
+				continue
+			}
+			metric.Histogram.Bucket = append(metric.Histogram.Bucket, &dto.Bucket{
+				UpperBound:      proto.Float64(bound),
+				CumulativeCount: proto.Uint64(uint64(value)),
+			})
+		default:
+			metric.Histogram.SampleSum = proto.Float64(value)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].GetName() < result[j].GetName() })
+	return result
+}
+
+// seriesKey identifies a series of a family by its labels.
+func seriesKey(name string, pairs []*dto.LabelPair) string {
+	var b strings.Builder
+	b.WriteString(name)
+	for _, lp := range pairs {
+		b.WriteByte(0xff)
+		b.WriteString(lp.GetName())
+		b.WriteByte(0xff)
+		b.WriteString(lp.GetValue())
+	}
+	return b.String()
+}
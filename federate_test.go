@@ -0,0 +1,177 @@
+package prommy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestFeedFamiliesRoundTrip(t *testing.T) {
+	mfs := testFamilies(t, 24)
+	payload, _ := newMetricEncoder().encode(mfs)
+	var feed []feedMetric
+	if err := json.Unmarshal(payload, &feed); err != nil {
+		t.Fatalf("unmarshal feed: %v", err)
+	}
+
+	want := convertMetrics(mfs)
+	for _, m := range want {
+		m.Labels["instance"] = "peer:8080"
+	}
+	if got := convertMetrics(feedFamilies(feed, "peer:8080")); !reflect.DeepEqual(got, want) {
+		t.Errorf("feedFamilies() does not restore the gathered families:\n got %+v\nwant %+v", got, want)
+	}
+}
+
+func TestFeedFamiliesLabels(t *testing.T) {
+	var feed []feedMetric
+	data := `[{"name":"up","type":"gauge","labels":{"instance":"db:9100"},"value":1},
+		{"name":"ratio","type":"gauge","value":"NaN"}]`
+	if err := json.Unmarshal([]byte(data), &feed); err != nil {
+		t.Fatalf("unmarshal feed: %v", err)
+	}
+	got := convertMetrics(feedFamilies(feed, "agg:8080"))
+	if len(got) != 2 || !math.IsNaN(got[0].Value) {
+		t.Fatalf("feedFamilies() = %+v, want ratio NaN and up", got)
+	}
+	if want := map[string]string{"instance": "agg:8080", "exported_instance": "db:9100"}; !reflect.DeepEqual(got[1].Labels, want) {
+		t.Errorf("up labels = %v, want %v", got[1].Labels, want)
+	}
+}
+
+func TestFederator(t *testing.T) {
+	newPeer := func(name string, opts ...Option) (*httptest.Server, *peerListener) {
+		reg := prometheus.NewRegistry()
+		jobs := prometheus.NewCounter(prometheus.CounterOpts{Name: "jobs_total", Help: "Jobs done by " + name + "."})
+		jobs.Add(3)
+		reg.MustRegister(jobs)
+		s, _ := newTestServer(t, append([]Option{WithNopLogger(), WithRegistry(reg), WithTickerInterval(20 * time.Millisecond)}, opts...)...)
+
+		// The listener lets the test take the peer away and bring it back on
+		// the same address
+		srv := httptest.NewUnstartedServer(nil)
+		listener := &peerListener{Listener: srv.Listener}
+		srv.Listener = listener
+		srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if listener.down.Load() {
+				http.Error(w, "down", http.StatusServiceUnavailable)
+				return
+			}
+			s.ServeHTTP(w, r)
+		})
+		srv.Start()
+		t.Cleanup(srv.Close)
+		return srv, listener
+	}
+	streamed, streamedPeer := newPeer("orders")
+	polled, _ := newPeer("billing", WithBasicAuth("ops", "secret"))
+
+	federator, err := NewFederator([]string{
+		"ws" + strings.TrimPrefix(streamed.URL, "http"),
+		"http://ops:secret@" + strings.TrimPrefix(polled.URL, "http://") + "/",
+	}, 20*time.Millisecond)
+	if err != nil {
+		t.Fatalf("NewFederator: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	federator.Start(ctx, slog.New(discardHandler{}))
+
+	values := func() (map[string]float64, error) {
+		mfs, err := federator.Gather()
+		got := make(map[string]float64)
+		for _, m := range convertMetrics(mfs) {
+			got[m.Name+"@"+m.Labels["instance"]] = m.Value
+		}
+		return got, err
+	}
+	waitFor := func(what string, ok func(map[string]float64, error) bool) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			got, err := values()
+			if ok(got, err) {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s: %v, %v", what, got, err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	streamedHost, polledHost := mustHost(t, streamed.URL), mustHost(t, polled.URL)
+	waitFor("both peers", func(got map[string]float64, err error) bool {
+		return err == nil && got["jobs_total@"+streamedHost] == 3 && got["jobs_total@"+polledHost] == 3 &&
+			got["peer_up@"+streamedHost] == 1 && got["peer_up@"+polledHost] == 1
+	})
+
+	// A peer that goes away is reported and its series left out
+	streamedPeer.takeDown()
+	waitFor("the lost peer", func(got map[string]float64, err error) bool {
+		var peerErr *PeerError
+		_, stale := got["jobs_total@"+streamedHost]
+		return errors.As(err, &peerErr) && peerErr.Peer == "ws"+strings.TrimPrefix(streamed.URL, "http") &&
+			!stale && got["peer_up@"+streamedHost] == 0 && got["jobs_total@"+polledHost] == 3
+	})
+	if _, err := federator.Gather(); len(gatherErrors(err)) != 1 || gatherErrors(err)[0].Kind != GatherErrorPeer {
+		t.Errorf("gatherErrors() = %+v, want one peer error", gatherErrors(err))
+	}
+
+	streamedPeer.down.Store(false)
+	waitFor("the peer to reconnect", func(got map[string]float64, err error) bool {
+		return err == nil && got["jobs_total@"+streamedHost] == 3 && got["peer_up@"+streamedHost] == 1
+	})
+}
+
+func TestNewFederatorRejectsInvalidPeers(t *testing.T) {
+	for _, peer := range []string{"localhost:8080", "ftp://host", "ws://"} {
+		if _, err := NewFederator([]string{peer}, 0); err == nil {
+			t.Errorf("NewFederator(%q) succeeded, want error", peer)
+		}
+	}
+}
+
+// peerListener remembers the connections it accepts, including hijacked
+// WebSocket connections that httptest.Server no longer tracks.
+type peerListener struct {
+	net.Listener
+	down  atomic.Bool
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func (l *peerListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.mu.Lock()
+		l.conns = append(l.conns, conn)
+		l.mu.Unlock()
+	}
+	return conn, err
+}
+
+// takeDown closes every open connection and fails requests until down is
+// cleared.
+func (l *peerListener) takeDown() {
+	l.down.Store(true)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, conn := range l.conns {
+		conn.Close()
+	}
+	l.conns = nil
+}
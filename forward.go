@@ -0,0 +1,390 @@
+package prommy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// Defaults for RemoteWriteConfig.
+const (
+	defaultRemoteWriteBatch   = 2000
+	defaultRemoteWriteBuffer  = 100000
+	defaultRemoteWriteTimeout = 30 * time.Second
+)
+
+// Backoff between attempts to send a batch, doubling from the minimum.
+const (
+	remoteWriteRetryMin = 100 * time.Millisecond
+	remoteWriteRetryMax = 30 * time.Second
+)
+
+// remoteWriteMetadataInterval is how often the type and help of every
+// family are sent again, so a receiver that restarted learns them, as
+// Prometheus does.
+const remoteWriteMetadataInterval = time.Minute
+
+// RemoteWriteConfig configures forwarding of the samples prommy gathers
+// every TickerInterval to a Prometheus remote_write receiver.
+type RemoteWriteConfig struct {
+	URL        string        // Receiver endpoint, such as http://prometheus:9090/api/v1/write
+	BasicAuth  *BasicAuth    // Credentials for the receiver, nil sends none
+	BatchSize  int           // Most samples sent in one request, 0 uses the default of 2000
+	BufferSize int           // Most samples queued while the receiver is slow or down, 0 uses the default of 100000
+	Timeout    time.Duration // Longest a request may take, 0 uses the default of 30 seconds
+}
+
+// remoteWriteStatusError reports a request the receiver did not accept.
+type remoteWriteStatusError struct {
+	status  int
+	message string
+}
+
+func (e *remoteWriteStatusError) Error() string {
+	if e.message == "" {
+		return fmt.Sprintf("receiver answered %d %s", e.status, http.StatusText(e.status))
+	}
+	return fmt.Sprintf("receiver answered %d %s: %s", e.status, http.StatusText(e.status), e.message)
+}
+
+// retry reports whether the request may succeed when sent again. As in
+// Prometheus, other client errors mean the samples will never be accepted.
+func (e *remoteWriteStatusError) retry() bool {
+	return e.status == http.StatusTooManyRequests || e.status >= 500
+}
+
+// remoteWriter queues the samples of every gather and sends them in batches to
+// a remote_write receiver, retrying with backoff. When the queue is full the
+// oldest samples are dropped, so a receiver that is down for long loses the
+// start of the outage rather than the latest data.
+type remoteWriter struct {
+	config  RemoteWriteConfig
+	target  string // URL without a password, for logs
+	client  *http.Client
+	logger  *slog.Logger
+	metrics *selfMetrics
+	wake    chan struct{} // Signalled when samples are queued
+
+	mu          sync.Mutex
+	series      map[string]*forwardSeries // Series of the last tick, by seriesKey
+	queue       []queuedSample
+	head        uint64                   // Position of queue[0] among all samples ever queued
+	metadata    map[string]writeMetadata // Family metadata not sent yet
+	describedAt time.Time                // When metadata was last queued for every family
+	described   map[string]bool          // Families whose metadata was queued since describedAt
+	dropping    bool                     // The queue is full and samples are being dropped
+	bounds      boundCache
+}
+
+// forwardSeries is a series with its labels encoded as the label fields of a
+// prometheus.TimeSeries message, shared by its queued samples.
+type forwardSeries struct {
+	labels []byte
+}
+
+type queuedSample struct {
+	series    *forwardSeries
+	value     float64
+	timestamp int64
+}
+
+// newRemoteWriter creates a writer for config with the defaults applied.
+// run must be called to start sending.
+func newRemoteWriter(config RemoteWriteConfig, logger *slog.Logger, metrics *selfMetrics) *remoteWriter {
+	if config.BatchSize <= 0 {
+		config.BatchSize = defaultRemoteWriteBatch
+	}
+	if config.BufferSize <= 0 {
+		config.BufferSize = defaultRemoteWriteBuffer
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultRemoteWriteTimeout
+	}
+	target := config.URL
+	if u, err := url.Parse(config.URL); err == nil {
+		target = u.Redacted()
+	}
+	return &remoteWriter{
+		config:    config,
+		target:    target,
+		client:    &http.Client{Timeout: config.Timeout},
+		logger:    logger,
+		metrics:   metrics,
+		wake:      make(chan struct{}, 1),
+		series:    make(map[string]*forwardSeries),
+		metadata:  make(map[string]writeMetadata),
+		described: make(map[string]bool),
+		bounds:    make(boundCache),
+	}
+}
+
+// enqueue queues every sample of mfs with the time of the tick that gathered
+// them. Summaries and histograms are split into series the way the text
+// exposition format names them.
+func (w *remoteWriter) enqueue(mfs []*dto.MetricFamily, at time.Time) {
+	timestamp := at.UnixMilli()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if at.Sub(w.describedAt) >= remoteWriteMetadataInterval {
+		clear(w.described)
+		w.describedAt = at
+	}
+
+	series := make(map[string]*forwardSeries, len(w.series))
+	add := func(name string, labels []*dto.LabelPair, extraName, extraValue string, value float64) {
+		pairs := make([]*dto.LabelPair, 0, len(labels)+2)
+		pairs = append(pairs, &dto.LabelPair{Name: proto.String(metricNameLabel), Value: proto.String(name)})
+		pairs = append(pairs, labels...)
+		if extraName != "" {
+			pairs = append(pairs, &dto.LabelPair{Name: proto.String(extraName), Value: proto.String(extraValue)})
+		}
+		// Receivers expect labels sorted by name, including __name__
+		sort.Slice(pairs, func(i, j int) bool { return pairs[i].GetName() < pairs[j].GetName() })
+
+		key := seriesKey("", pairs)
+		s, ok := series[key]
+		if !ok {
+			if s, ok = w.series[key]; !ok {
+				s = &forwardSeries{labels: appendWriteLabels(nil, pairs)}
+			}
+			series[key] = s
+		}
+		w.queue = append(w.queue, queuedSample{series: s, value: value, timestamp: timestamp})
+	}
+
+	for _, mf := range mfs {
+		name := mf.GetName()
+		if !w.described[name] {
+			w.described[name] = true
+			w.metadata[name] = writeMetadata{typ: writeMetadataType(mf.GetType()), name: name, help: mf.GetHelp()}
+		}
+		for _, m := range mf.Metric {
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				add(name, m.Label, "", "", m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add(name, m.Label, "", "", m.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				add(name, m.Label, "", "", m.GetUntyped().GetValue())
+			case dto.MetricType_SUMMARY:
+				summary := m.GetSummary()
+				for _, q := range summary.GetQuantile() {
+					add(name, m.Label, "quantile", w.bounds.format(q.GetQuantile()), q.GetValue())
+				}
+				add(name+"_sum", m.Label, "", "", summary.GetSampleSum())
+				add(name+"_count", m.Label, "", "", float64(summary.GetSampleCount()))
+			case dto.MetricType_HISTOGRAM, dto.MetricType_GAUGE_HISTOGRAM:
+				histogram := m.GetHistogram()
+				inf := false
+				for _, b := range histogram.GetBucket() {
+					inf = inf || math.IsInf(b.GetUpperBound(), 1)
+					add(name+"_bucket", m.Label, "le", w.bounds.format(b.GetUpperBound()), float64(b.GetCumulativeCount()))
+				}
+				// The +Inf bucket is implied in the data model but not on the wire
+				if !inf {
+					add(name+"_bucket", m.Label, "le", "+Inf", float64(histogram.GetSampleCount()))
+				}
+				add(name+"_sum", m.Label, "", "", histogram.GetSampleSum())
+				add(name+"_count", m.Label, "", "", float64(histogram.GetSampleCount()))
+			}
+		}
+	}
+	w.series = series
+
+	if overflow := len(w.queue) - w.config.BufferSize; overflow > 0 {
+		if !w.dropping {
+			w.logger.Warn("Remote write buffer is full, dropping the oldest samples", "url", w.target, "buffer", w.config.BufferSize)
+			w.dropping = true
+		}
+		w.queue = w.queue[overflow:]
+		w.head += uint64(overflow)
+		w.metrics.remoteWriteSamples("dropped", overflow)
+	}
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run sends queued samples until ctx is done. Samples still queued then are
+// dropped.
+func (w *remoteWriter) run(ctx context.Context) {
+	retry := remoteWriteRetryMin
+	var failure string // Last error logged, to log each problem once
+	for {
+		samples, start, metadata, ok := w.next(ctx)
+		if !ok {
+			return
+		}
+		err := w.send(ctx, samples, metadata)
+		if ctx.Err() != nil {
+			return
+		}
+
+		var statusErr *remoteWriteStatusError
+		if err != nil && (!errors.As(err, &statusErr) || statusErr.retry()) {
+			if msg := err.Error(); msg != failure {
+				w.logger.Warn("Cannot send samples to remote write receiver, retrying", "url", w.target, "samples", len(samples), "error", err)
+				failure = msg
+			}
+			w.metrics.remoteWriteSamples("retried", len(samples))
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(retry):
+			}
+			retry = min(retry*2, remoteWriteRetryMax)
+			continue
+		}
+
+		if err != nil {
+			w.logger.Error("Remote write receiver rejected samples, dropping them", "url", w.target, "samples", len(samples), "error", err)
+			w.metrics.remoteWriteSamples("rejected", len(samples))
+		} else {
+			if failure != "" {
+				w.logger.Info("Sending samples to remote write receiver again", "url", w.target)
+				failure = ""
+			}
+			w.metrics.remoteWriteSamples("sent", len(samples))
+		}
+		retry = remoteWriteRetryMin
+		w.done(start, len(samples), metadata)
+	}
+}
+
+// next waits for queued samples or metadata and returns the oldest batch
+// with the queue position of its first sample. It returns false once ctx is
+// done.
+func (w *remoteWriter) next(ctx context.Context) ([]queuedSample, uint64, []writeMetadata, bool) {
+	for {
+		w.mu.Lock()
+		if len(w.queue) > 0 || len(w.metadata) > 0 {
+			samples := w.queue[:min(len(w.queue), w.config.BatchSize)]
+			metadata := make([]writeMetadata, 0, len(w.metadata))
+			for _, meta := range w.metadata {
+				metadata = append(metadata, meta)
+			}
+			start := w.head
+			w.mu.Unlock()
+			return samples, start, metadata, true
+		}
+		w.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return nil, 0, nil, false
+		case <-w.wake:
+		}
+	}
+}
+
+// done removes a batch from the queue once it needs no more attempts. Samples
+// of the batch that were dropped for room meanwhile are already gone.
+func (w *remoteWriter) done(start uint64, n int, metadata []writeMetadata) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if end := start + uint64(n); end > w.head {
+		sent := min(int(end-w.head), len(w.queue))
+		w.queue = w.queue[sent:]
+		w.head += uint64(sent)
+	}
+	if len(w.queue) == 0 {
+		// Let go of the backing array, which may have grown during an outage
+		w.queue = nil
+		w.dropping = false
+	}
+	for _, meta := range metadata {
+		if w.metadata[meta.name] == meta {
+			delete(w.metadata, meta.name)
+		}
+	}
+}
+
+// send posts samples and metadata as one remote_write request.
+func (w *remoteWriter) send(ctx context.Context, samples []queuedSample, metadata []writeMetadata) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.config.URL, bytes.NewReader(encodeWriteBatch(samples, metadata)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("User-Agent", "prommy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if auth := w.config.BasicAuth; auth != nil {
+		req.SetBasicAuth(auth.Username, auth.Password)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	// The start of the body usually explains a rejection
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+	return &remoteWriteStatusError{status: resp.StatusCode, message: strings.TrimSpace(string(body))}
+}
+
+// encodeWriteBatch encodes samples and metadata as a snappy-compressed
+// prometheus.WriteRequest, with the samples of each series in one
+// TimeSeries.
+func encodeWriteBatch(samples []queuedSample, metadata []writeMetadata) []byte {
+	var order []*forwardSeries
+	bySeries := make(map[*forwardSeries][]byte)
+	for _, sample := range samples {
+		encoded, ok := bySeries[sample.series]
+		if !ok {
+			order = append(order, sample.series)
+		}
+		bySeries[sample.series] = appendWriteSample(encoded, sample.value, sample.timestamp)
+	}
+
+	var req []byte
+	for _, series := range order {
+		req = protowire.AppendTag(req, writeRequestTimeseries, protowire.BytesType)
+		req = protowire.AppendVarint(req, uint64(len(series.labels)+len(bySeries[series])))
+		req = append(req, series.labels...)
+		req = append(req, bySeries[series]...)
+	}
+	for _, meta := range metadata {
+		req = appendWriteMetadata(req, meta)
+	}
+	return snappy.Encode(nil, req)
+}
+
+// writeMetadataType returns the prometheus.MetricMetadata.MetricType of a
+// family type.
+func writeMetadataType(typ dto.MetricType) int {
+	switch typ {
+	case dto.MetricType_COUNTER:
+		return metadataCounter
+	case dto.MetricType_GAUGE:
+		return metadataGauge
+	case dto.MetricType_SUMMARY:
+		return metadataSummary
+	case dto.MetricType_HISTOGRAM:
+		return metadataHistogram
+	case dto.MetricType_GAUGE_HISTOGRAM:
+		return metadataGaugeHistogram
+	}
+	return metadataUnknown
+}
@@ -0,0 +1,282 @@
+package prommy
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/prometheus/prompb"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestRemoteWriteTo(t *testing.T) {
+	receiver, receiverSrv := newTestServer(t, WithNopLogger(), WithRemoteWrite(0), WithBasicAuth("push", "secret"))
+
+	reg := prometheus.NewRegistry()
+	jobs := prometheus.NewCounter(prometheus.CounterOpts{Name: "jobs_total", Help: "Jobs done."})
+	jobs.Add(3)
+	latency := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "latency_seconds", Help: "Job latency.", Buckets: []float64{0.1, 1}})
+	latency.Observe(0.5)
+	reg.MustRegister(jobs, latency)
+	newTestServer(t, WithNopLogger(), WithRegistry(reg), WithTickerInterval(20*time.Millisecond), WithRemoteWriteTo(RemoteWriteConfig{
+		URL:       receiverSrv.URL + "/api/v1/write",
+		BasicAuth: &BasicAuth{Username: "push", Password: "secret"},
+	}))
+
+	want := map[string]Metric{
+		"jobs_total":                   {Name: "jobs_total", Type: "counter", Help: "Jobs done.", Labels: map[string]string{}, Value: 3},
+		`latency_seconds_bucket{0.1}`:  {Name: "latency_seconds_bucket", Type: "gauge", Labels: map[string]string{"le": "0.1"}, Value: 0},
+		`latency_seconds_bucket{1}`:    {Name: "latency_seconds_bucket", Type: "gauge", Labels: map[string]string{"le": "1"}, Value: 1},
+		`latency_seconds_bucket{+Inf}`: {Name: "latency_seconds_bucket", Type: "gauge", Labels: map[string]string{"le": "+Inf"}, Value: 1},
+		"latency_seconds_count":        {Name: "latency_seconds_count", Type: "gauge", Labels: map[string]string{}, Value: 1},
+		"latency_seconds_sum":          {Name: "latency_seconds_sum", Type: "gauge", Labels: map[string]string{}, Value: 0.5},
+	}
+	var got map[string]Metric
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		metrics, _ := receiver.collectMetrics()
+		got = make(map[string]Metric)
+		for _, m := range metrics {
+			key := m.Name
+			if le, ok := m.Labels["le"]; ok {
+				key += "{" + le + "}"
+			}
+			got[key] = m
+		}
+		if reflect.DeepEqual(got, want) {
+			return
+		}
+	}
+	t.Errorf("receiver shows %+v, want %+v", got, want)
+}
+
+func TestRemoteWriteToSkipsRepeatedSnapshots(t *testing.T) {
+	receiver := &testReceiver{}
+	receiverSrv := httptest.NewServer(receiver)
+	t.Cleanup(receiverSrv.Close)
+
+	// Every gather sees a new value, so a snapshot sent twice shows as a repeat
+	var gathers atomic.Int64
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{Name: "test_value", Help: "A test value."}, func() float64 {
+		return float64(gathers.Add(1))
+	}))
+	s, srv := newTestServer(t, WithNopLogger(), WithRegistry(reg), WithTickerInterval(20*time.Millisecond),
+		WithRemoteWriteTo(RemoteWriteConfig{URL: receiverSrv.URL}))
+
+	// A dashboard asking for faster updates does not speed up forwarding
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws?interval=1", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	var values []float64
+	for deadline := start.Add(5 * time.Second); len(values) < 10; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("receiver got %v, want 10 samples", values)
+		}
+		values, _ = receiver.received()
+	}
+	if limit := int(time.Since(start)/(20*time.Millisecond)) + 2; len(values) > limit {
+		t.Errorf("receiver got %d samples in %v, want at most %d at the default interval", len(values), time.Since(start), limit)
+	}
+	for i := 1; i < len(values); i++ {
+		if values[i] <= values[i-1] {
+			t.Fatalf("forwarded values %v, want every snapshot once", values)
+		}
+	}
+
+	// Close stops forwarding
+	s.Close()
+	time.Sleep(50 * time.Millisecond)
+	_, before := receiver.received()
+	time.Sleep(100 * time.Millisecond)
+	if _, after := receiver.received(); after != before {
+		t.Errorf("receiver got %d requests after Close, want none", after-before)
+	}
+}
+
+func TestRemoteWriteToSharesGathers(t *testing.T) {
+	receiver := &testReceiver{}
+	receiverSrv := httptest.NewServer(receiver)
+	t.Cleanup(receiverSrv.Close)
+
+	var gathers atomic.Int64
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{Name: "test_value", Help: "A test value."}, func() float64 {
+		return float64(gathers.Add(1))
+	}))
+	_, srv := newTestServer(t, WithNopLogger(), WithRegistry(reg), WithTickerInterval(20*time.Millisecond),
+		WithRemoteWriteTo(RemoteWriteConfig{URL: receiverSrv.URL}))
+
+	// A dashboard asking for slower updates does not slow down forwarding
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws?interval=60000", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	var values []float64
+	for deadline := start.Add(5 * time.Second); len(values) < 10; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("receiver got %v, want 10 samples", values)
+		}
+		values, _ = receiver.received()
+	}
+
+	// Without a snapshot cache, forwarding reuses the dashboard's gathers
+	if limit := int64(time.Since(start)/(20*time.Millisecond)) + 2; gathers.Load() > limit {
+		t.Errorf("registry gathered %d times in %v, want at most %d at the default interval", gathers.Load(), time.Since(start), limit)
+	}
+}
+
+// testReceiver is a remote_write receiver recording the values of
+// test_value, answering with the queued statuses before accepting requests.
+type testReceiver struct {
+	mu       sync.Mutex
+	statuses []int
+	values   []float64
+	metadata []writeMetadata
+	requests int
+}
+
+func (r *testReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+	data, err := snappy.Decode(nil, body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Decoded with prompb to check the writer against Prometheus' own types
+	var wr prompb.WriteRequest
+	if err := wr.Unmarshal(data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests++
+	if len(r.statuses) > 0 {
+		status := r.statuses[0]
+		r.statuses = r.statuses[1:]
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	for _, ts := range wr.Timeseries {
+		for _, label := range ts.Labels {
+			if label.Name == metricNameLabel && label.Value == "test_value" {
+				for _, sample := range ts.Samples {
+					r.values = append(r.values, sample.Value)
+				}
+			}
+		}
+	}
+	for _, meta := range wr.Metadata {
+		r.metadata = append(r.metadata, writeMetadata{typ: int(meta.Type), name: meta.MetricFamilyName, help: meta.Help})
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (r *testReceiver) received() ([]float64, int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]float64(nil), r.values...), r.requests
+}
+
+func TestRemoteWriterQueue(t *testing.T) {
+	receiver := &testReceiver{statuses: []int{http.StatusServiceUnavailable, http.StatusTooManyRequests}}
+	srv := httptest.NewServer(receiver)
+	t.Cleanup(srv.Close)
+
+	w := newRemoteWriter(RemoteWriteConfig{URL: srv.URL, BatchSize: 3, BufferSize: 4}, slog.New(discardHandler{}), nil)
+	at := time.Unix(1700000000, 0)
+	tick := func(value float64) {
+		at = at.Add(time.Second)
+		w.enqueue([]*dto.MetricFamily{{
+			Name:   proto.String("test_value"),
+			Help:   proto.String("A test value."),
+			Type:   dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{{Gauge: &dto.Gauge{Value: proto.Float64(value)}}},
+		}}, at)
+	}
+	waitFor := func(want []float64) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			got, _ := receiver.received()
+			if reflect.DeepEqual(got, want) {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("received %v, want %v", got, want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// A full buffer drops the oldest samples
+	for v := 1; v <= 6; v++ {
+		tick(float64(v))
+	}
+	if len(w.queue) != 4 || w.head != 2 {
+		t.Fatalf("queue holds %d samples from %d, want 4 from 2", len(w.queue), w.head)
+	}
+
+	// Failed requests are retried until the receiver accepts them, in order
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go w.run(ctx)
+	waitFor([]float64{3, 4, 5, 6})
+	if _, requests := receiver.received(); requests != 4 {
+		t.Errorf("receiver got %d requests, want 2 failures and 2 batches", requests)
+	}
+	receiver.mu.Lock()
+	metadata := receiver.metadata
+	receiver.mu.Unlock()
+	if want := []writeMetadata{{typ: metadataGauge, name: "test_value", help: "A test value."}}; !reflect.DeepEqual(metadata, want) {
+		t.Errorf("metadata = %+v, want %+v", metadata, want)
+	}
+
+	// A batch the receiver rejects as invalid is not sent again
+	receiver.mu.Lock()
+	receiver.statuses = []int{http.StatusBadRequest}
+	receiver.mu.Unlock()
+	tick(7)
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, requests := receiver.received(); requests == 5 {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("receiver got %d requests, want 5", requests)
+		}
+	}
+	tick(8)
+	waitFor([]float64{3, 4, 5, 6, 8})
+}
+
+func TestRemoteWriteToValidation(t *testing.T) {
+	for _, rw := range []RemoteWriteConfig{
+		{URL: "prometheus:9090/api/v1/write"},
+		{URL: "ftp://prometheus/write"},
+		{URL: "http://prometheus:9090/api/v1/write", BatchSize: -1},
+		{URL: "http://prometheus:9090/api/v1/write", BasicAuth: &BasicAuth{}},
+	} {
+		if _, err := New(WithRemoteWriteTo(rw)); err == nil {
+			t.Errorf("New(WithRemoteWriteTo(%+v)) succeeded, want error", rw)
+		}
+	}
+}
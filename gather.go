@@ -0,0 +1,270 @@
+package prommy
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Default limit on how long a single gather may take before the last good snapshot is served.
+const defaultGatherTimeout = 10 * time.Second
+
+// gatherCoordinator runs gathers off the caller's goroutine so that a slow
+// collector cannot stall the dashboard or /metrics scrapes. Callers that
+// arrive while a gather is in flight share it instead of starting another,
+// and callers that wait longer than the timeout get the last good result.
+// With a positive maxAge, callers are also served the last result directly
+// while it is younger than maxAge, so ticks and scrapes share one gather.
+type gatherCoordinator struct {
+	source  prometheus.Gatherer
+	timeout time.Duration
+
+	// Collect durations of the timed collectors in source
+	timings *timingTable
+
+	// Instrumentation, nil when self-metrics are disabled
+	metrics *selfMetrics
+
+	mu       sync.Mutex
+	maxAge   time.Duration // Snapshot cache lifetime, follows the gather interval
+	inflight *gatherCall   // Gather currently running, nil if idle
+	last     *gatherResult // Most recent completed gather, served by the snapshot cache
+	lastGood *gatherResult // Most recent gather without errors, served when a gather is slow
+}
+
+// gatherCall is a gather shared by every caller that arrived while it was running.
+type gatherCall struct {
+	start  time.Time
+	done   chan struct{}
+	result *gatherResult
+}
+
+// gatherResult is the outcome of one call to the underlying gatherer.
+type gatherResult struct {
+	mfs []*dto.MetricFamily
+	err error
+	at  time.Time
+}
+
+// slowGatherError reports a gather that did not finish within its timeout.
+type slowGatherError struct {
+	collector string        // Timed collector still running, empty if unknown
+	elapsed   time.Duration // How long the gather had been running
+	staleAt   time.Time     // When the snapshot served instead was taken, zero if none
+}
+
+func (e *slowGatherError) Error() string {
+	msg := fmt.Sprintf("gather still running after %s", e.elapsed.Round(time.Millisecond))
+	if e.collector != "" {
+		msg += fmt.Sprintf(", waiting on collector %q", e.collector)
+	}
+	if e.staleAt.IsZero() {
+		return msg + "; no earlier snapshot to serve"
+	}
+	return msg + "; serving snapshot from " + e.staleAt.Format(time.TimeOnly)
+}
+
+// newGatherCoordinator wraps source with overlap protection, a timeout and
+// an optional snapshot cache of maxAge.
+func newGatherCoordinator(source prometheus.Gatherer, timeout, maxAge time.Duration) *gatherCoordinator {
+	if timeout <= 0 {
+		timeout = defaultGatherTimeout
+	}
+	return &gatherCoordinator{source: source, timeout: timeout, maxAge: maxAge, timings: newTimingTable()}
+}
+
+// setMaxAge changes how long gathers are reused, 0 disabling the cache.
+func (g *gatherCoordinator) setMaxAge(maxAge time.Duration) {
+	g.mu.Lock()
+	g.maxAge = maxAge
+	g.mu.Unlock()
+}
+
+// Gather implements prometheus.Gatherer.
+func (g *gatherCoordinator) Gather() ([]*dto.MetricFamily, error) {
+	mfs, _, err := g.snapshot()
+	return mfs, err
+}
+
+// snapshot gathers like Gather and also returns when the result was
+// gathered, so that callers can tell a result they already saw. The time is
+// zero when the gather ran past the timeout and an earlier one was served.
+func (g *gatherCoordinator) snapshot() ([]*dto.MetricFamily, time.Time, error) {
+	if cached := g.cached(); cached != nil {
+		g.metrics.snapshotCacheHit(true)
+		return cached.mfs, cached.at, cached.err
+	}
+	g.metrics.snapshotCacheHit(false)
+
+	call := g.start()
+
+	timer := time.NewTimer(g.timeout)
+	defer timer.Stop()
+
+	select {
+	case <-call.done:
+		return call.result.mfs, call.result.at, call.result.err
+	case <-timer.C:
+		mfs, err := g.stale(call)
+		return mfs, time.Time{}, err
+	}
+}
+
+// cached returns the last result if the snapshot cache is enabled and it is
+// still younger than maxAge.
+func (g *gatherCoordinator) cached() *gatherResult {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.maxAge <= 0 || g.last == nil || time.Since(g.last.at) > g.maxAge {
+		return nil
+	}
+	return g.last
+}
+
+// start returns the in-flight gather, starting a new one if none is running.
+func (g *gatherCoordinator) start() *gatherCall {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.inflight != nil {
+		return g.inflight
+	}
+
+	call := &gatherCall{start: time.Now(), done: make(chan struct{})}
+	g.inflight = call
+	go func() {
+		mfs, err := g.source.Gather()
+		result := &gatherResult{mfs: mfs, err: err, at: call.start}
+
+		g.mu.Lock()
+		call.result = result
+		g.inflight = nil
+		g.last = result
+		if err == nil {
+			g.lastGood = result
+		}
+		g.mu.Unlock()
+		close(call.done)
+	}()
+	return call
+}
+
+// stale returns the last good result along with errors naming the
+// collectors that are holding up the in-flight gather.
+func (g *gatherCoordinator) stale(call *gatherCall) ([]*dto.MetricFamily, error) {
+	g.mu.Lock()
+	last := g.lastGood
+	g.mu.Unlock()
+
+	slow := &slowGatherError{elapsed: time.Since(call.start)}
+	var mfs []*dto.MetricFamily
+	if last != nil {
+		mfs = last.mfs
+		slow.staleAt = last.at
+	}
+
+	running := g.timings.running()
+	if len(running) == 0 {
+		return mfs, prometheus.MultiError{slow}
+	}
+	errs := make(prometheus.MultiError, 0, len(running))
+	for _, name := range running {
+		e := *slow
+		e.collector = name
+		errs = append(errs, &e)
+	}
+	return mfs, errs
+}
+
+// timedCollector measures the Collect calls of a collector registered with
+// WithTimedCollector, recording them in the table of its server.
+type timedCollector struct {
+	prometheus.Collector
+	name    string
+	timings *timingTable
+}
+
+// Collect implements prometheus.Collector.
+func (t *timedCollector) Collect(ch chan<- prometheus.Metric) {
+	start := time.Now()
+	t.timings.begin(t.name, start)
+	defer func() {
+		t.timings.end(t.name, time.Since(start))
+	}()
+	t.Collector.Collect(ch)
+}
+
+// timingTable tracks Collect durations per named collector.
+type timingTable struct {
+	mu      sync.Mutex
+	entries map[string]*collectorTiming
+}
+
+func newTimingTable() *timingTable {
+	return &timingTable{entries: make(map[string]*collectorTiming)}
+}
+
+// collectorTiming is the timing state of one named collector.
+type collectorTiming struct {
+	running int           // Collect calls currently in progress
+	started time.Time     // Start of the oldest Collect in progress
+	last    time.Duration // Duration of the last completed Collect
+}
+
+func (t *timingTable) begin(name string, start time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e, ok := t.entries[name]
+	if !ok {
+		e = &collectorTiming{}
+		t.entries[name] = e
+	}
+	if e.running == 0 {
+		e.started = start
+	}
+	e.running++
+}
+
+func (t *timingTable) end(name string, d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e := t.entries[name]
+	e.running--
+	e.last = d
+}
+
+// running returns the sorted names of collectors with a Collect in progress.
+func (t *timingTable) running() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var names []string
+	for name, e := range t.entries {
+		if e.running > 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// durations returns how long each collector's Collect takes: the last
+// completed call, or the time spent so far if a longer call is in progress.
+func (t *timingTable) durations() map[string]time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	result := make(map[string]time.Duration, len(t.entries))
+	for name, e := range t.entries {
+		d := e.last
+		if e.running > 0 {
+			if elapsed := time.Since(e.started); elapsed > d {
+				d = elapsed
+			}
+		}
+		result[name] = d
+	}
+	return result
+}
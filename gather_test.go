@@ -0,0 +1,173 @@
+package prommy
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// blockingCollector reports a gauge, optionally waiting for release first.
+type blockingCollector struct {
+	desc    *prometheus.Desc
+	block   atomic.Bool
+	release chan struct{}
+	calls   atomic.Int32
+}
+
+func newBlockingCollector() *blockingCollector {
+	return &blockingCollector{
+		desc:    prometheus.NewDesc("test_slow_query_rows", "Rows returned by a slow query.", nil, nil),
+		release: make(chan struct{}),
+	}
+}
+
+func (c *blockingCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *blockingCollector) Collect(ch chan<- prometheus.Metric) {
+	c.calls.Add(1)
+	if c.block.Load() {
+		<-c.release
+	}
+	ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, 42)
+}
+
+func TestGatherCoordinatorServesLastGoodSnapshot(t *testing.T) {
+	slow := newBlockingCollector()
+	reg := prometheus.NewRegistry()
+	g := newGatherCoordinator(reg, 20*time.Millisecond, 0)
+	reg.MustRegister(&timedCollector{Collector: slow, name: "slow_query", timings: g.timings})
+
+	// A fast gather establishes the last good snapshot
+	mfs, err := g.Gather()
+	if err != nil || len(mfs) != 1 {
+		t.Fatalf("initial gather = %d families, %v", len(mfs), err)
+	}
+
+	// Now the collector hangs; concurrent callers must share one gather and time out
+	slow.block.Store(true)
+	var wg sync.WaitGroup
+	results := make([]error, 5)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			mfs, err := g.Gather()
+			if len(mfs) != 1 {
+				t.Errorf("stale gather returned %d families, want last good snapshot", len(mfs))
+			}
+			results[i] = err
+		}(i)
+	}
+	wg.Wait()
+
+	if calls := slow.calls.Load(); calls != 2 {
+		t.Errorf("Collect called %d times, want 2 (overlapping gathers must be shared)", calls)
+	}
+	for _, err := range results {
+		errs := gatherErrors(err)
+		if len(errs) != 1 || errs[0].Kind != GatherErrorTimeout || errs[0].Collector != "slow_query" {
+			t.Errorf("gather errors = %+v, want timeout naming slow_query", errs)
+		}
+	}
+
+	if d := g.timings.durations()["slow_query"]; d < 20*time.Millisecond {
+		t.Errorf("in-flight duration = %v, want at least the timeout", d)
+	}
+
+	// Once the collector recovers, the next gather is fresh again
+	slow.block.Store(false)
+	close(slow.release)
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, err := g.Gather(); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("gather did not recover after the collector was released")
+		}
+	}
+}
+
+func TestGatherCoordinatorWithoutSnapshot(t *testing.T) {
+	slow := newBlockingCollector()
+	slow.block.Store(true)
+	defer close(slow.release)
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(slow)
+
+	mfs, err := newGatherCoordinator(reg, 10*time.Millisecond, 0).Gather()
+	if len(mfs) != 0 {
+		t.Errorf("got %d families before any gather completed", len(mfs))
+	}
+	errs := gatherErrors(err)
+	if len(errs) != 1 || errs[0].Kind != GatherErrorTimeout || errs[0].Collector != "" {
+		t.Errorf("gather errors = %+v, want one anonymous timeout", errs)
+	}
+}
+
+func TestGatherCoordinatorKeepsLastGoodSnapshot(t *testing.T) {
+	slow := newBlockingCollector()
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(slow)
+	g := newGatherCoordinator(reg, 20*time.Millisecond, 0)
+	if _, err := g.Gather(); err != nil {
+		t.Fatalf("initial gather: %v", err)
+	}
+
+	// A gather with errors is not a good snapshot to fall back to
+	failing := newFailingCollector()
+	reg.MustRegister(failing)
+	if mfs, err := g.Gather(); err == nil || len(mfs) != 2 {
+		t.Fatalf("failing gather = %d families, %v; want the partial result and an error", len(mfs), err)
+	}
+
+	slow.block.Store(true)
+	defer close(slow.release)
+	mfs, _ := g.Gather()
+	if len(mfs) != 1 || mfs[0].GetName() != "test_slow_query_rows" {
+		t.Errorf("stale gather served %d families, want the snapshot from before the failure", len(mfs))
+	}
+}
+
+func TestTimedCollectorsPerServer(t *testing.T) {
+	a, _ := newTestServer(t, WithTimedCollector("query_a", newBlockingCollector()))
+	b, _ := newTestServer(t)
+	if _, err := a.gather.Gather(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := a.gather.timings.durations()["query_a"]; !ok {
+		t.Error("server a has no timing for its collector")
+	}
+	if d := b.gather.timings.durations(); len(d) != 0 {
+		t.Errorf("server b sees timings %v of another server", d)
+	}
+}
+
+func TestGatherCoordinatorSnapshotTime(t *testing.T) {
+	slow := newBlockingCollector()
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(slow)
+
+	// A cached snapshot keeps the time it was gathered
+	g := newGatherCoordinator(reg, 20*time.Millisecond, time.Hour)
+	_, first, err := g.snapshot()
+	if err != nil || first.IsZero() {
+		t.Fatalf("snapshot() = %v, %v, want a gather time", first, err)
+	}
+	if _, at, _ := g.snapshot(); !at.Equal(first) {
+		t.Errorf("cached snapshot() time = %v, want %v", at, first)
+	}
+
+	// A snapshot served in place of a slow gather has no time
+	g.setMaxAge(0)
+	slow.block.Store(true)
+	defer close(slow.release)
+	if _, at, err := g.snapshot(); !at.IsZero() || err == nil {
+		t.Errorf("slow snapshot() = %v, %v, want no time and an error", at, err)
+	}
+}
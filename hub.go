@@ -1,34 +1,185 @@
 package prommy
 
 import (
-	"log"
+	"compress/flate"
+	"encoding/json"
+	"log/slog"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
 const (
-	// Maximum number of allowed WebSocket connections
-	maxConnections = 64
+	// Default maximum number of allowed WebSocket connections
+	defaultMaxConnections = 64
+
+	// Default number of snapshots kept for replay to reconnecting clients
+	defaultReplayBufferSize = 60
+
+	// Default number of frames queued per client before the slow-client policy applies
+	defaultClientBufferSize = 256
+
+	// Default deflate level for compressed connections, favoring CPU over ratio
+	defaultCompressionLevel = flate.BestSpeed
+
+	// Default size below which frames are sent uncompressed, where deflate saves little
+	defaultCompressionThreshold = 1024
+
+	// Default bounds for the update interval a client may request
+	defaultMinInterval = 250 * time.Millisecond
+	defaultMaxInterval = time.Minute
+
+	// Largest message accepted from a client
+	maxClientMessageSize = 1024
+)
+
+// SlowClientPolicy selects what the hub does when a client's send queue is full.
+type SlowClientPolicy string
+
+const (
+	// SlowClientDisconnect closes the connection of a client that cannot keep up.
+	SlowClientDisconnect SlowClientPolicy = "disconnect"
+
+	// SlowClientDropOldest discards the oldest queued snapshot to make room for the new one.
+	SlowClientDropOldest SlowClientPolicy = "drop-oldest"
+
+	// SlowClientCoalesce discards every queued snapshot and keeps only the latest.
+	SlowClientCoalesce SlowClientPolicy = "coalesce"
 )
 
 // Hub manages WebSocket connections and broadcasts metrics updates.
+//
+// Publishing never blocks on clients: each snapshot is serialized once into
+// a shared frame and appended to every client's queue, and a per-client
+// writer goroutine drains its queue at whatever pace the connection allows.
 type Hub struct {
 	// Registered clients
 	clients map[*Client]bool
 
-	// Message broadcast channel
-	broadcast chan []byte
+	// Mutex to protect clients map, sequence state and replay buffer
+	mu sync.Mutex
+
+	// Identifies this hub instance so clients can detect a server restart
+	epoch string
 
-	// Register requests from clients
-	register chan *Client
+	// Sequence number of the last broadcast snapshot
+	seq uint64
 
-	// Unregister requests from clients
-	unregister chan *Client
+	// Ring buffer of recent snapshots, oldest first
+	replay []*snapshot
 
-	// Mutex to protect clients map
-	mu sync.Mutex
+	// Maximum number of snapshots kept in the replay buffer
+	replaySize int
+
+	// Maximum number of frames queued per client
+	queueSize int
+
+	// What to do when a client's queue is full
+	policy SlowClientPolicy
+
+	// Deflate settings for clients that negotiated permessage-deflate
+	compress          bool
+	compressLevel     int
+	compressThreshold int
+
+	// Bounds for the update intervals clients request, and the interval of
+	// clients that request none
+	minInterval     time.Duration
+	maxInterval     time.Duration
+	defaultInterval time.Duration
+
+	// Current time between gathers, used to absorb tick jitter when scheduling clients
+	tickInterval time.Duration
+
+	// Gather at least every default interval whoever is connected, set while
+	// samples are forwarded with remote_write
+	gatherDefault bool
+
+	// Signals the broadcaster that the fastest requested interval may have changed
+	intervalChanged chan struct{}
+
+	// Connection quotas enforced by admit, zero means unlimited for per-IP and per-user
+	maxConns        int
+	maxConnsPerIP   int
+	maxConnsPerUser int
+
+	// Connection slots currently held, in total and per remote IP and user
+	leased      int
+	leasedIP    map[string]int
+	leasedUsers map[string]int
+
+	// Instrumentation, nil when self-metrics are disabled
+	metrics *selfMetrics
+
+	// Diagnostics, and the id given to the most recent client for log records
+	logger   *slog.Logger
+	clientID atomic.Uint64
+}
+
+// Connection limits reported by admit when a client is turned away.
+const (
+	limitGlobal = "global"
+	limitIP     = "ip"
+	limitUser   = "user"
+)
+
+// connLease is a connection slot reserved by admit and returned by release.
+type connLease struct {
+	ip   string
+	user string
+}
+
+// tick is one gathered metrics payload in every wire encoding being served.
+type tick struct {
+	json   []byte        // JSON-encoded metrics
+	cbor   []byte        // CBOR string table and metrics, nil if binary encoding is disabled
+	errors []GatherError // Problems reported by the gather, nil if it was clean
+}
+
+// snapshot is a single broadcast metrics payload tagged with its sequence number.
+type snapshot struct {
+	seq    uint64
+	ts     int64  // Unix milliseconds when the snapshot was taken
+	tick   *tick  // Payload in every available encoding
+	errors []byte // JSON-encoded gather errors, nil if the gather was clean
+
+	// Envelope sent to clients in each encoding, built once per snapshot
+	frames [encodingCount]*frame
+}
+
+// frame returns the envelope for clients using enc. Clients that negotiated
+// an encoding the snapshot was not produced in get JSON.
+func (snap *snapshot) frame(enc wireEncoding) *frame {
+	if f := snap.frames[enc]; f != nil {
+		return f
+	}
+	return snap.frames[encodingJSON]
+}
+
+// frame is a pre-serialized WebSocket message shared by every client it is sent to.
+type frame struct {
+	seq         uint64 // Sequence number of the snapshot it carries
+	messageType int
+	data        []byte
+	prepared    *websocket.PreparedMessage
+}
+
+// newFrame serializes data once so it can be written to many connections.
+func newFrame(messageType int, data []byte) *frame {
+	f := &frame{messageType: messageType, data: data}
+	if pm, err := websocket.NewPreparedMessage(messageType, data); err == nil {
+		f.prepared = pm
+	}
+	return f
+}
+
+// resumePoint is the position a reconnecting client has already seen.
+type resumePoint struct {
+	epoch string
+	seq   uint64
 }
 
 // Client represents a connected WebSocket client.
@@ -36,102 +187,649 @@ type Client struct {
 	// The hub instance
 	hub *Hub
 
-	// The WebSocket connection
-	conn *websocket.Conn
+	// Connection the client's frames are written to
+	transport transport
+
+	// Logger tagged with the client's id and connection details
+	log *slog.Logger
+
+	// Mutex to protect the queue and closed flag
+	mu sync.Mutex
+
+	// Outbound frames waiting to be written, oldest first
+	queue []*frame
+
+	// Signals the writer that the queue is non-empty or the client was closed
+	notify chan struct{}
 
-	// Buffered channel of outbound messages
-	send chan []byte
+	// Set once the hub has dropped the client
+	closed bool
+
+	// Last snapshot seen before reconnecting, nil for fresh connections
+	resume *resumePoint
+
+	// Connection slot held by the client, nil if it was not admitted through admit
+	lease *connLease
+
+	// Encoding negotiated through the WebSocket subprotocol
+	encoding wireEncoding
+
+	// Delivery schedule, protected by the hub's mutex. Snapshots published
+	// before nextDue are skipped, so the client only sees the latest state at
+	// its own cadence. requested is the interval the client asked for, zero
+	// to follow the hub's default.
+	requested time.Duration
+	interval  time.Duration
+	nextDue   time.Time
 }
 
-// newHub creates a new hub instance and starts its run loop.
-func newHub() *Hub {
-	h := &Hub{
-		clients:    make(map[*Client]bool),
-		broadcast:  make(chan []byte),
-		register:   make(chan *Client),
-		unregister: make(chan *Client),
+// newHub creates a new hub configured from cfg.
+func newHub(cfg *Config) *Hub {
+	replaySize := cfg.ReplayBufferSize
+	if replaySize <= 0 {
+		replaySize = defaultReplayBufferSize
+	}
+	queueSize := cfg.ClientBufferSize
+	if queueSize <= 0 {
+		queueSize = defaultClientBufferSize
+	}
+	policy := cfg.SlowClientPolicy
+	if policy == "" {
+		policy = SlowClientDisconnect
+	}
+	maxConns := cfg.MaxConnections
+	if maxConns <= 0 {
+		maxConns = defaultMaxConnections
+	}
+	compressLevel := cfg.CompressionLevel
+	if compressLevel == 0 || compressLevel < flate.HuffmanOnly || compressLevel > flate.BestCompression {
+		compressLevel = defaultCompressionLevel
+	}
+	compressThreshold := cfg.CompressionThreshold
+	if compressThreshold <= 0 {
+		compressThreshold = defaultCompressionThreshold
+	}
+	// The configured ticker interval is always allowed, even outside the default bounds
+	minInterval := cfg.MinInterval
+	if minInterval <= 0 {
+		minInterval = min(defaultMinInterval, cfg.TickerInterval)
+	}
+	maxInterval := cfg.MaxInterval
+	if maxInterval <= 0 {
+		maxInterval = max(defaultMaxInterval, cfg.TickerInterval)
+	}
+	maxInterval = max(maxInterval, minInterval)
+	return &Hub{
+		clients:           make(map[*Client]bool),
+		epoch:             strconv.FormatInt(time.Now().UnixNano(), 36),
+		replaySize:        replaySize,
+		queueSize:         queueSize,
+		policy:            policy,
+		compress:          cfg.Compression,
+		compressLevel:     compressLevel,
+		compressThreshold: compressThreshold,
+		minInterval:       minInterval,
+		maxInterval:       maxInterval,
+		defaultInterval:   cfg.TickerInterval,
+		tickInterval:      cfg.TickerInterval,
+		intervalChanged:   make(chan struct{}, 1),
+		logger:            cfg.logger(),
+		maxConns:          maxConns,
+		maxConnsPerIP:     cfg.MaxConnectionsPerIP,
+		maxConnsPerUser:   cfg.MaxConnectionsPerUser,
+		leasedIP:          make(map[string]int),
+		leasedUsers:       make(map[string]int),
 	}
-	go h.run()
-	return h
 }
 
-// run starts the hub's event loop.
-func (h *Hub) run() {
-	for {
-		select {
-		case client := <-h.register:
-			h.mu.Lock()
-			// Check if we're at connection limit
-			if len(h.clients) >= maxConnections {
-				h.mu.Unlock()
-				client.conn.WriteControl(
-					websocket.CloseMessage,
-					websocket.FormatCloseMessage(1013, "Maximum connections reached, try again later"),
-					time.Now().Add(time.Second),
-				)
-				client.conn.Close()
-				continue
-			}
-			h.clients[client] = true
-			h.mu.Unlock()
-
-		case client := <-h.unregister:
-			h.mu.Lock()
-			if _, ok := h.clients[client]; ok {
-				delete(h.clients, client)
-				close(client.send)
-			}
-			h.mu.Unlock()
-
-		case message := <-h.broadcast:
-			h.mu.Lock()
-			for client := range h.clients {
-				select {
-				case client.send <- message:
-					// Message sent to client
-				default:
-					// Client is slow or disconnected, skip this message and close
-					close(client.send)
-					delete(h.clients, client)
-				}
+// admit reserves a connection slot for a client from ip authenticated as
+// user, which may be empty for anonymous clients. If a quota is exhausted it
+// returns a nil lease and the name of the limit that was hit.
+func (h *Hub) admit(ip, user string) (*connLease, string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	limit := ""
+	switch {
+	case h.leased >= h.maxConns:
+		limit = limitGlobal
+	case h.maxConnsPerIP > 0 && h.leasedIP[ip] >= h.maxConnsPerIP:
+		limit = limitIP
+	case h.maxConnsPerUser > 0 && user != "" && h.leasedUsers[user] >= h.maxConnsPerUser:
+		limit = limitUser
+	}
+	if limit != "" {
+		h.metrics.connectionRejected(limit)
+		return nil, limit
+	}
+
+	h.leased++
+	h.leasedIP[ip]++
+	if user != "" {
+		h.leasedUsers[user]++
+	}
+	h.metrics.connectionAccepted()
+	return &connLease{ip: ip, user: user}, ""
+}
+
+// release returns a connection slot reserved by admit.
+func (h *Hub) release(lease *connLease) {
+	if lease == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.leased--
+	if h.leasedIP[lease.ip]--; h.leasedIP[lease.ip] <= 0 {
+		delete(h.leasedIP, lease.ip)
+	}
+	if lease.user != "" {
+		if h.leasedUsers[lease.user]--; h.leasedUsers[lease.user] <= 0 {
+			delete(h.leasedUsers, lease.user)
+		}
+	}
+}
+
+// clientCount returns the number of registered clients.
+func (h *Hub) clientCount() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.clients)
+}
+
+// register adds a client to the hub, queueing any snapshots it missed.
+func (h *Hub) register(client *Client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	client.interval = h.clampInterval(client.requested)
+
+	// Queue missed snapshots before the client can see new broadcasts
+	frames := h.backfill(client.resume, client.encoding)
+	for _, f := range frames {
+		client.push(f)
+	}
+	if len(frames) > 0 {
+		client.nextDue = time.Now().Add(client.interval)
+	}
+	h.clients[client] = true
+	h.notifyIntervalChanged()
+	client.log.Debug("Client connected", "interval", client.interval, "resume", client.resume != nil)
+}
+
+// unregister removes a client from the hub and stops its writer.
+func (h *Hub) unregister(client *Client) {
+	h.mu.Lock()
+	_, ok := h.clients[client]
+	delete(h.clients, client)
+	h.mu.Unlock()
+	client.close()
+	if ok {
+		h.notifyIntervalChanged()
+		client.log.Debug("Client disconnected")
+	}
+}
+
+// clampInterval bounds a requested update interval by the configured
+// minimum and maximum. Zero selects the default interval.
+// Must be called with h.mu held.
+func (h *Hub) clampInterval(d time.Duration) time.Duration {
+	if d <= 0 {
+		return h.defaultInterval
+	}
+	return min(max(d, h.minInterval), h.maxInterval)
+}
+
+// intervalFor returns the update interval of a client requesting d, zero
+// for the default.
+func (h *Hub) intervalFor(d time.Duration) time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.clampInterval(d)
+}
+
+// setInterval changes how often client receives snapshots. A client that
+// speeds up gets its next snapshot no later than the new interval from now.
+func (h *Hub) setInterval(client *Client, d time.Duration) {
+	h.mu.Lock()
+	client.requested = d
+	client.interval = h.clampInterval(d)
+	if next := time.Now().Add(client.interval); client.nextDue.After(next) {
+		client.nextDue = next
+	}
+	h.mu.Unlock()
+	h.notifyIntervalChanged()
+}
+
+// setDefaultInterval changes the interval of clients that did not request
+// their own, and how often metrics are gathered while nobody is connected.
+func (h *Hub) setDefaultInterval(d time.Duration) {
+	h.mu.Lock()
+	h.defaultInterval = d
+	now := time.Now()
+	for client := range h.clients {
+		if client.requested <= 0 {
+			client.interval = d
+			if next := now.Add(d); client.nextDue.After(next) {
+				client.nextDue = next
 			}
-			h.mu.Unlock()
 		}
 	}
+	h.mu.Unlock()
+	h.notifyIntervalChanged()
+}
+
+// updateGatherInterval returns how often metrics need to be gathered: as
+// often as the fastest client wants them, or the default interval when
+// nobody is connected or gatherDefault is set and clients want them less
+// often. It also records the result for delivery scheduling.
+func (h *Hub) updateGatherInterval() time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	d := h.defaultInterval
+	if len(h.clients) > 0 {
+		d = h.maxInterval
+		for client := range h.clients {
+			d = min(d, client.interval)
+		}
+		if h.gatherDefault {
+			d = min(d, h.defaultInterval)
+		}
+	}
+	h.tickInterval = d
+	return d
+}
+
+// notifyIntervalChanged wakes the broadcaster without blocking.
+func (h *Hub) notifyIntervalChanged() {
+	select {
+	case h.intervalChanged <- struct{}{}:
+	default:
+	}
+}
+
+// record assigns the next sequence number to t, stores it in the replay
+// buffer and returns the snapshot to send to clients.
+// Must be called with h.mu held.
+func (h *Hub) record(t *tick) *snapshot {
+	h.seq++
+	snap := &snapshot{
+		seq:  h.seq,
+		ts:   time.Now().UnixMilli(),
+		tick: t,
+	}
+	if len(t.errors) > 0 {
+		snap.errors, _ = json.Marshal(t.errors)
+	}
+	snap.frames[encodingJSON] = h.envelope(snap, encodingJSON, false)
+	snap.frames[encodingArray] = h.envelope(snap, encodingArray, false)
+	if t.cbor != nil {
+		snap.frames[encodingCBOR] = h.envelope(snap, encodingCBOR, false)
+	}
+
+	if len(h.replay) >= h.replaySize {
+		copy(h.replay, h.replay[1:])
+		h.replay = h.replay[:len(h.replay)-1]
+	}
+	h.replay = append(h.replay, snap)
+	return snap
+}
+
+// backfill returns the frames a registering client should receive before
+// live broadcasts. Clients resuming within the replay window get every
+// snapshot they missed; everyone else gets the latest snapshot flagged as
+// a resync so stale history can be discarded.
+// Frames are in the client's encoding enc.
+// Must be called with h.mu held.
+func (h *Hub) backfill(resume *resumePoint, enc wireEncoding) []*frame {
+	if len(h.replay) == 0 {
+		return nil
+	}
+	latest := h.replay[len(h.replay)-1]
+	oldest := h.replay[0]
+
+	if resume == nil {
+		return []*frame{latest.frame(enc)}
+	}
+	if resume.epoch != h.epoch || resume.seq > latest.seq || resume.seq+1 < oldest.seq {
+		if latest.frames[enc] == nil {
+			enc = encodingJSON
+		}
+		return []*frame{h.envelope(latest, enc, true)}
+	}
+
+	var frames []*frame
+	for _, snap := range h.replay {
+		if snap.seq > resume.seq {
+			frames = append(frames, snap.frame(enc))
+		}
+	}
+	return frames
+}
+
+// envelope wraps a snapshot payload with its sequence metadata in the
+// given encoding. Bare array clients get the payload alone, so they cannot
+// tell a resync from any other snapshot.
+func (h *Hub) envelope(snap *snapshot, enc wireEncoding, resync bool) *frame {
+	if enc == encodingArray {
+		f := newFrame(websocket.TextMessage, snap.tick.json)
+		f.seq = snap.seq
+		return f
+	}
+	if enc == encodingCBOR {
+		buf := make([]byte, 0, len(snap.tick.cbor)+len(snap.errors)+64)
+		f := newFrame(websocket.BinaryMessage, appendCBOREnvelope(buf, h.epoch, snap, resync, snap.tick.cbor))
+		f.seq = snap.seq
+		return f
+	}
+
+	buf := make([]byte, 0, len(snap.tick.json)+len(snap.errors)+96)
+	buf = append(buf, `{"seq":`...)
+	buf = strconv.AppendUint(buf, snap.seq, 10)
+	buf = append(buf, `,"ts":`...)
+	buf = strconv.AppendInt(buf, snap.ts, 10)
+	buf = append(buf, `,"epoch":`...)
+	buf = strconv.AppendQuote(buf, h.epoch)
+	if resync {
+		buf = append(buf, `,"resync":true`...)
+	}
+	if snap.errors != nil {
+		buf = append(buf, `,"errors":`...)
+		buf = append(buf, snap.errors...)
+	}
+	buf = append(buf, `,"metrics":`...)
+	buf = append(buf, snap.tick.json...)
+	buf = append(buf, '}')
+	f := newFrame(websocket.TextMessage, buf)
+	f.seq = snap.seq
+	return f
+}
+
+// latest returns the JSON envelope of the most recent snapshot, or nil if
+// nothing has been published yet.
+func (h *Hub) latest() *frame {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.replay) == 0 {
+		return nil
+	}
+	return h.replay[len(h.replay)-1].frame(encodingJSON)
 }
 
 // Broadcast sends a message to all connected clients.
+// It never blocks on slow clients; they are handled according to the
+// configured SlowClientPolicy.
 func (h *Hub) Broadcast(message []byte) {
-	h.broadcast <- message
+	h.publish(&tick{json: message})
 }
 
-// ServeWebSocket handles WebSocket connections for a client.
-func (h *Hub) ServeWebSocket(conn *websocket.Conn) {
-	client := &Client{
-		hub:  h,
-		conn: conn,
-		send: make(chan []byte, 256),
+// announce sends a JSON control message, such as a layout change notice,
+// to every client that understands envelopes. Announcements carry no
+// sequence number, bypass the replay buffer and the slow-client policy, and
+// are sent as text frames whatever the client's encoding. Bare array
+// clients never get them, since they expect every message to be metrics.
+func (h *Hub) announce(message []byte) {
+	f := newFrame(websocket.TextMessage, message)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for client := range h.clients {
+		if client.encoding != encodingArray {
+			client.push(f)
+		}
+	}
+}
+
+// publish broadcasts a gathered payload to every client in its negotiated encoding.
+func (h *Hub) publish(t *tick) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	snap := h.record(t)
+	now := time.Now()
+	for client := range h.clients {
+		if !client.due(now, h.tickInterval/2) {
+			// Coalesced: the client gets a later snapshot at its own cadence
+			continue
+		}
+		dropped, ok := client.enqueue(snap.frame(client.encoding), h.queueSize, h.policy)
+		h.metrics.framesDiscarded(dropped)
+		if !ok {
+			// Client is too slow for the disconnect policy
+			delete(h.clients, client)
+			client.close()
+			h.metrics.clientKicked()
+			client.log.Info("Disconnecting slow client", "queue", h.queueSize)
+		}
+	}
+}
+
+// ServeWebSocket handles WebSocket connections for a client holding lease.
+// The lease is released when the connection ends.
+func (h *Hub) ServeWebSocket(conn *websocket.Conn, lease *connLease) {
+	h.serveClient(conn, lease, nil, 0)
+}
+
+// ResumeWebSocket handles a reconnecting client that has already seen
+// every snapshot up to and including seq from the hub identified by epoch.
+func (h *Hub) ResumeWebSocket(conn *websocket.Conn, lease *connLease, epoch string, seq uint64) {
+	h.serveClient(conn, lease, &resumePoint{epoch: epoch, seq: seq}, 0)
+}
+
+// serveClient registers a client that wants snapshots every interval, zero
+// for the default, and starts its reader and writer goroutines.
+func (h *Hub) serveClient(conn *websocket.Conn, lease *connLease, resume *resumePoint, interval time.Duration) {
+	client := newClient(h, &wsTransport{conn: conn, hub: h}, resume)
+	client.log = client.log.With("transport", "websocket", "remote", conn.RemoteAddr().String())
+	client.lease = lease
+	client.encoding = encodingFor(conn.Subprotocol())
+	client.requested = interval
+	if h.compress {
+		// Has no effect unless the client negotiated permessage-deflate
+		conn.SetCompressionLevel(h.compressLevel)
 	}
 
 	// Register client
-	h.register <- client
+	h.register(client)
 
-	// Start writer goroutine
+	// Start reader and writer goroutines
+	go client.readPump(conn)
 	go client.writePump()
 }
 
-// writePump pumps messages from the hub to the WebSocket connection.
+// clientMessage is a control message sent by a WebSocket client.
+type clientMessage struct {
+	Interval int64 `json:"interval"` // Requested update interval in milliseconds
+}
+
+// readPump handles control messages from a WebSocket client until the
+// connection fails, then drops the client. Reading also lets the hub notice
+// a closed connection without waiting for the next write.
+func (c *Client) readPump(conn *websocket.Conn) {
+	defer c.hub.unregister(c)
+
+	conn.SetReadLimit(maxClientMessageSize)
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var msg clientMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			c.log.Warn("Ignoring malformed client message", "error", err)
+			continue
+		}
+		if msg.Interval > 0 {
+			c.hub.setInterval(c, time.Duration(msg.Interval)*time.Millisecond)
+		}
+	}
+}
+
+// due reports whether the client should receive a snapshot published at
+// now and, if so, schedules the next one. slack lets a snapshot that is
+// slightly early through rather than making the client wait a whole tick.
+// Must be called with the hub's mutex held.
+func (c *Client) due(now time.Time, slack time.Duration) bool {
+	if c.interval <= 0 {
+		return true
+	}
+	if now.Add(slack).Before(c.nextDue) {
+		return false
+	}
+	// Keep the average cadence even when ticks do not divide the interval
+	c.nextDue = c.nextDue.Add(c.interval)
+	if c.nextDue.Before(now) {
+		c.nextDue = now.Add(c.interval)
+	}
+	return true
+}
+
+// newClient creates a client with an empty send queue.
+func newClient(hub *Hub, t transport, resume *resumePoint) *Client {
+	id := hub.clientID.Add(1)
+	return &Client{
+		hub:       hub,
+		transport: t,
+		log:       hub.logger.With("client", id),
+		notify:    make(chan struct{}, 1),
+		resume:    resume,
+	}
+}
+
+// push appends a frame to the queue regardless of its length.
+func (c *Client) push(f *frame) {
+	c.mu.Lock()
+	c.queue = append(c.queue, f)
+	c.mu.Unlock()
+	c.wake()
+}
+
+// enqueue appends a frame to the queue, applying policy when the queue
+// already holds limit frames. It returns the number of queued frames that
+// were discarded and reports false if the client should be disconnected.
+func (c *Client) enqueue(f *frame, limit int, policy SlowClientPolicy) (int, bool) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return 0, false
+	}
+	dropped := 0
+	if len(c.queue) >= limit {
+		switch policy {
+		case SlowClientDropOldest:
+			copy(c.queue, c.queue[1:])
+			c.queue = c.queue[:len(c.queue)-1]
+			dropped = 1
+		case SlowClientCoalesce:
+			dropped = len(c.queue)
+			clear(c.queue)
+			c.queue = c.queue[:0]
+		default:
+			c.mu.Unlock()
+			return 0, false
+		}
+	}
+	c.queue = append(c.queue, f)
+	c.mu.Unlock()
+	c.wake()
+	return dropped, true
+}
+
+// wake signals the writer without blocking.
+func (c *Client) wake() {
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+}
+
+// close marks the client as dropped and wakes its writer so it can exit.
+func (c *Client) close() {
+	c.mu.Lock()
+	c.closed = true
+	c.queue = nil
+	c.mu.Unlock()
+	c.wake()
+}
+
+// next waits for queued frames and takes them all. It reports false once
+// the client has been closed.
+func (c *Client) next(buf []*frame) ([]*frame, bool) {
+	for {
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			return nil, false
+		}
+		if len(c.queue) > 0 {
+			buf = append(buf[:0], c.queue...)
+			clear(c.queue)
+			c.queue = c.queue[:0]
+			c.mu.Unlock()
+			return buf, true
+		}
+		c.mu.Unlock()
+		<-c.notify
+	}
+}
+
+// writePump pumps messages from the hub to the client's connection until
+// the client is dropped or a write fails.
 func (c *Client) writePump() {
 	defer func() {
-		c.conn.Close()
-		c.hub.unregister <- c
+		c.transport.close()
+		c.hub.unregister(c)
+		c.hub.release(c.lease)
 	}()
 
-	for message := range c.send {
-		err := c.conn.WriteMessage(websocket.TextMessage, message)
-		if err != nil {
-			log.Printf("Error writing to WebSocket: %v", err)
+	var batch []*frame
+	for {
+		var ok bool
+		batch, ok = c.next(batch)
+		if !ok {
 			return
 		}
+		for _, f := range batch {
+			if err := c.transport.write(f); err != nil {
+				c.hub.metrics.writeError()
+				c.log.Warn("Error writing to client", "error", err)
+				return
+			}
+		}
 	}
 }
+
+// transport delivers frames to a single client over some connection type.
+type transport interface {
+	// write sends one frame
+	write(f *frame) error
+
+	// close releases the connection once the client is done
+	close() error
+}
+
+// wsTransport sends frames as WebSocket messages.
+type wsTransport struct {
+	conn *websocket.Conn
+	hub  *Hub
+}
+
+// write sends a single frame, reusing its prepared encoding when available.
+// Prepared messages cache their compressed form, so a frame is deflated once
+// for all clients sharing a compression level.
+func (t *wsTransport) write(f *frame) error {
+	if t.hub.compress {
+		t.conn.EnableWriteCompression(len(f.data) >= t.hub.compressThreshold)
+	}
+	if f.prepared != nil {
+		return t.conn.WritePreparedMessage(f.prepared)
+	}
+	return t.conn.WriteMessage(f.messageType, f.data)
+}
+
+// close closes the WebSocket connection.
+func (t *wsTransport) close() error {
+	return t.conn.Close()
+}
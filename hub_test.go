@@ -0,0 +1,585 @@
+package prommy
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// testEnvelope mirrors the JSON envelope broadcast to WebSocket clients.
+type testEnvelope struct {
+	Seq     uint64          `json:"seq"`
+	Ts      int64           `json:"ts"`
+	Epoch   string          `json:"epoch"`
+	Resync  bool            `json:"resync"`
+	Metrics json.RawMessage `json:"metrics"`
+}
+
+// newTestHubServer starts an HTTP server that upgrades every request and
+// hands the connection to hub, honoring the since/epoch query parameters.
+func newTestHubServer(t *testing.T, hub *Hub) *httptest.Server {
+	t.Helper()
+	upgrader := websocket.Upgrader{Subprotocols: []string{subprotocolJSON}}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade: %v", err)
+			return
+		}
+		query := r.URL.Query()
+		if since, err := strconv.ParseUint(query.Get("since"), 10, 64); err == nil {
+			hub.ResumeWebSocket(conn, nil, query.Get("epoch"), since)
+			return
+		}
+		hub.ServeWebSocket(conn, nil)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func dialTestHub(t *testing.T, srv *httptest.Server, query string) *websocket.Conn {
+	t.Helper()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws" + query
+	dialer := websocket.Dialer{Subprotocols: []string{subprotocolJSON}}
+	conn, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dial %s: %v", url, err)
+	}
+	return conn
+}
+
+// waitForClients blocks until the hub has exactly n registered clients.
+func waitForClients(t testing.TB, hub *Hub, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		hub.mu.Lock()
+		count := len(hub.clients)
+		hub.mu.Unlock()
+		if count == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d clients", n)
+}
+
+func readEnvelope(t *testing.T, conn *websocket.Conn) testEnvelope {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	var env testEnvelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		t.Fatalf("unmarshal %q: %v", data, err)
+	}
+	return env
+}
+
+func TestHubResumeReplaysMissedSnapshots(t *testing.T) {
+	hub := newHub(&Config{ReplayBufferSize: 10})
+	srv := newTestHubServer(t, hub)
+
+	conn := dialTestHub(t, srv, "")
+	waitForClients(t, hub, 1)
+	hub.Broadcast([]byte(`[1]`))
+	hub.Broadcast([]byte(`[2]`))
+	first := readEnvelope(t, conn)
+	second := readEnvelope(t, conn)
+	if first.Seq != 1 || second.Seq != 2 {
+		t.Fatalf("got seqs %d, %d, want 1, 2", first.Seq, second.Seq)
+	}
+	if string(second.Metrics) != "[2]" {
+		t.Errorf("metrics = %s, want [2]", second.Metrics)
+	}
+
+	// Simulate a network blip: drop the connection and keep broadcasting
+	conn.Close()
+	hub.Broadcast([]byte(`[3]`))
+	hub.Broadcast([]byte(`[4]`))
+	hub.Broadcast([]byte(`[5]`))
+
+	conn = dialTestHub(t, srv, "?since=2&epoch="+second.Epoch)
+	defer conn.Close()
+	for want := uint64(3); want <= 5; want++ {
+		env := readEnvelope(t, conn)
+		if env.Seq != want {
+			t.Fatalf("replayed seq = %d, want %d", env.Seq, want)
+		}
+		if env.Resync {
+			t.Errorf("seq %d unexpectedly flagged as resync", env.Seq)
+		}
+		if string(env.Metrics) != "["+strconv.FormatUint(want, 10)+"]" {
+			t.Errorf("seq %d metrics = %s", want, env.Metrics)
+		}
+	}
+
+	// Live broadcasts continue after the backfill
+	hub.Broadcast([]byte(`[6]`))
+	if env := readEnvelope(t, conn); env.Seq != 6 {
+		t.Errorf("live seq = %d, want 6", env.Seq)
+	}
+}
+
+func TestHubResumeResyncs(t *testing.T) {
+	hub := newHub(&Config{ReplayBufferSize: 3})
+	srv := newTestHubServer(t, hub)
+
+	conn := dialTestHub(t, srv, "")
+	waitForClients(t, hub, 1)
+	hub.Broadcast([]byte(`[1]`))
+	env := readEnvelope(t, conn)
+	conn.Close()
+
+	for i := 2; i <= 10; i++ {
+		hub.Broadcast([]byte("[" + strconv.Itoa(i) + "]"))
+	}
+
+	tests := []struct {
+		name  string
+		query string
+	}{
+		{name: "fell out of replay window", query: "?since=1&epoch=" + env.Epoch},
+		{name: "server restarted", query: "?since=1&epoch=other"},
+		{name: "ahead of server", query: "?since=99&epoch=" + env.Epoch},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := dialTestHub(t, srv, tt.query)
+			defer conn.Close()
+
+			got := readEnvelope(t, conn)
+			if !got.Resync {
+				t.Errorf("expected resync envelope, got %+v", got)
+			}
+			if got.Seq != 10 || string(got.Metrics) != "[10]" {
+				t.Errorf("resync seq = %d metrics = %s, want latest snapshot", got.Seq, got.Metrics)
+			}
+		})
+	}
+}
+
+func TestHubFreshClientGetsLatestSnapshot(t *testing.T) {
+	hub := newHub(&Config{})
+	srv := newTestHubServer(t, hub)
+
+	conn := dialTestHub(t, srv, "")
+	waitForClients(t, hub, 1)
+	hub.Broadcast([]byte(`[1]`))
+	readEnvelope(t, conn)
+	conn.Close()
+
+	conn = dialTestHub(t, srv, "")
+	defer conn.Close()
+	env := readEnvelope(t, conn)
+	if env.Seq != 1 || env.Resync {
+		t.Errorf("fresh client got %+v, want latest snapshot without resync", env)
+	}
+}
+
+func TestClientEnqueuePolicies(t *testing.T) {
+	frames := make([]*frame, 5)
+	for i := range frames {
+		frames[i] = &frame{data: []byte(strconv.Itoa(i))}
+	}
+
+	tests := []struct {
+		policy   SlowClientPolicy
+		wantOK   bool
+		wantData []string
+	}{
+		{policy: SlowClientDisconnect, wantOK: false},
+		{policy: SlowClientDropOldest, wantOK: true, wantData: []string{"2", "3", "4"}},
+		{policy: SlowClientCoalesce, wantOK: true, wantData: []string{"3", "4"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			c := newClient(newHub(&Config{}), nil, nil)
+			ok := true
+			for _, f := range frames {
+				if _, ok = c.enqueue(f, 3, tt.policy); !ok {
+					break
+				}
+			}
+			if ok != tt.wantOK {
+				t.Fatalf("enqueue ok = %v, want %v", ok, tt.wantOK)
+			}
+			if !ok {
+				return
+			}
+			var got []string
+			for _, f := range c.queue {
+				got = append(got, string(f.data))
+			}
+			if strings.Join(got, ",") != strings.Join(tt.wantData, ",") {
+				t.Errorf("queue = %v, want %v", got, tt.wantData)
+			}
+		})
+	}
+}
+
+func TestHubBroadcastDoesNotBlockOnSlowClients(t *testing.T) {
+	hub := newHub(&Config{ClientBufferSize: 2, SlowClientPolicy: SlowClientCoalesce})
+
+	// Register clients without writers so their queues are never drained
+	stalled := make([]*Client, 10)
+	for i := range stalled {
+		stalled[i] = newClient(hub, nil, nil)
+		hub.register(stalled[i])
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 1000; i++ {
+			hub.Broadcast([]byte(`[]`))
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Broadcast blocked on stalled clients")
+	}
+
+	hub.mu.Lock()
+	latest := hub.replay[len(hub.replay)-1].frame(encodingJSON)
+	hub.mu.Unlock()
+	for _, c := range stalled {
+		if n := len(c.queue); n == 0 || n > 2 || c.queue[n-1] != latest {
+			t.Errorf("coalesced queue length = %d, want at most 2 ending with the latest frame", n)
+		}
+	}
+}
+
+func TestHubDisconnectsSlowClients(t *testing.T) {
+	hub := newHub(&Config{ClientBufferSize: 2, SlowClientPolicy: SlowClientDisconnect})
+	c := newClient(hub, nil, nil)
+	hub.register(c)
+
+	for i := 0; i < 3; i++ {
+		hub.Broadcast([]byte(`[]`))
+	}
+
+	hub.mu.Lock()
+	registered := hub.clients[c]
+	hub.mu.Unlock()
+	if registered || !c.closed {
+		t.Errorf("slow client still registered=%v closed=%v, want dropped", registered, c.closed)
+	}
+}
+
+// benchmarkHubBroadcast publishes to n simulated clients that drain their
+// queues concurrently, as writers on fast connections would.
+func benchmarkHubBroadcast(b *testing.B, n int, policy SlowClientPolicy) {
+	hub := newHub(&Config{ClientBufferSize: 64, SlowClientPolicy: policy})
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		c := newClient(hub, nil, nil)
+		// Bypass register so the benchmark is not bound by the connection limit
+		hub.clients[c] = true
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var batch []*frame
+			for {
+				var ok bool
+				if batch, ok = c.next(batch); !ok {
+					return
+				}
+			}
+		}()
+	}
+
+	payload := []byte(`[{"name":"go_goroutines","type":"gauge","value":42}]`)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		hub.Broadcast(payload)
+	}
+	b.StopTimer()
+
+	hub.mu.Lock()
+	for c := range hub.clients {
+		c.close()
+	}
+	hub.mu.Unlock()
+	wg.Wait()
+}
+
+func BenchmarkHubBroadcast(b *testing.B) {
+	for _, n := range []int{100, 500} {
+		for _, policy := range []SlowClientPolicy{SlowClientDisconnect, SlowClientDropOldest, SlowClientCoalesce} {
+			b.Run(string(policy)+"/clients="+strconv.Itoa(n), func(b *testing.B) {
+				benchmarkHubBroadcast(b, n, policy)
+			})
+		}
+	}
+}
+
+func TestHubAdmitQuotas(t *testing.T) {
+	hub := newHub(&Config{MaxConnections: 4, MaxConnectionsPerIP: 2, MaxConnectionsPerUser: 1})
+
+	steps := []struct {
+		ip, user  string
+		wantLimit string
+	}{
+		{ip: "10.0.0.1", user: "alice"},
+		{ip: "10.0.0.1", user: "alice", wantLimit: limitUser},
+		{ip: "10.0.0.1", user: ""},
+		{ip: "10.0.0.1", user: "bob", wantLimit: limitIP},
+		{ip: "10.0.0.2", user: "bob"},
+		{ip: "10.0.0.3", user: ""},
+		{ip: "10.0.0.4", user: "", wantLimit: limitGlobal},
+	}
+
+	var leases []*connLease
+	for i, step := range steps {
+		lease, limit := hub.admit(step.ip, step.user)
+		if limit != step.wantLimit {
+			t.Fatalf("step %d: limit = %q, want %q", i, limit, step.wantLimit)
+		}
+		if (lease == nil) != (step.wantLimit != "") {
+			t.Fatalf("step %d: lease = %v with limit %q", i, lease, limit)
+		}
+		if lease != nil {
+			leases = append(leases, lease)
+		}
+	}
+
+	// Releasing alice's connection frees both her user slot and a global slot
+	hub.release(leases[0])
+	if lease, limit := hub.admit("10.0.0.5", "alice"); lease == nil {
+		t.Errorf("admit after release rejected by %q limit", limit)
+	}
+}
+
+// countingListener counts the bytes written to every connection it accepts.
+type countingListener struct {
+	net.Listener
+	written atomic.Int64
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &countingConn{Conn: conn, written: &l.written}, nil
+}
+
+type countingConn struct {
+	net.Conn
+	written *atomic.Int64
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.written.Add(int64(n))
+	return n, err
+}
+
+// demoFamilies gathers the metrics of examples/demo after simulated traffic
+// has touched every label combination.
+func demoFamilies(tb testing.TB) []*dto.MetricFamily {
+	tb.Helper()
+	reg := prometheus.NewRegistry()
+	requests := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "Total number of HTTP requests by status code and method.",
+	}, []string{"code", "method"})
+	duration := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "HTTP request latencies in seconds.",
+		Buckets: prometheus.LinearBuckets(0.1, 0.2, 10),
+	}, []string{"handler", "method"})
+	size := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "http_response_size_bytes",
+		Help:    "HTTP response sizes in bytes.",
+		Buckets: prometheus.ExponentialBuckets(100, 2, 8),
+	})
+	memory := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "memory_usage_bytes",
+		Help: "Current memory usage in bytes.",
+	})
+	reg.MustRegister(requests, duration, size, memory)
+
+	rnd := rand.New(rand.NewSource(1))
+	for _, method := range []string{"GET", "POST", "PUT", "DELETE"} {
+		for _, code := range []string{"200", "404", "500", "302", "403"} {
+			requests.WithLabelValues(code, method).Add(float64(rnd.Intn(1000)))
+		}
+		for _, handler := range []string{"api", "static", "metrics", "auth"} {
+			for i := 0; i < 50; i++ {
+				duration.WithLabelValues(handler, method).Observe(0.1 + rnd.Float64()*2)
+			}
+		}
+	}
+	for i := 0; i < 100; i++ {
+		size.Observe(100 + rnd.Float64()*8000)
+	}
+	memory.Set(123456789)
+
+	mfs, err := reg.Gather()
+	if err != nil {
+		tb.Fatalf("gather: %v", err)
+	}
+	return mfs
+}
+
+// newCountingHubServer serves hub over a listener that counts bytes sent to
+// clients, negotiating compression when the hub has it enabled.
+func newCountingHubServer(tb testing.TB, hub *Hub) (*httptest.Server, *countingListener) {
+	tb.Helper()
+	upgrader := websocket.Upgrader{EnableCompression: hub.compress}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			tb.Errorf("upgrade: %v", err)
+			return
+		}
+		hub.ServeWebSocket(conn, nil)
+	}))
+	counter := &countingListener{Listener: srv.Listener}
+	srv.Listener = counter
+	srv.Start()
+	tb.Cleanup(srv.Close)
+	return srv, counter
+}
+
+// wireBytes returns how many bytes hub sends per frame to one client that
+// offers permessage-deflate, when every tick carries payload.
+func wireBytes(tb testing.TB, hub *Hub, payload []byte, frames int) int64 {
+	tb.Helper()
+	srv, counter := newCountingHubServer(tb, hub)
+	dialer := websocket.Dialer{EnableCompression: true}
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", nil)
+	if err != nil {
+		tb.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	waitForClients(tb, hub, 1)
+
+	// Leave out the handshake
+	counter.written.Store(0)
+	for i := 0; i < frames; i++ {
+		hub.Broadcast(payload)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, _, err := conn.ReadMessage(); err != nil {
+			tb.Fatalf("read: %v", err)
+		}
+	}
+	return counter.written.Load() / int64(frames)
+}
+
+func TestHubCompression(t *testing.T) {
+	payload, _ := newMetricEncoder().encode(demoFamilies(t))
+	small := []byte(`[{"name":"go_goroutines","type":"gauge","value":42}]`)
+
+	plain := wireBytes(t, newHub(&Config{}), payload, 3)
+	compressed := wireBytes(t, newHub(&Config{Compression: true}), payload, 3)
+	if compressed*2 > plain {
+		t.Errorf("compressed frame is %d bytes, want less than half of %d", compressed, plain)
+	}
+
+	// Frames under the threshold go out exactly as they would without compression
+	plainSmall := wireBytes(t, newHub(&Config{}), small, 3)
+	compressedSmall := wireBytes(t, newHub(&Config{Compression: true, CompressionThreshold: 4096}), small, 3)
+	if compressedSmall != plainSmall {
+		t.Errorf("frame under threshold is %d bytes, want uncompressed %d", compressedSmall, plainSmall)
+	}
+}
+
+// BenchmarkCompression reports the bytes sent per tick of the demo registry
+// for several deflate levels.
+func BenchmarkCompression(b *testing.B) {
+	payload, _ := newMetricEncoder().encode(demoFamilies(b))
+
+	configs := []struct {
+		name string
+		cfg  Config
+	}{
+		{"off", Config{}},
+		{"level=1", Config{Compression: true, CompressionLevel: 1}},
+		{"level=6", Config{Compression: true, CompressionLevel: 6}},
+		{"level=9", Config{Compression: true, CompressionLevel: 9}},
+	}
+	for _, c := range configs {
+		b.Run(c.name, func(b *testing.B) {
+			b.ReportAllocs()
+			perFrame := wireBytes(b, newHub(&c.cfg), payload, b.N)
+			b.ReportMetric(float64(perFrame), "wire-B/op")
+			b.ReportMetric(float64(len(payload)), "payload-B/op")
+		})
+	}
+}
+
+func TestClientDueSchedule(t *testing.T) {
+	tests := []struct {
+		name     string
+		interval time.Duration
+		tick     time.Duration
+		want     int
+	}{
+		{"every tick", 250 * time.Millisecond, 250 * time.Millisecond, 13},
+		{"every fourth tick", time.Second, 250 * time.Millisecond, 4},
+		{"interval not a multiple of the tick", time.Second, 400 * time.Millisecond, 4},
+		{"default", 0, 250 * time.Millisecond, 13},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Client{interval: tt.interval}
+			start := time.Unix(0, 0)
+			delivered := 0
+			// Three seconds of ticks, each up to a few milliseconds late
+			for at := time.Duration(0); at <= 3*time.Second; at += tt.tick {
+				jitter := time.Duration(delivered%3) * time.Millisecond
+				if c.due(start.Add(at+jitter), tt.tick/2) {
+					delivered++
+				}
+			}
+			if delivered != tt.want {
+				t.Errorf("delivered %d snapshots, want %d", delivered, tt.want)
+			}
+		})
+	}
+}
+
+func TestHubClampInterval(t *testing.T) {
+	hub := newHub(&Config{TickerInterval: time.Second, MinInterval: 250 * time.Millisecond, MaxInterval: 10 * time.Second})
+	tests := []struct {
+		requested, want time.Duration
+	}{
+		{0, time.Second},
+		{10 * time.Millisecond, 250 * time.Millisecond},
+		{5 * time.Second, 5 * time.Second},
+		{time.Hour, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := hub.clampInterval(tt.requested); got != tt.want {
+			t.Errorf("clampInterval(%v) = %v, want %v", tt.requested, got, tt.want)
+		}
+	}
+
+	// A fast default interval stays allowed even below the default minimum
+	if hub := newHub(&Config{TickerInterval: 100 * time.Millisecond}); hub.clampInterval(0) != 100*time.Millisecond {
+		t.Errorf("default interval clamped to %v", hub.clampInterval(0))
+	}
+}
@@ -5,7 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/fs"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"strconv"
@@ -19,12 +19,47 @@ type Option func(*Config)
 
 // Config holds the configuration for the prommy server.
 type Config struct {
-	Registry       *prometheus.Registry
-	TickerInterval time.Duration
-	StaticFS       fs.FS
-	BasicAuth      *BasicAuth
-	Dashboard      [][]interface{} // Can be string or map with name and short fields
-	PrefixURI      string          // URI prefix that will be trimmed from requests
+	Registry              *prometheus.Registry
+	TickerInterval        time.Duration
+	StaticFS              fs.FS
+	BasicAuth             *BasicAuth
+	Dashboard             [][]interface{}                 // Can be string or map with name and short fields
+	PrefixURI             string                          // URI prefix that will be trimmed from requests
+	ReplayBufferSize      int                             // Snapshots kept for reconnecting clients, 0 uses the default
+	ClientBufferSize      int                             // Frames queued per client before SlowClientPolicy applies, 0 uses the default
+	SlowClientPolicy      SlowClientPolicy                // What to do with clients whose queue is full, defaults to disconnect
+	MaxConnections        int                             // Maximum concurrent WebSocket, SSE and polling clients, 0 uses the default of 64
+	MaxConnectionsPerIP   int                             // Maximum concurrent clients per remote IP, 0 means unlimited
+	MaxConnectionsPerUser int                             // Maximum concurrent clients per basic auth user name, 0 means unlimited
+	SelfMetrics           bool                            // Expose prommy's own metrics on /metrics and the dashboard
+	GatherTimeout         time.Duration                   // Longest a gather may take before the last good snapshot is served, 0 uses the default of 10s
+	SnapshotMaxAge        time.Duration                   // Reuse a gather younger than this for ticks and scrapes, 0 disables the cache
+	BinaryEncoding        bool                            // Offer the CBOR metrics feed to WebSocket clients that negotiate it
+	Compression           bool                            // Negotiate permessage-deflate with WebSocket clients that support it
+	CompressionLevel      int                             // Deflate level from -2 (Huffman only) to 9, 0 uses the default of 1 (best speed)
+	CompressionThreshold  int                             // Frames smaller than this many bytes are sent uncompressed, 0 uses the default of 1024
+	MinInterval           time.Duration                   // Shortest update interval a client may request, 0 uses the default of 250ms
+	MaxInterval           time.Duration                   // Longest update interval a client may request, 0 uses the default of one minute
+	Logger                *slog.Logger                    // Destination for diagnostics, nil uses slog.Default()
+	Strict                bool                            // Make New fail on option and environment values it cannot parse
+	ConfigFile            string                          // YAML or JSON file overriding these settings, watched for changes
+	Gatherers             []prometheus.Gatherer           // Further metric sources merged with Registry
+	TimedCollectors       map[string]prometheus.Collector // Collectors registered on Registry with their Collect calls timed, by name
+	Relabel               []RelabelConfig                 // Rules applied in order to every gathered series
+	RemoteWrite           bool                            // Accept Prometheus remote_write requests on /api/v1/write
+	RemoteWriteRetention  time.Duration                   // How long a written series is shown after its last sample, 0 uses the default of five minutes
+	RemoteWriteTo         *RemoteWriteConfig              // Forward the samples gathered every TickerInterval to a remote_write receiver, nil disables
+	Push                  bool                            // Accept metrics pushed to /metrics/job/<job> like a Pushgateway
+	PushTTL               time.Duration                   // How long a pushed group is kept after its last push, 0 keeps it until deleted
+
+	// Problems found while applying options, reported once the logger is known
+	optionErrors []*FieldError
+
+	// Configuration before ConfigFile was applied, the file contents, and
+	// why it could not be read, which is fatal even outside strict mode
+	fileBase   *Config
+	fileData   []byte
+	fileErrors []*FieldError
 }
 
 // BasicAuth contains username and password for basic authentication.
@@ -40,6 +75,58 @@ func WithRegistry(reg *prometheus.Registry) Option {
 	}
 }
 
+// WithGatherer adds a metric source that is gathered together with the
+// registry for /metrics and the dashboard, such as a Scraper for remote
+// targets. It may be given several times.
+func WithGatherer(g prometheus.Gatherer) Option {
+	return func(c *Config) {
+		c.Gatherers = append(c.Gatherers, g)
+	}
+}
+
+// WithRelabel adds rules that rewrite or drop gathered series before they
+// reach /metrics and the dashboard, such as hiding the go_* families or
+// renaming labels. The rules apply to every source in order; use the
+// Relabel field of a Target for rules that only apply to one scraped target.
+func WithRelabel(rules ...RelabelConfig) Option {
+	return func(c *Config) {
+		c.Relabel = append(c.Relabel, rules...)
+	}
+}
+
+// WithRemoteWrite accepts Prometheus remote_write requests on
+// /api/v1/write, for jobs that can only push their metrics. The latest
+// sample of every written series is shown on /metrics and the dashboard
+// until it goes stale or receives no samples for retention; 0 keeps the
+// default of five minutes.
+func WithRemoteWrite(retention time.Duration) Option {
+	return func(c *Config) {
+		c.RemoteWrite = true
+		c.RemoteWriteRetention = retention
+	}
+}
+
+// WithRemoteWriteTo forwards the samples gathered every TickerInterval to a
+// Prometheus remote_write receiver, keeping a history of them where no
+// Prometheus server runs. Samples are sent in batches from a bounded
+// in-memory queue, and requests that fail are retried with backoff.
+func WithRemoteWriteTo(config RemoteWriteConfig) Option {
+	return func(c *Config) {
+		c.RemoteWriteTo = &config
+	}
+}
+
+// WithPush accepts metrics pushed by short-lived jobs, such as cron jobs, on
+// the Pushgateway API under /metrics/job/<job>. Pushed groups are kept in
+// memory and shown on /metrics and the dashboard next to the registry until
+// they are deleted or, if ttl is positive, not pushed again for ttl.
+func WithPush(ttl time.Duration) Option {
+	return func(c *Config) {
+		c.Push = true
+		c.PushTTL = ttl
+	}
+}
+
 // WithTickerInterval sets the interval for sending metrics updates.
 func WithTickerInterval(d time.Duration) Option {
 	return func(c *Config) {
@@ -91,12 +178,13 @@ func WithDashboardStrings(layout [][]string) Option {
 // WithDashboardJSON sets a custom dashboard layout using a JSON string.
 // This provides a more convenient way to define layouts inline.
 // Example: `[["metric1", "metric2"], [{"name": "metric3", "short": "M3"}]]`
+// A layout that does not parse is logged and ignored, or fails New in strict mode.
 func WithDashboardJSON(jsonLayout string) Option {
 	return func(c *Config) {
 		var dashboard [][]interface{}
 		if err := json.Unmarshal([]byte(jsonLayout), &dashboard); err != nil {
-			// Log error but don't fail - will use default dashboard
-			log.Printf("Error parsing dashboard JSON: %v", err)
+			// Outside strict mode the default dashboard is used
+			c.optionError("Dashboard", "invalid JSON layout", err)
 			return
 		}
 		c.Dashboard = dashboard
@@ -111,59 +199,214 @@ func WithPrefixURI(prefix string) Option {
 	}
 }
 
-// Handler returns an http.HandlerFunc that serves the metrics dashboard.
-// This function can be used to register the handler with a custom path prefix.
-//
-// Usage:
-//
-//	http.HandleFunc("/custom/path/", prommy.Handler(opts...))
-func Handler(opts ...Option) http.HandlerFunc {
-	// Create default config
-	cfg := &Config{
-		Registry:       prometheus.DefaultRegisterer.(*prometheus.Registry),
-		TickerInterval: time.Second,
+// WithReplayBuffer sets how many recent snapshots are kept so that clients
+// reconnecting after a short network interruption can catch up on missed ticks.
+// Clients that fall further behind receive a full resync instead.
+func WithReplayBuffer(size int) Option {
+	return func(c *Config) {
+		c.ReplayBufferSize = size
 	}
+}
 
-	// Apply options
-	for _, opt := range opts {
-		opt(cfg)
+// WithSlowClientPolicy sets what happens when a client cannot keep up with
+// updates and its send queue of bufferSize frames is full. A bufferSize of 0
+// keeps the default of 256.
+func WithSlowClientPolicy(policy SlowClientPolicy, bufferSize int) Option {
+	return func(c *Config) {
+		c.SlowClientPolicy = policy
+		c.ClientBufferSize = bufferSize
 	}
+}
 
-	// Check environment variables for configuration
-	applyEnvConfig(cfg)
+// WithMaxConnections sets the maximum number of concurrent clients, counting
+// WebSocket and SSE connections and clients polling /api/snapshot. Further
+// clients are refused with HTTP 503 until a slot frees up.
+func WithMaxConnections(n int) Option {
+	return func(c *Config) {
+		c.MaxConnections = n
+	}
+}
 
-	// Initialize the server
-	server, err := newServer(cfg)
-	if err != nil {
-		log.Printf("Failed to initialize Prommy server: %v", err)
-		return func(w http.ResponseWriter, r *http.Request) {
-			http.Error(w, "Prommy server initialization failed", http.StatusInternalServerError)
+// WithMaxConnectionsPerIP limits concurrent clients from a single remote IP,
+// so one user with many tabs cannot exhaust the global limit.
+func WithMaxConnectionsPerIP(n int) Option {
+	return func(c *Config) {
+		c.MaxConnectionsPerIP = n
+	}
+}
+
+// WithMaxConnectionsPerUser limits concurrent clients per user name in their
+// basic auth credentials. It has no effect on unauthenticated connections.
+// WithBasicAuth has a single user, so with it this caps all clients
+// together; the limit is meant for servers behind a proxy that
+// authenticates several users and forwards their credentials.
+func WithMaxConnectionsPerUser(n int) Option {
+	return func(c *Config) {
+		c.MaxConnectionsPerUser = n
+	}
+}
+
+// WithSelfMetrics enables prommy's own instrumentation. The metrics are kept on
+// a separate registry and merged into /metrics and the dashboard feed.
+func WithSelfMetrics() Option {
+	return func(c *Config) {
+		c.SelfMetrics = true
+	}
+}
+
+// WithGatherTimeout limits how long the dashboard and /metrics wait for the
+// registry to be gathered, 10s by default. Gathers run in the background and
+// never overlap; when one takes longer than d, the last snapshot gathered
+// without errors is served together with an error naming any collector
+// registered with WithTimedCollector that is still running.
+func WithGatherTimeout(d time.Duration) Option {
+	return func(c *Config) {
+		c.GatherTimeout = d
+	}
+}
+
+// WithTimedCollector registers c on the registry and records how long its
+// Collect takes under name. Timings are exported as
+// prommy_collector_duration_seconds when self-metrics are enabled, and
+// collectors still running when a gather times out are named in the
+// dashboard's error banner. Timings belong to the server, so servers sharing
+// a process do not see each other's collectors.
+func WithTimedCollector(name string, c prometheus.Collector) Option {
+	return func(cfg *Config) {
+		if cfg.TimedCollectors == nil {
+			cfg.TimedCollectors = make(map[string]prometheus.Collector)
 		}
+		cfg.TimedCollectors[name] = c
 	}
+}
 
-	// Return a handler function that strips the path prefix and serves the request
-	return server.ServeHTTP
+// WithSnapshotCache lets WebSocket ticks and /metrics scrapes share one
+// gather: any request within maxAge of the last gather is answered from it
+// instead of gathering the registry again. maxAge is capped at half the
+// current gather interval so that every tick still sees fresh data.
+func WithSnapshotCache(maxAge time.Duration) Option {
+	return func(c *Config) {
+		c.SnapshotMaxAge = maxAge
+	}
 }
 
-// Serve starts the prommy server on the specified address.
-// It registers default Prometheus collectors if no custom registry is provided.
-func Serve(addr string, opts ...Option) error {
-	// Create default config
-	cfg := &Config{
-		Registry:       prometheus.DefaultRegisterer.(*prometheus.Registry),
-		TickerInterval: time.Second,
+// WithBinaryEncoding offers a compact CBOR encoding of the WebSocket feed,
+// negotiated through the "prommy.cbor" subprotocol. Clients that do not ask
+// for it, including the dashboard opened with #encoding=json, keep receiving
+// JSON.
+func WithBinaryEncoding() Option {
+	return func(c *Config) {
+		c.BinaryEncoding = true
 	}
+}
+
+// WithCompression enables permessage-deflate for WebSocket clients that
+// support it, which typically shrinks JSON frames several times over at some
+// CPU cost. level is a compress/flate level, where 0 keeps the default of
+// flate.BestSpeed. Frames shorter than threshold bytes are sent uncompressed;
+// 0 keeps the default of 1024. Each frame is compressed once and shared by
+// every client.
+func WithCompression(level, threshold int) Option {
+	return func(c *Config) {
+		c.Compression = true
+		c.CompressionLevel = level
+		c.CompressionThreshold = threshold
+	}
+}
 
-	// Apply options
+// WithIntervalBounds limits the update intervals dashboard clients may
+// request. Each client receives snapshots at its own interval, and metrics
+// are gathered only as often as the fastest connected client needs them;
+// TickerInterval remains the interval of clients that request none.
+func WithIntervalBounds(min, max time.Duration) Option {
+	return func(c *Config) {
+		c.MinInterval = min
+		c.MaxInterval = max
+	}
+}
+
+// WithLogger sets the logger for prommy's diagnostics, such as failed
+// upgrades, gather errors and client write errors. Records carry structured
+// fields like route, remote, client and error.
+func WithLogger(logger *slog.Logger) Option {
+	return func(c *Config) {
+		c.Logger = logger
+	}
+}
+
+// WithNopLogger discards all of prommy's diagnostics, for libraries that
+// embed the dashboard and do not want it writing to the global logger.
+func WithNopLogger() Option {
+	return func(c *Config) {
+		c.Logger = slog.New(discardHandler{})
+	}
+}
+
+// WithConfigFile loads settings from a YAML file, or JSON if the name ends
+// in .json, overriding options and PROMMY_* environment variables. The file
+// is watched while the server runs: dashboard, interval and basic auth
+// changes apply immediately and connected dashboards pick up the new
+// layout, while other changes need a restart. PROMMY_CONFIG sets the path
+// when this option is not used.
+func WithConfigFile(path string) Option {
+	return func(c *Config) {
+		c.ConfigFile = path
+	}
+}
+
+// WithStrict makes New fail when an option or environment variable cannot
+// be parsed, such as a malformed WithDashboardJSON layout or PROMMY_INTERVAL,
+// instead of logging the problem and falling back to the default.
+func WithStrict() Option {
+	return func(c *Config) {
+		c.Strict = true
+	}
+}
+
+// New creates a prommy server from the given options and the PROMMY_*
+// environment variables. If the configuration is invalid it returns a
+// *ConfigError listing every problem found.
+func New(opts ...Option) (*Server, error) {
+	return newServer(newConfig(opts))
+}
+
+// newConfig applies opts and then the environment to the default configuration.
+func newConfig(opts []Option) *Config {
+	cfg := defaultConfig()
 	for _, opt := range opts {
 		opt(cfg)
 	}
 
 	// Check environment variables for configuration
 	applyEnvConfig(cfg)
+	return cfg
+}
 
-	// Initialize the server
+// Handler returns an http.HandlerFunc that serves the metrics dashboard.
+// This function can be used to register the handler with a custom path prefix.
+// Like regexp.MustCompile it panics with the *ConfigError if the
+// configuration is invalid, so a bad option fails at startup rather than on
+// every request; use New to handle configuration errors instead.
+//
+// Usage:
+//
+//	http.HandleFunc("/custom/path/", prommy.Handler(opts...))
+func Handler(opts ...Option) http.HandlerFunc {
+	cfg := newConfig(opts)
 	server, err := newServer(cfg)
+	if err != nil {
+		cfg.logger().Error("Failed to initialize Prommy server", "error", err)
+		panic(err)
+	}
+
+	// Return a handler function that strips the path prefix and serves the request
+	return server.ServeHTTP
+}
+
+// Serve starts the prommy server on the specified address.
+// It registers default Prometheus collectors if no custom registry is provided.
+func Serve(addr string, opts ...Option) error {
+	server, err := New(opts...)
 	if err != nil {
 		return fmt.Errorf("failed to initialize server: %w", err)
 	}
@@ -172,7 +415,8 @@ func Serve(addr string, opts ...Option) error {
 	return http.ListenAndServe(addr, server)
 }
 
-// applyEnvConfig applies configuration from environment variables.
+// applyEnvConfig applies configuration from environment variables. Values
+// that do not parse are recorded as option errors.
 func applyEnvConfig(cfg *Config) {
 	// Apply basic auth from environment variables
 	username := os.Getenv("PROMMY_BASIC_AUTH_USER")
@@ -186,11 +430,22 @@ func applyEnvConfig(cfg *Config) {
 
 	// Apply ticker interval from environment variable
 	if intervalStr := os.Getenv("PROMMY_INTERVAL"); intervalStr != "" {
-		if ms, err := strconv.Atoi(intervalStr); err == nil && ms > 0 {
+		ms, err := strconv.Atoi(intervalStr)
+		switch {
+		case err != nil:
+			cfg.optionError("PROMMY_INTERVAL", "not a number of milliseconds", err)
+		case ms <= 0:
+			cfg.optionError("PROMMY_INTERVAL", fmt.Sprintf("must be positive, got %d", ms), nil)
+		default:
 			cfg.TickerInterval = time.Duration(ms) * time.Millisecond
 		}
 	}
 
+	// Apply config file path from environment variable
+	if path := os.Getenv("PROMMY_CONFIG"); path != "" && cfg.ConfigFile == "" {
+		cfg.ConfigFile = path
+	}
+
 	// Apply URI prefix from environment variable
 	if prefix := os.Getenv("PROMMY_PREFIX_URI"); prefix != "" && cfg.PrefixURI == "" {
 		cfg.PrefixURI = prefix
@@ -200,7 +455,9 @@ func applyEnvConfig(cfg *Config) {
 	if cfg.Dashboard == nil {
 		if dashEnv := os.Getenv("PROMMY_DASHBOARD"); dashEnv != "" {
 			var dashboard [][]interface{}
-			if err := json.Unmarshal([]byte(dashEnv), &dashboard); err == nil {
+			if err := json.Unmarshal([]byte(dashEnv), &dashboard); err != nil {
+				cfg.optionError("PROMMY_DASHBOARD", "invalid JSON layout", err)
+			} else {
 				cfg.Dashboard = dashboard
 			}
 		}
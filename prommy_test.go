@@ -1,9 +1,14 @@
 package prommy
 
 import (
+	"errors"
 	"os"
+	"reflect"
+	"strconv"
 	"testing"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 func TestWithTickerInterval(t *testing.T) {
@@ -252,3 +257,148 @@ func TestEnvVarConfig(t *testing.T) {
 		t.Errorf("ENV PROMMY_BASIC_AUTH_* not applied correctly, got %v", cfg.BasicAuth)
 	}
 }
+
+func TestNewValidation(t *testing.T) {
+	t.Setenv("PROMMY_INTERVAL", "")
+	t.Setenv("PROMMY_DASHBOARD", "")
+
+	tests := []struct {
+		name   string
+		opts   []Option
+		fields []string
+	}{
+		{
+			name: "valid",
+			opts: []Option{
+				WithDashboard([][]interface{}{{"metric1", map[string]interface{}{"name": "metric2", "short": "M2"}}, {
+					map[string]interface{}{"name": "metric3", "compare": "track", "values": []interface{}{"baseline", "canary"}, "view": "split", "delta": "ratio"},
+				}}),
+				WithPrefixURI("/metrics/"),
+				WithIntervalBounds(time.Second, time.Minute),
+			},
+		},
+		{
+			name: "dashboard items",
+			opts: []Option{WithDashboard([][]interface{}{
+				{"metric1", ""},
+				{map[string]interface{}{"short": "M"}, 42, map[string]interface{}{"name": "m", "short": 1}},
+			})},
+			fields: []string{"Dashboard[0][1]", "Dashboard[1][0]", "Dashboard[1][1]", "Dashboard[1][2]"},
+		},
+		{
+			name: "comparison items",
+			opts: []Option{WithDashboard([][]interface{}{{
+				map[string]interface{}{"name": "m", "compare": "instance", "view": "stacked"},
+				map[string]interface{}{"name": "m", "compare": "instance", "values": "canary"},
+				map[string]interface{}{"name": "m", "values": []interface{}{"a", "b"}},
+				map[string]string{"name": "m", "compare": "instance", "delta": "percent"},
+			}})},
+			fields: []string{"Dashboard[0][0]", "Dashboard[0][1]", "Dashboard[0][2]", "Dashboard[0][3]"},
+		},
+		{
+			name: "intervals",
+			opts: []Option{
+				WithTickerInterval(-time.Second),
+				WithGatherTimeout(-time.Second),
+				WithIntervalBounds(time.Minute, time.Second),
+			},
+			fields: []string{"TickerInterval", "GatherTimeout", "MinInterval"},
+		},
+		{
+			name:   "prefix without slash",
+			opts:   []Option{WithPrefixURI("metrics")},
+			fields: []string{"PrefixURI"},
+		},
+		{
+			name:   "prefix with query",
+			opts:   []Option{WithPrefixURI("/metrics?x=1")},
+			fields: []string{"PrefixURI"},
+		},
+		{
+			name:   "limits and policy",
+			opts:   []Option{WithSlowClientPolicy("block", -1), WithMaxConnections(-1), WithCompression(12, 0)},
+			fields: []string{"ClientBufferSize", "MaxConnections", "CompressionLevel", "SlowClientPolicy"},
+		},
+		{
+			name: "relabel rules",
+			opts: []Option{WithRelabel(
+				RelabelConfig{SourceLabels: []string{"__name__"}, Regex: "go_.*", Action: RelabelDrop},
+				RelabelConfig{Regex: "(", TargetLabel: "x"},
+				RelabelConfig{Action: "hashmod"},
+			)},
+			fields: []string{"Relabel[1]", "Relabel[2]"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := append([]Option{WithRegistry(prometheus.NewRegistry()), WithNopLogger()}, tt.opts...)
+			_, err := New(opts...)
+			if len(tt.fields) == 0 {
+				if err != nil {
+					t.Fatalf("New() error = %v, want nil", err)
+				}
+				return
+			}
+
+			var cfgErr *ConfigError
+			if !errors.As(err, &cfgErr) {
+				t.Fatalf("New() error = %v, want *ConfigError", err)
+			}
+			var got []string
+			for _, fe := range cfgErr.Errors {
+				got = append(got, fe.Field)
+			}
+			if !reflect.DeepEqual(got, tt.fields) {
+				t.Errorf("invalid fields = %v, want %v (%v)", got, tt.fields, err)
+			}
+		})
+	}
+}
+
+func TestHandlerPanicsOnInvalidConfig(t *testing.T) {
+	defer func() {
+		err, _ := recover().(error)
+		var cfgErr *ConfigError
+		if !errors.As(err, &cfgErr) {
+			t.Fatalf("Handler panicked with %v, want *ConfigError", err)
+		}
+	}()
+	Handler(WithRegistry(prometheus.NewRegistry()), WithNopLogger(), WithPrefixURI("metrics"))
+	t.Fatal("Handler returned with an invalid prefix, want panic")
+}
+
+func TestStrictMode(t *testing.T) {
+	t.Setenv("PROMMY_INTERVAL", "soon")
+	t.Setenv("PROMMY_DASHBOARD", "")
+	opts := []Option{WithRegistry(prometheus.NewRegistry()), WithNopLogger(), WithDashboardJSON("[[")}
+
+	// Without strict mode the bad values are ignored
+	s, err := New(opts...)
+	if err != nil {
+		t.Fatalf("New() error = %v, want nil", err)
+	}
+	if s.config.Dashboard != nil || s.config.TickerInterval != time.Second {
+		t.Errorf("config = %v, %v; want defaults", s.config.Dashboard, s.config.TickerInterval)
+	}
+
+	_, err = New(append(opts, WithStrict())...)
+	var cfgErr *ConfigError
+	if !errors.As(err, &cfgErr) || len(cfgErr.Errors) != 2 {
+		t.Fatalf("New(WithStrict()) error = %v, want two field errors", err)
+	}
+	if f := cfgErr.Errors[0]; f.Field != "Dashboard" || f.Err == nil {
+		t.Errorf("first error = %+v, want Dashboard parse error", f)
+	}
+	var fieldErr *FieldError
+	if !errors.As(err, &fieldErr) || fieldErr.Field != "Dashboard" {
+		t.Errorf("errors.As(*FieldError) = %v", fieldErr)
+	}
+	if f := cfgErr.Errors[1]; f.Field != "PROMMY_INTERVAL" {
+		t.Errorf("second error = %+v, want PROMMY_INTERVAL", f)
+	}
+	var numErr *strconv.NumError
+	if !errors.As(err, &numErr) {
+		t.Errorf("error chain does not reach the strconv error: %v", err)
+	}
+}
@@ -0,0 +1,351 @@
+package prommy
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+	"google.golang.org/protobuf/proto"
+)
+
+// maxPushBytes limits the size of a push request body.
+const maxPushBytes = 16 << 20
+
+// pushTimeFamily is the name of the series recording when each group was
+// last pushed, as on the Pushgateway.
+const pushTimeFamily = "push_time_seconds"
+
+// pushStore holds the metric families pushed by short-lived jobs, grouped
+// by the labels of their push URL, and serves them as a prometheus.Gatherer
+// with the grouping labels added to every series.
+type pushStore struct {
+	ttl time.Duration // How long a group is kept after its last push, 0 keeps it until deleted
+	now func() time.Time
+
+	mu     sync.Mutex
+	groups map[string]*pushGroup // By seriesKey of the grouping labels
+}
+
+// pushGroup is the latest push of one grouping key.
+type pushGroup struct {
+	labels   []*dto.LabelPair // Grouping labels, sorted by name
+	families map[string]*dto.MetricFamily
+	pushed   time.Time
+}
+
+func newPushStore(ttl time.Duration) *pushStore {
+	return &pushStore{ttl: ttl, now: time.Now, groups: make(map[string]*pushGroup)}
+}
+
+// servePush handles the Pushgateway API under prefix: PUT replaces the
+// metrics of the group named by the URL, POST replaces only the families it
+// sends, and DELETE removes the group. Bodies may be in the text format or,
+// as the client_golang push package sends them, delimited protobuf.
+func (s *Server) servePush(prefix string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		grouping, err := parseGroupingKey(strings.TrimPrefix(r.URL.EscapedPath(), prefix))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodDelete:
+			s.pushes.remove(grouping)
+			w.WriteHeader(http.StatusAccepted)
+			return
+		case http.MethodPut, http.MethodPost:
+		default:
+			w.Header().Set("Allow", "PUT, POST, DELETE")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		mfs, err := decodePush(http.MaxBytesReader(w, r.Body, maxPushBytes), expfmt.ResponseFormat(r.Header))
+		if err == nil {
+			err = s.pushes.push(grouping, mfs, r.Method == http.MethodPut)
+		}
+		if err != nil {
+			s.logger.Warn("Rejected push", "route", "push", "remote", r.RemoteAddr, "error", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// parseGroupingKey parses the part of a push URL after /metrics: a job name
+// followed by further label name and value pairs, such as
+// /job/backup/instance/db1. A name ending in @base64 has a base64url
+// encoded value, which may contain slashes or be empty.
+func parseGroupingKey(path string) (map[string]string, error) {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	if len(segments) < 2 || strings.TrimSuffix(segments[0], "@base64") != "job" {
+		return nil, errors.New("push URLs look like /metrics/job/<job>{/<label>/<value>}")
+	}
+	if len(segments)%2 != 0 {
+		return nil, fmt.Errorf("label %q has no value", segments[len(segments)-1])
+	}
+
+	grouping := make(map[string]string, len(segments)/2)
+	for i := 0; i < len(segments); i += 2 {
+		name, encoded := strings.CutSuffix(segments[i], "@base64")
+		value, err := url.PathUnescape(segments[i+1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for label %q: %w", name, err)
+		}
+		if encoded {
+			decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+			if err != nil {
+				return nil, fmt.Errorf("invalid base64 value for label %q: %w", name, err)
+			}
+			value = string(decoded)
+		}
+		_, duplicate := grouping[name]
+		switch {
+		case !labelNamePattern.MatchString(name) || strings.HasPrefix(name, "__"):
+			return nil, fmt.Errorf("invalid label name %q", name)
+		case duplicate:
+			return nil, fmt.Errorf("label %q appears twice", name)
+		case name == "job" && value == "":
+			return nil, errors.New("job name must not be empty")
+		}
+		grouping[name] = value
+	}
+	return grouping, nil
+}
+
+// decodePush reads the families of a push body in format.
+func decodePush(r io.Reader, format expfmt.Format) ([]*dto.MetricFamily, error) {
+	if format != expfmt.FmtProtoDelim {
+		return parseExposition(r)
+	}
+	var mfs []*dto.MetricFamily
+	dec := expfmt.NewDecoder(r, format)
+	for {
+		mf := &dto.MetricFamily{}
+		if err := dec.Decode(mf); errors.Is(err, io.EOF) {
+			return mfs, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if err := checkPushedFamily(mf); err != nil {
+			return nil, err
+		}
+		for _, other := range mfs {
+			if other.GetName() == mf.GetName() {
+				return nil, fmt.Errorf("%s: family sent twice", mf.GetName())
+			}
+		}
+		untypedToGauge(mf)
+		mfs = append(mfs, mf)
+	}
+}
+
+// checkPushedFamily checks a protobuf family for what the text parser
+// refuses in the text format: invalid names, help or label values that are
+// not UTF-8, series without the value of the family's type and series
+// sent twice.
+func checkPushedFamily(mf *dto.MetricFamily) error {
+	name := mf.GetName()
+	if !model.IsValidMetricName(model.LabelValue(name)) {
+		return fmt.Errorf("invalid metric name %q", name)
+	}
+	if !utf8.ValidString(mf.GetHelp()) {
+		return fmt.Errorf("%s: help is not valid UTF-8", name)
+	}
+	seen := make(map[string]bool, len(mf.Metric))
+	for _, m := range mf.Metric {
+		if !hasTypeValue(mf.GetType(), m) {
+			return fmt.Errorf("%s: series value does not match type %s", name, metricTypeToString(mf.GetType()))
+		}
+		pairs := append([]*dto.LabelPair(nil), m.Label...)
+		sort.Slice(pairs, func(i, j int) bool { return pairs[i].GetName() < pairs[j].GetName() })
+		for i, lp := range pairs {
+			if !labelNamePattern.MatchString(lp.GetName()) {
+				return fmt.Errorf("%s: invalid label name %q", name, lp.GetName())
+			}
+			if i > 0 && pairs[i-1].GetName() == lp.GetName() {
+				return fmt.Errorf("%s: label %s repeated", name, lp.GetName())
+			}
+			if !utf8.ValidString(lp.GetValue()) {
+				return fmt.Errorf("%s: value of label %s is not valid UTF-8", name, lp.GetName())
+			}
+		}
+		key := seriesKey("", pairs)
+		if seen[key] {
+			return fmt.Errorf("%s: series sent twice", name)
+		}
+		seen[key] = true
+	}
+	return nil
+}
+
+// hasTypeValue reports whether m has the value field of metric type t and
+// no other.
+func hasTypeValue(t dto.MetricType, m *dto.Metric) bool {
+	set := 0
+	for _, v := range []bool{m.Counter != nil, m.Gauge != nil, m.Summary != nil, m.Untyped != nil, m.Histogram != nil} {
+		if v {
+			set++
+		}
+	}
+	if set != 1 {
+		return false
+	}
+	switch t {
+	case dto.MetricType_COUNTER:
+		return m.Counter != nil
+	case dto.MetricType_GAUGE:
+		return m.Gauge != nil
+	case dto.MetricType_SUMMARY:
+		return m.Summary != nil
+	case dto.MetricType_UNTYPED:
+		return m.Untyped != nil
+	case dto.MetricType_HISTOGRAM, dto.MetricType_GAUGE_HISTOGRAM:
+		return m.Histogram != nil
+	}
+	return false
+}
+
+// push stores mfs for a group, replacing all of its families or only
+// those of the same name. Pushes that the gathered result could not hold
+// are refused as a whole.
+func (p *pushStore) push(grouping map[string]string, mfs []*dto.MetricFamily, replace bool) error {
+	groupLabels := labelPairs(grouping)
+	for _, mf := range mfs {
+		if mf.GetName() == pushTimeFamily {
+			return fmt.Errorf("%s is set by prommy and cannot be pushed", pushTimeFamily)
+		}
+		for _, m := range mf.Metric {
+			if m.TimestampMs != nil {
+				return fmt.Errorf("%s: pushed metrics must not have timestamps", mf.GetName())
+			}
+			for _, lp := range m.Label {
+				if value, ok := grouping[lp.GetName()]; ok && value != lp.GetValue() {
+					return fmt.Errorf("%s: label %s=%q conflicts with the grouping key", mf.GetName(), lp.GetName(), lp.GetValue())
+				}
+			}
+		}
+	}
+
+	key := seriesKey("", groupLabels)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.expire()
+	for _, mf := range mfs {
+		for groupKey, group := range p.groups {
+			if other, ok := group.families[mf.GetName()]; ok && groupKey != key && other.GetType() != mf.GetType() {
+				return fmt.Errorf("%s: pushed as %s, but another group pushed it as %s",
+					mf.GetName(), metricTypeToString(mf.GetType()), metricTypeToString(other.GetType()))
+			}
+		}
+	}
+
+	group, ok := p.groups[key]
+	if !ok || replace {
+		group = &pushGroup{labels: groupLabels, families: make(map[string]*dto.MetricFamily)}
+		p.groups[key] = group
+	}
+	for _, mf := range mfs {
+		group.families[mf.GetName()] = mf
+	}
+	group.pushed = p.now()
+	return nil
+}
+
+// remove deletes a group.
+func (p *pushStore) remove(grouping map[string]string) {
+	p.mu.Lock()
+	delete(p.groups, seriesKey("", labelPairs(grouping)))
+	p.mu.Unlock()
+}
+
+// expire removes groups not pushed within the TTL. Must be called with
+// p.mu held.
+func (p *pushStore) expire() {
+	if p.ttl <= 0 {
+		return
+	}
+	cutoff := p.now().Add(-p.ttl)
+	for key, group := range p.groups {
+		if group.pushed.Before(cutoff) {
+			delete(p.groups, key)
+		}
+	}
+}
+
+// Gather returns the pushed families sorted by name with the grouping
+// labels of every series added, and push_time_seconds for every group.
+// Families pushed by several groups are merged, keeping the help of the
+// first.
+func (p *pushStore) Gather() ([]*dto.MetricFamily, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.expire()
+
+	keys := make([]string, 0, len(p.groups))
+	for key := range p.groups {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	byName := make(map[string]*dto.MetricFamily)
+	var result []*dto.MetricFamily
+	family := func(name string, help *string, typ *dto.MetricType) *dto.MetricFamily {
+		mf, ok := byName[name]
+		if !ok {
+			mf = &dto.MetricFamily{Name: proto.String(name), Help: help, Type: typ}
+			byName[name] = mf
+			result = append(result, mf)
+		}
+		return mf
+	}
+	for _, key := range keys {
+		group := p.groups[key]
+		for _, pushed := range group.families {
+			mf := family(pushed.GetName(), pushed.Help, pushed.Type)
+			for _, m := range pushed.Metric {
+				mf.Metric = append(mf.Metric, withLabels(m, group.labels))
+			}
+		}
+		pushTime := family(pushTimeFamily, proto.String("Unix time of the last push to the group."), dto.MetricType_GAUGE.Enum())
+		pushTime.Metric = append(pushTime.Metric, &dto.Metric{
+			Label: group.labels,
+			Gauge: &dto.Gauge{Value: proto.Float64(float64(group.pushed.UnixNano()) / 1e9)},
+		})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].GetName() < result[j].GetName() })
+	return result, nil
+}
+
+// withLabels returns a copy of m with labels added, leaving m unchanged so
+// that the stored push can be gathered again.
+func withLabels(m *dto.Metric, labels []*dto.LabelPair) *dto.Metric {
+	merged := make(map[string]string, len(m.Label)+len(labels))
+	for _, lp := range m.Label {
+		merged[lp.GetName()] = lp.GetValue()
+	}
+	for _, lp := range labels {
+		merged[lp.GetName()] = lp.GetValue()
+	}
+	return &dto.Metric{
+		Label:     labelPairs(merged),
+		Gauge:     m.Gauge,
+		Counter:   m.Counter,
+		Summary:   m.Summary,
+		Untyped:   m.Untyped,
+		Histogram: m.Histogram,
+	}
+}
@@ -0,0 +1,223 @@
+package prommy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"google.golang.org/protobuf/proto"
+)
+
+// sendPush sends a text format body to a push URL and returns the status.
+func sendPush(t *testing.T, method, url, body string) int {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, url, err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// pushedValues returns the values of the server's series by name and
+// labels, leaving out push_time_seconds.
+func pushedValues(s *Server) map[string]float64 {
+	metrics, _ := s.collectMetrics()
+	values := make(map[string]float64)
+	for _, m := range metrics {
+		if m.Name == pushTimeFamily {
+			values[m.Name+"{job="+m.Labels["job"]+"}"] = 1
+			continue
+		}
+		var labels []string
+		for _, name := range []string{"job", "instance", "table"} {
+			if v, ok := m.Labels[name]; ok {
+				labels = append(labels, name+"="+v)
+			}
+		}
+		values[m.Name+"{"+strings.Join(labels, ",")+"}"] = m.Value
+	}
+	return values
+}
+
+func TestPush(t *testing.T) {
+	s, srv := newTestServer(t, WithNopLogger(), WithPush(0))
+
+	// The client_golang push package sends delimited protobuf with PUT
+	rows := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "backup_rows", Help: "Rows backed up."}, []string{"table"})
+	rows.WithLabelValues("users").Set(120)
+	if err := push.New(srv.URL, "backup").Grouping("instance", "db1").Collector(rows).Push(); err != nil {
+		t.Fatalf("Push: %v", err)
+	}
+
+	// POST adds families to the group, replacing only those it sends
+	if status := sendPush(t, http.MethodPost, srv.URL+"/metrics/job/backup/instance/db1", "# TYPE backup_duration_seconds gauge\nbackup_duration_seconds 42\n"); status != http.StatusOK {
+		t.Fatalf("POST status = %d, want 200", status)
+	}
+	if status := sendPush(t, http.MethodPost, srv.URL+"/metrics/job@base64/Y3Jvbi9ob3VybHk", "cron_runs_total 1\n"); status != http.StatusOK {
+		t.Fatalf("POST with base64 job status = %d, want 200", status)
+	}
+	want := map[string]float64{
+		"backup_rows{job=backup,instance=db1,table=users}": 120,
+		"backup_duration_seconds{job=backup,instance=db1}": 42,
+		"cron_runs_total{job=cron/hourly}":                 1,
+		"push_time_seconds{job=backup}":                    1,
+		"push_time_seconds{job=cron/hourly}":               1,
+	}
+	if got := pushedValues(s); !reflect.DeepEqual(got, want) {
+		t.Errorf("after pushes = %v, want %v", got, want)
+	}
+
+	// PUT replaces everything the group had
+	if status := sendPush(t, http.MethodPut, srv.URL+"/metrics/job/backup/instance/db1", "backup_duration_seconds 7\n"); status != http.StatusOK {
+		t.Fatalf("PUT status = %d, want 200", status)
+	}
+	delete(want, "backup_rows{job=backup,instance=db1,table=users}")
+	want["backup_duration_seconds{job=backup,instance=db1}"] = 7
+	if got := pushedValues(s); !reflect.DeepEqual(got, want) {
+		t.Errorf("after PUT = %v, want %v", got, want)
+	}
+
+	// DELETE removes the group
+	if err := push.New(srv.URL, "backup").Grouping("instance", "db1").Delete(); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	want = map[string]float64{"cron_runs_total{job=cron/hourly}": 1, "push_time_seconds{job=cron/hourly}": 1}
+	if got := pushedValues(s); !reflect.DeepEqual(got, want) {
+		t.Errorf("after DELETE = %v, want %v", got, want)
+	}
+
+	resp, err := http.Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("GET /metrics: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), `cron_runs_total{job="cron/hourly"} 1`) {
+		t.Errorf("/metrics does not show pushed series:\n%s", body)
+	}
+}
+
+func TestPushRejects(t *testing.T) {
+	_, srv := newTestServer(t, WithNopLogger(), WithPush(0))
+	if status := sendPush(t, http.MethodPut, srv.URL+"/metrics/job/a", "# TYPE shared gauge\nshared 1\n"); status != http.StatusOK {
+		t.Fatalf("PUT status = %d, want 200", status)
+	}
+
+	tests := []struct {
+		name, method, path, body string
+		status                   int
+	}{
+		{"no job", http.MethodPut, "/metrics/instance/x", "up 1\n", http.StatusBadRequest},
+		{"empty job", http.MethodPut, "/metrics/job@base64/=", "up 1\n", http.StatusBadRequest},
+		{"label without value", http.MethodPut, "/metrics/job/a/instance", "up 1\n", http.StatusBadRequest},
+		{"repeated label", http.MethodPut, "/metrics/job/a/job/b", "up 1\n", http.StatusBadRequest},
+		{"reserved label", http.MethodPut, "/metrics/job/a/__name__/x", "up 1\n", http.StatusBadRequest},
+		{"conflicting label", http.MethodPut, "/metrics/job/a", "up{job=\"b\"} 1\n", http.StatusBadRequest},
+		{"timestamp", http.MethodPut, "/metrics/job/a", "up 1 1700000000000\n", http.StatusBadRequest},
+		{"push time", http.MethodPut, "/metrics/job/a", "push_time_seconds 1\n", http.StatusBadRequest},
+		{"type of another group", http.MethodPut, "/metrics/job/b", "# TYPE shared counter\nshared 1\n", http.StatusBadRequest},
+		{"malformed", http.MethodPut, "/metrics/job/a", "up{\n", http.StatusBadRequest},
+		{"get", http.MethodGet, "/metrics/job/a", "", http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if status := sendPush(t, tt.method, srv.URL+tt.path, tt.body); status != tt.status {
+				t.Errorf("status = %d, want %d", status, tt.status)
+			}
+		})
+	}
+}
+
+func TestPushRejectsInvalidProtobuf(t *testing.T) {
+	_, srv := newTestServer(t, WithNopLogger(), WithPush(0))
+
+	gauge := func(value float64, labels ...*dto.LabelPair) *dto.Metric {
+		return &dto.Metric{Label: labels, Gauge: &dto.Gauge{Value: proto.Float64(value)}}
+	}
+	label := func(name, value string) *dto.LabelPair {
+		return &dto.LabelPair{Name: proto.String(name), Value: proto.String(value)}
+	}
+	family := func(name string, metrics ...*dto.Metric) *dto.MetricFamily {
+		return &dto.MetricFamily{Name: proto.String(name), Type: dto.MetricType_GAUGE.Enum(), Metric: metrics}
+	}
+	tests := []struct {
+		name string
+		mfs  []*dto.MetricFamily
+	}{
+		{"invalid metric name", []*dto.MetricFamily{family("backup-rows", gauge(1))}},
+		{"invalid label name", []*dto.MetricFamily{family("backup_rows", gauge(1, label("table-name", "users")))}},
+		{"invalid UTF-8 value", []*dto.MetricFamily{family("backup_rows", gauge(1, label("table", "users\xff")))}},
+		{"repeated label", []*dto.MetricFamily{family("backup_rows", gauge(1, label("table", "a"), label("table", "b")))}},
+		{"value of another type", []*dto.MetricFamily{family("backup_rows", &dto.Metric{Counter: &dto.Counter{Value: proto.Float64(1)}})}},
+		{"repeated series", []*dto.MetricFamily{family("backup_rows", gauge(1, label("table", "users")), gauge(2, label("table", "users")))}},
+		{"repeated family", []*dto.MetricFamily{family("backup_rows", gauge(1)), family("backup_rows", gauge(2))}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body bytes.Buffer
+			enc := expfmt.NewEncoder(&body, expfmt.FmtProtoDelim)
+			for _, mf := range tt.mfs {
+				if err := enc.Encode(mf); err != nil {
+					t.Fatal(err)
+				}
+			}
+			req, err := http.NewRequest(http.MethodPut, srv.URL+"/metrics/job/backup", &body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", string(expfmt.FmtProtoDelim))
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("PUT: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("status = %d, want 400", resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestPushStoreTTL(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	store := newPushStore(time.Hour)
+	store.now = func() time.Time { return now }
+
+	up := func() []*dto.MetricFamily {
+		mfs, err := parseExposition(strings.NewReader("up 1\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return mfs
+	}
+	store.push(map[string]string{"job": "old"}, up(), true)
+	now = now.Add(45 * time.Minute)
+	store.push(map[string]string{"job": "new"}, up(), true)
+	now = now.Add(30 * time.Minute)
+
+	mfs, _ := store.Gather()
+	var jobs []string
+	for _, m := range convertMetrics(mfs) {
+		if m.Name == "up" {
+			jobs = append(jobs, m.Labels["job"])
+		}
+	}
+	if !reflect.DeepEqual(jobs, []string{"new"}) {
+		t.Errorf("jobs after TTL = %v, want [new]", jobs)
+	}
+}
@@ -0,0 +1,240 @@
+package prommy
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"google.golang.org/protobuf/proto"
+)
+
+// RelabelAction is what a RelabelConfig does with the series it matches.
+type RelabelAction string
+
+// Relabel actions, with the same meaning as in Prometheus.
+const (
+	RelabelReplace   RelabelAction = "replace"   // Set TargetLabel to Replacement if the source labels match
+	RelabelKeep      RelabelAction = "keep"      // Drop series whose source labels do not match
+	RelabelDrop      RelabelAction = "drop"      // Drop series whose source labels match
+	RelabelLabelMap  RelabelAction = "labelmap"  // Copy labels whose names match to the name given by Replacement
+	RelabelLabelDrop RelabelAction = "labeldrop" // Remove labels whose names match
+	RelabelLabelKeep RelabelAction = "labelkeep" // Remove labels whose names do not match
+)
+
+// metricNameLabel holds the family name of a series while it is relabeled,
+// so rules can match and rename metrics like any other label.
+const metricNameLabel = "__name__"
+
+// RelabelConfig is a rule rewriting the labels of gathered series, written
+// like a Prometheus metric_relabel_configs entry. The values of
+// SourceLabels, joined by Separator, are matched against Regex, which must
+// match the whole value. Replacement may refer to the regex's capture
+// groups as $1 or ${name}. Empty fields take the Prometheus defaults: the
+// separator ";", the regex "(.*)", the replacement "$1" and the action
+// replace.
+type RelabelConfig struct {
+	SourceLabels []string      `json:"source_labels" yaml:"source_labels"`
+	Separator    string        `json:"separator" yaml:"separator"`
+	Regex        string        `json:"regex" yaml:"regex"`
+	TargetLabel  string        `json:"target_label" yaml:"target_label"`
+	Replacement  string        `json:"replacement" yaml:"replacement"`
+	Action       RelabelAction `json:"action" yaml:"action"`
+}
+
+// relabelRule is a RelabelConfig with its defaults applied and regex compiled.
+type relabelRule struct {
+	sourceLabels []string
+	separator    string
+	regex        *regexp.Regexp
+	targetLabel  string
+	replacement  string
+	action       RelabelAction
+}
+
+// compile checks the rule and prepares it for use.
+func (c RelabelConfig) compile() (*relabelRule, error) {
+	r := &relabelRule{
+		sourceLabels: c.SourceLabels,
+		separator:    c.Separator,
+		targetLabel:  c.TargetLabel,
+		replacement:  c.Replacement,
+		action:       c.Action,
+	}
+	if r.separator == "" {
+		r.separator = ";"
+	}
+	if r.replacement == "" {
+		r.replacement = "$1"
+	}
+	if r.action == "" {
+		r.action = RelabelReplace
+	}
+	expr := c.Regex
+	if expr == "" {
+		expr = "(.*)"
+	}
+	regex, err := regexp.Compile("^(?:" + expr + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid regex %q: %w", c.Regex, err)
+	}
+	r.regex = regex
+
+	for _, name := range c.SourceLabels {
+		if !labelNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("invalid source label %q", name)
+		}
+	}
+	switch r.action {
+	case RelabelReplace:
+		if c.TargetLabel == "" {
+			return nil, fmt.Errorf("action %s needs a target_label", r.action)
+		}
+	case RelabelKeep, RelabelDrop:
+		if len(c.SourceLabels) == 0 {
+			return nil, fmt.Errorf("action %s needs source_labels", r.action)
+		}
+	case RelabelLabelMap, RelabelLabelDrop, RelabelLabelKeep:
+		if len(c.SourceLabels) > 0 || c.TargetLabel != "" {
+			return nil, fmt.Errorf("action %s matches label names and takes no source_labels or target_label", r.action)
+		}
+	default:
+		return nil, fmt.Errorf("unknown action %q", c.Action)
+	}
+	return r, nil
+}
+
+// compileRelabel compiles rules in order, failing on the first invalid one.
+func compileRelabel(rules []RelabelConfig) ([]*relabelRule, error) {
+	compiled := make([]*relabelRule, 0, len(rules))
+	for i, rule := range rules {
+		r, err := rule.compile()
+		if err != nil {
+			return nil, fmt.Errorf("relabel rule %d: %w", i, err)
+		}
+		compiled = append(compiled, r)
+	}
+	return compiled, nil
+}
+
+// apply rewrites labels in place and reports whether the series is kept.
+func (r *relabelRule) apply(labels map[string]string) bool {
+	values := make([]string, len(r.sourceLabels))
+	for i, name := range r.sourceLabels {
+		values[i] = labels[name]
+	}
+	value := strings.Join(values, r.separator)
+
+	switch r.action {
+	case RelabelKeep:
+		return r.regex.MatchString(value)
+	case RelabelDrop:
+		return !r.regex.MatchString(value)
+	case RelabelReplace:
+		match := r.regex.FindStringSubmatchIndex(value)
+		if match == nil {
+			return true
+		}
+		target := string(r.regex.ExpandString(nil, r.targetLabel, value, match))
+		if !labelNamePattern.MatchString(target) {
+			return true
+		}
+		if result := string(r.regex.ExpandString(nil, r.replacement, value, match)); result != "" {
+			labels[target] = result
+		} else {
+			delete(labels, target)
+		}
+	case RelabelLabelMap:
+		mapped := make(map[string]string)
+		for name, v := range labels {
+			if match := r.regex.FindStringSubmatchIndex(name); match != nil {
+				// Like a replace target, a result that is no label name is skipped
+				if target := string(r.regex.ExpandString(nil, r.replacement, name, match)); labelNamePattern.MatchString(target) {
+					mapped[target] = v
+				}
+			}
+		}
+		for name, v := range mapped {
+			labels[name] = v
+		}
+	case RelabelLabelDrop, RelabelLabelKeep:
+		for name := range labels {
+			// The metric name is not a label to these actions
+			if name != metricNameLabel && r.regex.MatchString(name) == (r.action == RelabelLabelDrop) {
+				delete(labels, name)
+			}
+		}
+	}
+	return true
+}
+
+// relabelFamilies applies rules to every series in mfs and returns the
+// result sorted by name, leaving mfs unchanged. Series are dropped if a rule
+// drops them or their name is removed or rewritten to an invalid metric
+// name, and moved to another family if their name is rewritten; a family
+// left without series is omitted. Labels
+// starting with "__" are removed once all rules have run.
+func relabelFamilies(mfs []*dto.MetricFamily, rules []*relabelRule) []*dto.MetricFamily {
+	if len(rules) == 0 {
+		return mfs
+	}
+	byName := make(map[string]*dto.MetricFamily)
+	var result []*dto.MetricFamily
+	for _, mf := range mfs {
+	series:
+		for _, m := range mf.Metric {
+			labels := make(map[string]string, len(m.Label)+1)
+			for _, lp := range m.Label {
+				labels[lp.GetName()] = lp.GetValue()
+			}
+			labels[metricNameLabel] = mf.GetName()
+			for _, rule := range rules {
+				if !rule.apply(labels) {
+					continue series
+				}
+			}
+
+			name := labels[metricNameLabel]
+			if !model.IsValidMetricName(model.LabelValue(name)) {
+				// Removed, or rewritten to something no exposition format accepts
+				continue
+			}
+			family, ok := byName[name]
+			if !ok {
+				family = &dto.MetricFamily{Name: proto.String(name), Help: mf.Help, Type: mf.Type}
+				byName[name] = family
+				result = append(result, family)
+			} else if family.GetType() != mf.GetType() {
+				// Renamed onto a family of another type
+				continue
+			}
+			family.Metric = append(family.Metric, &dto.Metric{
+				Label:       labelPairs(labels),
+				Gauge:       m.Gauge,
+				Counter:     m.Counter,
+				Summary:     m.Summary,
+				Untyped:     m.Untyped,
+				Histogram:   m.Histogram,
+				TimestampMs: m.TimestampMs,
+			})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].GetName() < result[j].GetName() })
+	return result
+}
+
+// labelPairs converts labels to sorted label pairs, leaving out the metric
+// name and other reserved labels starting with "__".
+func labelPairs(labels map[string]string) []*dto.LabelPair {
+	pairs := make([]*dto.LabelPair, 0, len(labels))
+	for name, value := range labels {
+		if strings.HasPrefix(name, "__") {
+			continue
+		}
+		pairs = append(pairs, &dto.LabelPair{Name: proto.String(name), Value: proto.String(value)})
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].GetName() < pairs[j].GetName() })
+	return pairs
+}
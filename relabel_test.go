@@ -0,0 +1,164 @@
+package prommy
+
+import (
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestRelabelRule(t *testing.T) {
+	series := func() map[string]string {
+		return map[string]string{"__name__": "http_requests_total", "method": "GET", "pod": "web-1", "__meta_node": "n1"}
+	}
+	tests := []struct {
+		name   string
+		rule   RelabelConfig
+		keep   bool
+		labels map[string]string
+	}{
+		{
+			name: "keep matching",
+			rule: RelabelConfig{SourceLabels: []string{"__name__"}, Regex: "http_.*", Action: RelabelKeep},
+			keep: true, labels: series(),
+		},
+		{
+			name: "keep anchors the regex",
+			rule: RelabelConfig{SourceLabels: []string{"__name__"}, Regex: "http", Action: RelabelKeep},
+		},
+		{
+			name: "drop joined source labels",
+			rule: RelabelConfig{SourceLabels: []string{"method", "pod"}, Regex: "GET;web-.*", Action: RelabelDrop},
+		},
+		{
+			name: "replace with capture group",
+			rule: RelabelConfig{SourceLabels: []string{"pod"}, Regex: "(.*)-[0-9]+", TargetLabel: "app"},
+			keep: true,
+			labels: map[string]string{"__name__": "http_requests_total", "method": "GET", "pod": "web-1", "__meta_node": "n1",
+				"app": "web"},
+		},
+		{
+			name: "replace without match leaves labels",
+			rule: RelabelConfig{SourceLabels: []string{"pod"}, Regex: "db-.*", TargetLabel: "app", Replacement: "db"},
+			keep: true, labels: series(),
+		},
+		{
+			name:   "replace with empty result removes the label",
+			rule:   RelabelConfig{SourceLabels: []string{"missing"}, TargetLabel: "method"},
+			keep:   true,
+			labels: map[string]string{"__name__": "http_requests_total", "pod": "web-1", "__meta_node": "n1"},
+		},
+		{
+			name: "labelmap",
+			rule: RelabelConfig{Regex: "__meta_(.+)", Action: RelabelLabelMap},
+			keep: true,
+			labels: map[string]string{"__name__": "http_requests_total", "method": "GET", "pod": "web-1", "__meta_node": "n1",
+				"node": "n1"},
+		},
+		{
+			name: "labelmap skips invalid names",
+			rule: RelabelConfig{Regex: "(.*)", Replacement: "$1-x", Action: RelabelLabelMap},
+			keep: true, labels: series(),
+		},
+		{
+			name: "labeldrop",
+			rule: RelabelConfig{Regex: "pod|method", Action: RelabelLabelDrop},
+			keep: true, labels: map[string]string{"__name__": "http_requests_total", "__meta_node": "n1"},
+		},
+		{
+			name: "labelkeep keeps the name",
+			rule: RelabelConfig{Regex: "method", Action: RelabelLabelKeep},
+			keep: true, labels: map[string]string{"__name__": "http_requests_total", "method": "GET"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule, err := tt.rule.compile()
+			if err != nil {
+				t.Fatalf("compile: %v", err)
+			}
+			labels := series()
+			if keep := rule.apply(labels); keep != tt.keep {
+				t.Fatalf("apply() = %v, want %v", keep, tt.keep)
+			}
+			if tt.keep && !reflect.DeepEqual(labels, tt.labels) {
+				t.Errorf("labels = %v, want %v", labels, tt.labels)
+			}
+		})
+	}
+}
+
+func TestRelabelFamilies(t *testing.T) {
+	gauge := func(name string, value float64, labels ...string) *dto.MetricFamily {
+		m := &dto.Metric{Gauge: &dto.Gauge{Value: proto.Float64(value)}}
+		for i := 0; i < len(labels); i += 2 {
+			m.Label = append(m.Label, &dto.LabelPair{Name: proto.String(labels[i]), Value: proto.String(labels[i+1])})
+		}
+		return &dto.MetricFamily{Name: proto.String(name), Type: dto.MetricType_GAUGE.Enum(), Metric: []*dto.Metric{m}}
+	}
+	mfs := []*dto.MetricFamily{
+		gauge("go_goroutines", 10),
+		gauge("queue_depth", 3, "queue", "fast"),
+		gauge("queue_size", 5, "queue", "slow"),
+		gauge("temp_celsius", 21),
+	}
+	rules, err := compileRelabel([]RelabelConfig{
+		{SourceLabels: []string{"__name__"}, Regex: "go_.*", Action: RelabelDrop},
+		{SourceLabels: []string{"__name__"}, Regex: "queue_size", TargetLabel: "__name__", Replacement: "queue_depth"},
+		{SourceLabels: []string{"queue"}, TargetLabel: "__tmp_queue"},
+		{SourceLabels: []string{"__tmp_queue"}, TargetLabel: "lane"},
+		{Regex: "queue", Action: RelabelLabelDrop},
+		{SourceLabels: []string{"__name__"}, Regex: "temp_(.*)", TargetLabel: "__name__", Replacement: "temp °$1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := convertMetrics(relabelFamilies(mfs, rules))
+	want := []Metric{
+		{Name: "queue_depth", Type: "gauge", Labels: map[string]string{"lane": "fast"}, Value: 3},
+		{Name: "queue_depth", Type: "gauge", Labels: map[string]string{"lane": "slow"}, Value: 5},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("relabelFamilies() = %+v, want %+v", got, want)
+	}
+	if mfs[1].Metric[0].Label[0].GetName() != "queue" {
+		t.Error("relabelFamilies modified its input")
+	}
+}
+
+func TestWithRelabel(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(collectors.NewGoCollector())
+	jobs := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_jobs", Help: "Queued jobs."}, []string{"queue"})
+	jobs.WithLabelValues("fast").Set(4)
+	reg.MustRegister(jobs)
+
+	s, srv := newTestServer(t, WithNopLogger(), WithRegistry(reg), WithRelabel(
+		RelabelConfig{SourceLabels: []string{"__name__"}, Regex: "go_.*", Action: RelabelDrop},
+		RelabelConfig{SourceLabels: []string{"queue"}, TargetLabel: "lane"},
+		RelabelConfig{Regex: "queue", Action: RelabelLabelDrop},
+	))
+
+	metrics, _ := s.collectMetrics()
+	want := []Metric{{Name: "test_jobs", Type: "gauge", Help: "Queued jobs.", Labels: map[string]string{"lane": "fast"}, Value: 4}}
+	if !reflect.DeepEqual(metrics, want) {
+		t.Errorf("collectMetrics() = %+v, want %+v", metrics, want)
+	}
+
+	resp, err := http.Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("GET /metrics: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(body), `test_jobs{lane="fast"} 4`) || strings.Contains(string(body), "go_goroutines") {
+		t.Errorf("/metrics is not relabeled:\n%s", body)
+	}
+}
@@ -0,0 +1,330 @@
+package prommy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/golang/snappy"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// maxRemoteWriteBytes limits the compressed size of a remote_write request.
+const maxRemoteWriteBytes = 32 << 20
+
+// staleNaN is the value Prometheus sends to mark a series as gone.
+const staleNaN = 0x7ff0000000000002
+
+// Field numbers of the prometheus.WriteRequest protobuf message and the
+// messages it contains, from prompb/remote.proto and prompb/types.proto.
+const (
+	writeRequestTimeseries = 1
+	writeRequestMetadata   = 3
+
+	timeSeriesLabels  = 1
+	timeSeriesSamples = 2
+
+	labelName  = 1
+	labelValue = 2
+
+	sampleValue     = 1
+	sampleTimestamp = 2
+
+	metadataType       = 1
+	metadataFamilyName = 2
+	metadataHelp       = 4
+)
+
+// Values of prometheus.MetricMetadata.MetricType. Only counters are kept
+// apart by the receiver; other types are shown as gauges.
+const (
+	metadataUnknown        = 0
+	metadataCounter        = 1
+	metadataGauge          = 2
+	metadataHistogram      = 3
+	metadataGaugeHistogram = 4
+	metadataSummary        = 5
+)
+
+// writeRequest is the part of a remote_write request prommy uses. Exemplars
+// and native histograms are skipped.
+type writeRequest struct {
+	timeseries []writeSeries
+	metadata   []writeMetadata
+}
+
+type writeSeries struct {
+	labels  map[string]string
+	samples []writeSample
+}
+
+type writeSample struct {
+	value     float64
+	timestamp int64
+}
+
+type writeMetadata struct {
+	typ  int
+	name string
+	help string
+}
+
+// receiveRemoteWrite serves Prometheus remote_write requests, storing the
+// latest sample of every series so it is gathered like any other metric.
+func (s *Server) receiveRemoteWrite(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// Remote write 2.0 senders fall back to 1.0 when it is refused
+	if mediaType, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "" &&
+		(mediaType != "application/x-protobuf" || params["proto"] != "" && params["proto"] != "prometheus.WriteRequest") {
+		http.Error(w, "Only prometheus.WriteRequest protobuf messages are supported", http.StatusUnsupportedMediaType)
+		return
+	}
+	if encoding := r.Header.Get("Content-Encoding"); encoding != "" && !strings.EqualFold(encoding, "snappy") {
+		http.Error(w, "Only snappy compression is supported", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	compressed, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRemoteWriteBytes))
+	if err != nil {
+		status := http.StatusBadRequest
+		if tooLarge := (*http.MaxBytesError)(nil); errors.As(err, &tooLarge) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		s.rejectRemoteWrite(w, r, status, err)
+		return
+	}
+	data, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		s.rejectRemoteWrite(w, r, http.StatusBadRequest, fmt.Errorf("snappy: %w", err))
+		return
+	}
+	req, err := decodeWriteRequest(data)
+	if err != nil {
+		s.rejectRemoteWrite(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	for _, meta := range req.metadata {
+		typ := dto.MetricType_GAUGE
+		if meta.typ == metadataCounter {
+			typ = dto.MetricType_COUNTER
+		}
+		s.pushed.describe(meta.name, typ, meta.help)
+	}
+	dropped := 0
+	for _, ts := range req.timeseries {
+		name := ts.labels[metricNameLabel]
+		if name == "" {
+			continue
+		}
+		// Only the latest sample is shown, and a stale marker removes the series
+		latest := ts.samples[0]
+		for _, sample := range ts.samples[1:] {
+			if sample.timestamp >= latest.timestamp {
+				latest = sample
+			}
+		}
+		if math.Float64bits(latest.value) == staleNaN {
+			s.pushed.remove(name, ts.labels)
+			continue
+		}
+		if !s.pushed.set(name, ts.labels, latest.value, latest.timestamp) {
+			dropped++
+		}
+	}
+	// Like Prometheus, report a partial write as an error so the sender logs
+	// it; the series that fit are stored
+	if dropped > 0 {
+		s.rejectRemoteWrite(w, r, http.StatusBadRequest, fmt.Errorf("dropped %d new series, the limit of %d series is reached", dropped, maxStoredSeries))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// rejectRemoteWrite answers a remote_write request that cannot be stored.
+// Senders do not retry 4xx responses, so the data is dropped.
+func (s *Server) rejectRemoteWrite(w http.ResponseWriter, r *http.Request, status int, err error) {
+	s.logger.Warn("Rejected remote write request", "route", "write", "remote", r.RemoteAddr, "error", err)
+	http.Error(w, err.Error(), status)
+}
+
+// decodeWriteRequest parses a prometheus.WriteRequest message. Series without
+// samples are left out, and metric names, label names and label values are
+// checked since they end up in the exposition of gathered metrics.
+func decodeWriteRequest(data []byte) (*writeRequest, error) {
+	req := &writeRequest{}
+	err := decodeMessage(data, func(num protowire.Number, typ protowire.Type, field []byte) error {
+		switch {
+		case num == writeRequestTimeseries && typ == protowire.BytesType:
+			ts, err := decodeWriteSeries(field)
+			if err != nil {
+				return fmt.Errorf("timeseries %d: %w", len(req.timeseries), err)
+			}
+			if len(ts.samples) > 0 {
+				req.timeseries = append(req.timeseries, ts)
+			}
+		case num == writeRequestMetadata && typ == protowire.BytesType:
+			meta, err := decodeWriteMetadata(field)
+			if err != nil {
+				return fmt.Errorf("metadata: %w", err)
+			}
+			// Metadata is advisory, so entries that could not be served are skipped
+			if model.IsValidMetricName(model.LabelValue(meta.name)) && utf8.ValidString(meta.help) {
+				req.metadata = append(req.metadata, meta)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+func decodeWriteSeries(data []byte) (writeSeries, error) {
+	ts := writeSeries{labels: make(map[string]string)}
+	err := decodeMessage(data, func(num protowire.Number, typ protowire.Type, field []byte) error {
+		switch {
+		case num == timeSeriesLabels && typ == protowire.BytesType:
+			var name, value string
+			err := decodeMessage(field, func(num protowire.Number, typ protowire.Type, field []byte) error {
+				if typ == protowire.BytesType {
+					switch num {
+					case labelName:
+						name = string(field)
+					case labelValue:
+						value = string(field)
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if name != metricNameLabel && !labelNamePattern.MatchString(name) {
+				return fmt.Errorf("invalid label name %q", name)
+			}
+			if name == metricNameLabel && value != "" && !model.IsValidMetricName(model.LabelValue(value)) {
+				return fmt.Errorf("invalid metric name %q", value)
+			}
+			if !utf8.ValidString(value) {
+				return fmt.Errorf("label %s has a value that is not valid UTF-8", name)
+			}
+			ts.labels[name] = value
+		case num == timeSeriesSamples && typ == protowire.BytesType:
+			var sample writeSample
+			err := decodeMessage(field, func(num protowire.Number, typ protowire.Type, field []byte) error {
+				switch {
+				case num == sampleValue && typ == protowire.Fixed64Type:
+					v, _ := protowire.ConsumeFixed64(field)
+					sample.value = math.Float64frombits(v)
+				case num == sampleTimestamp && typ == protowire.VarintType:
+					v, _ := protowire.ConsumeVarint(field)
+					sample.timestamp = int64(v)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			ts.samples = append(ts.samples, sample)
+		}
+		return nil
+	})
+	return ts, err
+}
+
+func decodeWriteMetadata(data []byte) (writeMetadata, error) {
+	var meta writeMetadata
+	err := decodeMessage(data, func(num protowire.Number, typ protowire.Type, field []byte) error {
+		switch {
+		case num == metadataType && typ == protowire.VarintType:
+			v, _ := protowire.ConsumeVarint(field)
+			meta.typ = int(v)
+		case num == metadataFamilyName && typ == protowire.BytesType:
+			meta.name = string(field)
+		case num == metadataHelp && typ == protowire.BytesType:
+			meta.help = string(field)
+		}
+		return nil
+	})
+	return meta, err
+}
+
+// decodeMessage calls fn with every field of a protobuf message. Length
+// delimited fields are passed without their length, and other fields as
+// their raw encoding; unknown fields are for fn to ignore.
+func decodeMessage(data []byte, fn func(num protowire.Number, typ protowire.Type, field []byte) error) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+		n = protowire.ConsumeFieldValue(num, typ, data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		field := data[:n]
+		if typ == protowire.BytesType {
+			field, _ = protowire.ConsumeBytes(field)
+		}
+		if err := fn(num, typ, field); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// appendWriteLabels appends pairs as the label fields of a
+// prometheus.TimeSeries message.
+func appendWriteLabels(b []byte, pairs []*dto.LabelPair) []byte {
+	for _, lp := range pairs {
+		name, value := lp.GetName(), lp.GetValue()
+		b = protowire.AppendTag(b, timeSeriesLabels, protowire.BytesType)
+		b = protowire.AppendVarint(b, uint64(protowire.SizeTag(labelName)+protowire.SizeBytes(len(name))+
+			protowire.SizeTag(labelValue)+protowire.SizeBytes(len(value))))
+		b = protowire.AppendTag(b, labelName, protowire.BytesType)
+		b = protowire.AppendString(b, name)
+		b = protowire.AppendTag(b, labelValue, protowire.BytesType)
+		b = protowire.AppendString(b, value)
+	}
+	return b
+}
+
+// appendWriteSample appends a sample field of a prometheus.TimeSeries message.
+func appendWriteSample(b []byte, value float64, timestamp int64) []byte {
+	b = protowire.AppendTag(b, timeSeriesSamples, protowire.BytesType)
+	b = protowire.AppendVarint(b, uint64(protowire.SizeTag(sampleValue)+protowire.SizeFixed64()+
+		protowire.SizeTag(sampleTimestamp)+protowire.SizeVarint(uint64(timestamp))))
+	b = protowire.AppendTag(b, sampleValue, protowire.Fixed64Type)
+	b = protowire.AppendFixed64(b, math.Float64bits(value))
+	b = protowire.AppendTag(b, sampleTimestamp, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(timestamp))
+}
+
+// appendWriteMetadata appends a metadata field of a prometheus.WriteRequest
+// message.
+func appendWriteMetadata(b []byte, meta writeMetadata) []byte {
+	var msg []byte
+	msg = protowire.AppendTag(msg, metadataType, protowire.VarintType)
+	msg = protowire.AppendVarint(msg, uint64(meta.typ))
+	msg = protowire.AppendTag(msg, metadataFamilyName, protowire.BytesType)
+	msg = protowire.AppendString(msg, meta.name)
+	msg = protowire.AppendTag(msg, metadataHelp, protowire.BytesType)
+	msg = protowire.AppendString(msg, meta.help)
+	b = protowire.AppendTag(b, writeRequestMetadata, protowire.BytesType)
+	return protowire.AppendBytes(b, msg)
+}
@@ -0,0 +1,268 @@
+package prommy
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// testSeries is a remote_write time series for building test requests.
+type testSeries struct {
+	labels  map[string]string
+	samples []writeSample
+}
+
+// encodeTestWriteRequest encodes a request with prompb, the way Prometheus
+// sends it, followed by snappy block compression.
+func encodeTestWriteRequest(series []testSeries, metadata []writeMetadata) []byte {
+	var req prompb.WriteRequest
+	for _, ts := range series {
+		var pts prompb.TimeSeries
+		for name, value := range ts.labels {
+			pts.Labels = append(pts.Labels, prompb.Label{Name: name, Value: value})
+		}
+		sort.Slice(pts.Labels, func(i, j int) bool { return pts.Labels[i].Name < pts.Labels[j].Name })
+		for _, sample := range ts.samples {
+			pts.Samples = append(pts.Samples, prompb.Sample{Value: sample.value, Timestamp: sample.timestamp})
+		}
+		req.Timeseries = append(req.Timeseries, pts)
+	}
+	for _, meta := range metadata {
+		req.Metadata = append(req.Metadata, prompb.MetricMetadata{
+			Type:             prompb.MetricMetadata_MetricType(meta.typ),
+			MetricFamilyName: meta.name,
+			Help:             meta.help,
+		})
+	}
+	data, err := req.Marshal()
+	if err != nil {
+		panic(err)
+	}
+	return snappy.Encode(nil, data)
+}
+
+// postRemoteWrite sends body to the remote_write endpoint of url with the
+// headers Prometheus sets.
+func postRemoteWrite(t *testing.T, url, contentType string, body []byte) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, url+"/api/v1/write", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("POST /api/v1/write: %v", err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestRemoteWrite(t *testing.T) {
+	s, srv := newTestServer(t, WithNopLogger(), WithRemoteWrite(0))
+
+	body := encodeTestWriteRequest([]testSeries{
+		{
+			labels:  map[string]string{"__name__": "batch_jobs_total", "job": "nightly"},
+			samples: []writeSample{{value: 5, timestamp: 1000}, {value: 7, timestamp: 2000}},
+		},
+		{
+			labels:  map[string]string{"__name__": "batch_queue_depth", "job": "nightly", "queue": "slow"},
+			samples: []writeSample{{value: 3, timestamp: 2000}},
+		},
+	}, []writeMetadata{{typ: metadataCounter, name: "batch_jobs_total", help: "Jobs run by the batch."}})
+	if resp := postRemoteWrite(t, srv.URL, "application/x-protobuf", body); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("status = %d, want 204", resp.StatusCode)
+	}
+
+	metrics, errs := s.collectMetrics()
+	want := []Metric{
+		{Name: "batch_jobs_total", Type: "counter", Help: "Jobs run by the batch.", Labels: map[string]string{"job": "nightly"}, Value: 7},
+		{Name: "batch_queue_depth", Type: "gauge", Labels: map[string]string{"job": "nightly", "queue": "slow"}, Value: 3},
+	}
+	if len(errs) > 0 || !reflect.DeepEqual(metrics, want) {
+		t.Errorf("collectMetrics() = %+v, %v, want %+v", metrics, errs, want)
+	}
+
+	resp, err := http.Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("GET /metrics: %v", err)
+	}
+	text, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(text), `batch_jobs_total{job="nightly"} 7`) {
+		t.Errorf("/metrics does not show written series:\n%s", text)
+	}
+
+	// Older samples arriving late are ignored, and a stale marker removes the series
+	body = encodeTestWriteRequest([]testSeries{
+		{
+			labels:  map[string]string{"__name__": "batch_jobs_total", "job": "nightly"},
+			samples: []writeSample{{value: 6, timestamp: 1500}},
+		},
+		{
+			labels:  map[string]string{"__name__": "batch_queue_depth", "job": "nightly", "queue": "slow"},
+			samples: []writeSample{{value: math.Float64frombits(staleNaN), timestamp: 3000}},
+		},
+	}, nil)
+	postRemoteWrite(t, srv.URL, "application/x-protobuf", body)
+	if metrics, _ := s.collectMetrics(); !reflect.DeepEqual(metrics, want[:1]) {
+		t.Errorf("after stale marker = %+v, want %+v", metrics, want[:1])
+	}
+}
+
+func TestRemoteWriteRejects(t *testing.T) {
+	_, srv := newTestServer(t, WithNopLogger(), WithRemoteWrite(0))
+	valid := encodeTestWriteRequest([]testSeries{{
+		labels:  map[string]string{"__name__": "up"},
+		samples: []writeSample{{value: 1}},
+	}}, nil)
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        []byte
+		status      int
+	}{
+		{"remote write 2.0", "application/x-protobuf;proto=io.prometheus.write.v2.Request", valid, http.StatusUnsupportedMediaType},
+		{"not snappy", "application/x-protobuf", []byte("plain text"), http.StatusBadRequest},
+		{"not protobuf", "application/x-protobuf", snappy.Encode(nil, []byte{0xff, 0xff}), http.StatusBadRequest},
+		{"invalid label", "application/x-protobuf", encodeTestWriteRequest([]testSeries{{
+			labels:  map[string]string{"__name__": "up", "bad-label": "x"},
+			samples: []writeSample{{value: 1}},
+		}}, nil), http.StatusBadRequest},
+		{"invalid metric name", "application/x-protobuf", encodeTestWriteRequest([]testSeries{{
+			labels:  map[string]string{"__name__": "foo-bar"},
+			samples: []writeSample{{value: 1}},
+		}}, nil), http.StatusBadRequest},
+		{"invalid UTF-8 value", "application/x-protobuf", encodeTestWriteRequest([]testSeries{{
+			labels:  map[string]string{"__name__": "up", "job": "batch\xff"},
+			samples: []writeSample{{value: 1}},
+		}}, nil), http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if resp := postRemoteWrite(t, srv.URL, tt.contentType, tt.body); resp.StatusCode != tt.status {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+		})
+	}
+
+	resp, err := http.Get(srv.URL + "/api/v1/write")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET status = %d, want 405", resp.StatusCode)
+	}
+
+	// The endpoint only exists when enabled
+	_, plain := newTestServer(t, WithNopLogger())
+	if resp := postRemoteWrite(t, plain.URL, "application/x-protobuf", valid); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("status without WithRemoteWrite = %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestSeriesStoreRetention(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	store := newSeriesStore(time.Minute)
+	store.now = func() time.Time { return now }
+
+	store.describe("temp", dto.MetricType_GAUGE, "Temperature.")
+	store.set("temp", map[string]string{"room": "a"}, 20, 1000)
+	now = now.Add(45 * time.Second)
+	store.set("temp", map[string]string{"room": "b"}, 22, 1000)
+
+	now = now.Add(30 * time.Second)
+	mfs, _ := store.Gather()
+	got := convertMetrics(mfs)
+	want := []Metric{{Name: "temp", Type: "gauge", Help: "Temperature.", Labels: map[string]string{"room": "b"}, Value: 22}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Gather() = %+v, want %+v", got, want)
+	}
+
+	now = now.Add(time.Minute)
+	if mfs, _ := store.Gather(); len(mfs) != 0 || len(store.families) != 0 {
+		t.Errorf("Gather() after retention = %v, families %v, want nothing", mfs, store.families)
+	}
+}
+
+func TestDecodeWriteRequest(t *testing.T) {
+	// Exemplars, native histograms and metadata units are skipped, and a
+	// series without float samples is left out
+	req := prompb.WriteRequest{
+		Timeseries: []prompb.TimeSeries{
+			{
+				Labels:    []prompb.Label{{Name: "__name__", Value: "http_requests_total"}, {Name: "code", Value: "200"}},
+				Samples:   []prompb.Sample{{Value: 12, Timestamp: 1000}, {Value: -1.5, Timestamp: -2}},
+				Exemplars: []prompb.Exemplar{{Labels: []prompb.Label{{Name: "trace_id", Value: "abc"}}, Value: 0.3, Timestamp: 900}},
+			},
+			{
+				Labels:     []prompb.Label{{Name: "__name__", Value: "latency_seconds"}},
+				Histograms: []prompb.Histogram{{Count: &prompb.Histogram_CountInt{CountInt: 3}, Sum: 1.5, Schema: 1, Timestamp: 1000}},
+			},
+		},
+		Metadata: []prompb.MetricMetadata{{Type: prompb.MetricMetadata_COUNTER, MetricFamilyName: "http_requests_total", Help: "Requests.", Unit: "requests"}},
+	}
+	data, err := req.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := decodeWriteRequest(data)
+	if err != nil {
+		t.Fatalf("decodeWriteRequest: %v", err)
+	}
+	want := &writeRequest{
+		timeseries: []writeSeries{{
+			labels:  map[string]string{"__name__": "http_requests_total", "code": "200"},
+			samples: []writeSample{{value: 12, timestamp: 1000}, {value: -1.5, timestamp: -2}},
+		}},
+		metadata: []writeMetadata{{typ: metadataCounter, name: "http_requests_total", help: "Requests."}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("decodeWriteRequest() = %+v, want %+v", got, want)
+	}
+}
+
+func TestSeriesStoreLimit(t *testing.T) {
+	store := newSeriesStore(0)
+	for i := 0; i < maxStoredSeries; i++ {
+		if !store.set("requests", map[string]string{"id": strconv.Itoa(i)}, 1, 0) {
+			t.Fatalf("set() of series %d failed, want it stored", i)
+		}
+	}
+	if store.set("requests", map[string]string{"id": "new"}, 1, 0) {
+		t.Error("set() stored a series above the limit")
+	}
+	if !store.set("requests", map[string]string{"id": "0"}, 2, 1000) {
+		t.Error("set() refused to update a stored series at the limit")
+	}
+
+	// Metadata is limited the same way
+	for i := 0; i < maxStoredSeries; i++ {
+		store.describe("family_"+strconv.Itoa(i), dto.MetricType_COUNTER, "")
+	}
+	store.describe("family_new", dto.MetricType_COUNTER, "")
+	store.describe("family_0", dto.MetricType_GAUGE, "Updated.")
+	if _, ok := store.families["family_new"]; ok || len(store.families) != maxStoredSeries {
+		t.Errorf("described %d families, want the limit of %d", len(store.families), maxStoredSeries)
+	}
+	if meta := store.families["family_0"]; meta.help != "Updated." {
+		t.Errorf("family_0 metadata = %+v, want it updated at the limit", meta)
+	}
+}
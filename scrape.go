@@ -0,0 +1,390 @@
+package prommy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"google.golang.org/protobuf/proto"
+)
+
+// Default limit on a single scrape, kept below the default tick so a dead
+// target does not delay the others by more than one update.
+const defaultScrapeTimeout = 5 * time.Second
+
+// Largest exposition accepted from a target.
+const maxScrapeSize = 16 << 20
+
+// scrapeAccept asks for the text format, which every Prometheus client serves.
+const scrapeAccept = "text/plain;version=0.0.4;q=1,*/*;q=0.1"
+
+// Longest scrape error message kept in the error label of scrape_error.
+const maxScrapeErrorLength = 256
+
+// Target is a metrics endpoint scraped by a Scraper.
+type Target struct {
+	URL     string            // Absolute http, https or file URL of the endpoint
+	Labels  map[string]string // Added to every series scraped from the target
+	Relabel []RelabelConfig   // Applied in order to the scraped series after Labels
+}
+
+// instance returns the host and port the target is identified by, or the
+// path of a file target.
+func (t Target) instance() string {
+	u, _ := url.Parse(t.URL)
+	if u.Scheme == "file" {
+		return u.Path
+	}
+	return u.Host
+}
+
+// ScrapeError reports a target that could not be scraped.
+type ScrapeError struct {
+	Target string // URL of the target
+	Err    error
+}
+
+func (e *ScrapeError) Error() string {
+	return fmt.Sprintf("scrape %s: %v", e.Target, e.Err)
+}
+
+func (e *ScrapeError) Unwrap() error {
+	return e.Err
+}
+
+// Scraper is a prometheus.Gatherer that fetches the /metrics endpoints of
+// other processes, so that the dashboard can show services it is not
+// embedded in. Pass it to WithGatherer. Every Gather scrapes all targets
+// concurrently and labels each series with its target's instance and labels.
+//
+// Like Prometheus, the scraper adds health series for every target: up is 1
+// if the last scrape succeeded and 0 otherwise, scrape_duration_seconds is
+// how long it took, and scrape_samples_scraped how many samples it returned.
+// A target whose last scrape failed also has a scrape_error series of value 1
+// whose error label holds the reason.
+type Scraper struct {
+	client *http.Client
+
+	mu      sync.Mutex
+	targets []Target
+	rules   [][]*relabelRule // Compiled Relabel of each target
+}
+
+// NewScraper creates a scraper for the given URLs, which must be absolute
+// http or https URLs, or file URLs of files in the Prometheus text format
+// such as those written for node_exporter's textfile collector. A timeout
+// of 0 uses the default of five seconds.
+func NewScraper(urls []string, timeout time.Duration) (*Scraper, error) {
+	if timeout <= 0 {
+		timeout = defaultScrapeTimeout
+	}
+	s := &Scraper{client: &http.Client{Timeout: timeout}}
+
+	targets := make([]Target, len(urls))
+	for i, u := range urls {
+		targets[i] = Target{URL: u}
+	}
+	if err := s.SetTargets(targets); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// SetTargets replaces the scraped targets, taking effect with the next
+// Gather. It fails without changing anything if a target URL or relabel
+// rule is invalid.
+func (s *Scraper) SetTargets(targets []Target) error {
+	rules := make([][]*relabelRule, len(targets))
+	for i, target := range targets {
+		if err := validateTargetURL(target.URL); err != nil {
+			return err
+		}
+		compiled, err := compileRelabel(target.Relabel)
+		if err != nil {
+			return fmt.Errorf("target %q: %w", target.URL, err)
+		}
+		rules[i] = compiled
+	}
+	s.mu.Lock()
+	s.targets, s.rules = targets, rules
+	s.mu.Unlock()
+	return nil
+}
+
+// Targets returns the targets currently scraped.
+func (s *Scraper) Targets() []Target {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.targets
+}
+
+func validateTargetURL(target string) error {
+	u, err := url.Parse(target)
+	if err != nil {
+		return fmt.Errorf("invalid target %q: %w", target, err)
+	}
+	if u.Scheme == "file" {
+		if u.Path == "" || u.Host != "" {
+			return fmt.Errorf("invalid target %q: want file:///path", target)
+		}
+		return nil
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid target %q: want an http, https or file URL", target)
+	}
+	return nil
+}
+
+// scrapeResult is the outcome of scraping one target.
+type scrapeResult struct {
+	mfs      []*dto.MetricFamily
+	samples  int
+	duration time.Duration
+	err      error
+}
+
+// Gather implements prometheus.Gatherer. Targets that fail are reported as
+// *ScrapeError values in the returned prometheus.MultiError alongside the
+// families of the others.
+func (s *Scraper) Gather() ([]*dto.MetricFamily, error) {
+	s.mu.Lock()
+	targets, rules := s.targets, s.rules
+	s.mu.Unlock()
+	results := make([]scrapeResult, len(targets))
+
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			mfs, err := s.scrape(context.Background(), target)
+			results[i] = scrapeResult{mfs: mfs, samples: countSamples(mfs), duration: time.Since(start), err: err}
+		}()
+	}
+	wg.Wait()
+
+	var multi prometheus.MultiError
+	sources := make([][]*dto.MetricFamily, 0, len(targets)+1)
+	for i, result := range results {
+		multi.Append(result.err)
+		labelTarget(result.mfs, targets[i])
+		sources = append(sources, relabelFamilies(result.mfs, rules[i]))
+	}
+	sources = append(sources, healthFamilies(targets, results))
+	return mergeFamilies(sources), multi.MaybeUnwrap()
+}
+
+// scrape fetches one target.
+func (s *Scraper) scrape(ctx context.Context, target Target) ([]*dto.MetricFamily, error) {
+	if strings.HasPrefix(target.URL, "file:") {
+		return scrapeFile(target)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.URL, nil)
+	if err != nil {
+		return nil, &ScrapeError{Target: target.URL, Err: err}
+	}
+	req.Header.Set("Accept", scrapeAccept)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, &ScrapeError{Target: target.URL, Err: err}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &ScrapeError{Target: target.URL, Err: fmt.Errorf("unexpected status %s", resp.Status)}
+	}
+
+	mfs, err := parseExposition(io.LimitReader(resp.Body, maxScrapeSize))
+	if err != nil {
+		return nil, &ScrapeError{Target: target.URL, Err: err}
+	}
+	return mfs, nil
+}
+
+// scrapeFile reads a file target.
+func scrapeFile(target Target) ([]*dto.MetricFamily, error) {
+	u, _ := url.Parse(target.URL)
+	f, err := os.Open(u.Path)
+	if err != nil {
+		return nil, &ScrapeError{Target: target.URL, Err: err}
+	}
+	defer f.Close()
+	mfs, err := parseExposition(io.LimitReader(f, maxScrapeSize))
+	if err != nil {
+		return nil, &ScrapeError{Target: target.URL, Err: err}
+	}
+	return mfs, nil
+}
+
+// labelTarget adds the target's labels and instance to every series in mfs.
+// They replace labels of the same name exposed by the target.
+func labelTarget(mfs []*dto.MetricFamily, target Target) {
+	for name, value := range target.Labels {
+		addLabel(mfs, name, value)
+	}
+	addLabel(mfs, "instance", target.instance())
+}
+
+// healthFamilies builds the up, scrape_duration_seconds,
+// scrape_samples_scraped and scrape_error series for the given scrape results.
+func healthFamilies(targets []Target, results []scrapeResult) []*dto.MetricFamily {
+	if len(targets) == 0 {
+		return nil
+	}
+	family := func(name, help string, value func(scrapeResult) float64) *dto.MetricFamily {
+		mf := &dto.MetricFamily{Name: proto.String(name), Help: proto.String(help), Type: dto.MetricType_GAUGE.Enum()}
+		for i, result := range results {
+			m := &dto.Metric{Gauge: &dto.Gauge{Value: proto.Float64(value(result))}}
+			labelTarget([]*dto.MetricFamily{{Metric: []*dto.Metric{m}}}, targets[i])
+			mf.Metric = append(mf.Metric, m)
+		}
+		return mf
+	}
+
+	// Only failed targets have an error to show
+	failed := &dto.MetricFamily{
+		Name: proto.String("scrape_error"),
+		Help: proto.String("Why the last scrape of the target failed, in the error label."),
+		Type: dto.MetricType_GAUGE.Enum(),
+	}
+	for i, result := range results {
+		if result.err == nil {
+			continue
+		}
+		m := &dto.Metric{
+			Label: []*dto.LabelPair{{Name: proto.String("error"), Value: proto.String(scrapeErrorMessage(result.err))}},
+			Gauge: &dto.Gauge{Value: proto.Float64(1)},
+		}
+		labelTarget([]*dto.MetricFamily{{Metric: []*dto.Metric{m}}}, targets[i])
+		failed.Metric = append(failed.Metric, m)
+	}
+
+	mfs := []*dto.MetricFamily{
+		family("scrape_duration_seconds", "Duration of the last scrape of the target.", func(r scrapeResult) float64 {
+			return r.duration.Seconds()
+		}),
+		family("scrape_samples_scraped", "Number of samples the last scrape of the target returned.", func(r scrapeResult) float64 {
+			return float64(r.samples)
+		}),
+		family("up", "Whether the last scrape of the target succeeded.", func(r scrapeResult) float64 {
+			if r.err != nil {
+				return 0
+			}
+			return 1
+		}),
+	}
+	if len(failed.Metric) > 0 {
+		mfs = append(mfs, failed)
+	}
+	return mfs
+}
+
+// scrapeErrorMessage returns the reason a scrape failed without the target
+// URL, which the instance label already shows, cut to maxScrapeErrorLength.
+func scrapeErrorMessage(err error) string {
+	var scrapeErr *ScrapeError
+	if errors.As(err, &scrapeErr) {
+		err = scrapeErr.Err
+	}
+	msg := strings.ToValidUTF8(err.Error(), "")
+	if len(msg) > maxScrapeErrorLength {
+		msg = strings.ToValidUTF8(msg[:maxScrapeErrorLength], "")
+	}
+	return msg
+}
+
+// countSamples returns the number of series in mfs.
+func countSamples(mfs []*dto.MetricFamily) int {
+	n := 0
+	for _, mf := range mfs {
+		n += len(mf.Metric)
+	}
+	return n
+}
+
+// parseExposition reads metric families in the Prometheus text format,
+// sorted by name. Untyped families become gauges, since the dashboard has
+// no other way to show them.
+func parseExposition(r io.Reader) ([]*dto.MetricFamily, error) {
+	var parser expfmt.TextParser
+	parsed, err := parser.TextToMetricFamilies(r)
+	if err != nil {
+		return nil, err
+	}
+
+	mfs := make([]*dto.MetricFamily, 0, len(parsed))
+	for _, mf := range parsed {
+		untypedToGauge(mf)
+		mfs = append(mfs, mf)
+	}
+	sort.Slice(mfs, func(i, j int) bool { return mfs[i].GetName() < mfs[j].GetName() })
+	return mfs, nil
+}
+
+// untypedToGauge turns an untyped family into a gauge.
+func untypedToGauge(mf *dto.MetricFamily) {
+	if mf.GetType() != dto.MetricType_UNTYPED {
+		return
+	}
+	mf.Type = dto.MetricType_GAUGE.Enum()
+	for _, m := range mf.Metric {
+		m.Gauge = &dto.Gauge{Value: proto.Float64(m.GetUntyped().GetValue())}
+		m.Untyped = nil
+	}
+}
+
+// addLabel sets name to value on every series in mfs, replacing any label
+// of that name the series already has.
+func addLabel(mfs []*dto.MetricFamily, name, value string) {
+	for _, mf := range mfs {
+		for _, m := range mf.Metric {
+			replaced := false
+			for _, lp := range m.Label {
+				if lp.GetName() == name {
+					lp.Value = proto.String(value)
+					replaced = true
+				}
+			}
+			if !replaced {
+				m.Label = append(m.Label, &dto.LabelPair{Name: proto.String(name), Value: proto.String(value)})
+				sort.Slice(m.Label, func(i, j int) bool { return m.Label[i].GetName() < m.Label[j].GetName() })
+			}
+		}
+	}
+}
+
+// mergeFamilies combines families gathered from several sources into one
+// name-sorted list. Series of a family that appears in more than one source
+// are concatenated; if the sources disagree on its type, the first wins and
+// the others' series are dropped.
+func mergeFamilies(sources [][]*dto.MetricFamily) []*dto.MetricFamily {
+	byName := make(map[string]*dto.MetricFamily)
+	var merged []*dto.MetricFamily
+	for _, mfs := range sources {
+		for _, mf := range mfs {
+			existing, ok := byName[mf.GetName()]
+			if !ok {
+				byName[mf.GetName()] = mf
+				merged = append(merged, mf)
+				continue
+			}
+			if existing.GetType() == mf.GetType() {
+				existing.Metric = append(existing.Metric, mf.Metric...)
+			}
+		}
+	}
+	sort.Slice(merged, func(i, j int) bool { return merged[i].GetName() < merged[j].GetName() })
+	return merged
+}
@@ -0,0 +1,178 @@
+package prommy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestTarget serves body as a text exposition.
+func newTestTarget(t *testing.T, body string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		fmt.Fprint(w, body)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestScraper(t *testing.T) {
+	a := newTestTarget(t, `# HELP jobs_total Jobs processed.
+# TYPE jobs_total counter
+jobs_total{queue="fast"} 3
+# TYPE queue_depth untyped
+queue_depth 7
+`)
+	b := newTestTarget(t, `# TYPE jobs_total counter
+jobs_total{queue="fast",instance="ignored"} 5
+`)
+	down := httptest.NewServer(http.NotFoundHandler())
+	defer down.Close()
+
+	scraper, err := NewScraper([]string{a.URL + "/metrics", b.URL + "/metrics", down.URL + "/metrics"}, 0)
+	if err != nil {
+		t.Fatalf("NewScraper: %v", err)
+	}
+	mfs, err := scraper.Gather()
+	var scrapeErr *ScrapeError
+	if !errors.As(err, &scrapeErr) || scrapeErr.Target != down.URL+"/metrics" || !strings.Contains(err.Error(), "404") {
+		t.Errorf("Gather() error = %v, want 404 from the failing target", err)
+	}
+	if ge := gatherErrors(err); len(ge) != 1 || ge[0].Kind != GatherErrorScrape || ge[0].Collector != down.URL+"/metrics" {
+		t.Errorf("gatherErrors() = %+v, want a scrape error naming the target", ge)
+	}
+
+	got := map[string]Metric{}
+	for _, m := range convertMetrics(mfs) {
+		got[m.Name+"@"+m.Labels["instance"]] = m
+	}
+	hostA, hostB, hostDown := mustHost(t, a.URL), mustHost(t, b.URL), mustHost(t, down.URL)
+	if m := got["jobs_total@"+hostA]; m.Value != 3 || m.Type != "counter" || m.Labels["queue"] != "fast" || m.Help != "Jobs processed." {
+		t.Errorf("jobs_total from a = %+v", m)
+	}
+	if m := got["jobs_total@"+hostB]; m.Value != 5 {
+		t.Errorf("jobs_total from b = %+v, want 5 with the target's instance label", m)
+	}
+	if m := got["queue_depth@"+hostA]; m.Value != 7 || m.Type != "gauge" {
+		t.Errorf("untyped queue_depth = %+v, want gauge 7", m)
+	}
+
+	// Every target gets health series, including the one that failed
+	for host, want := range map[string]float64{hostA: 1, hostB: 1, hostDown: 0} {
+		if m, ok := got["up@"+host]; !ok || m.Value != want {
+			t.Errorf("up for %s = %+v, want %v", host, m, want)
+		}
+		if _, ok := got["scrape_duration_seconds@"+host]; !ok {
+			t.Errorf("scrape_duration_seconds missing for %s", host)
+		}
+	}
+	if m := got["scrape_samples_scraped@"+hostA]; m.Value != 2 {
+		t.Errorf("scrape_samples_scraped for a = %v, want 2", m.Value)
+	}
+	if m, ok := got["scrape_error@"+hostDown]; !ok || m.Value != 1 || m.Labels["error"] != "unexpected status 404 Not Found" {
+		t.Errorf("scrape_error for the failing target = %+v, want the 404 in the error label", m)
+	}
+	if len(got) != 13 {
+		t.Errorf("got %d series, want 3 scraped and 10 health series: %v", len(got), got)
+	}
+}
+
+func mustHost(t *testing.T, rawURL string) string {
+	t.Helper()
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.Host
+}
+
+func TestNewScraperRejectsInvalidTargets(t *testing.T) {
+	for _, target := range []string{"localhost:9100", "ftp://host/metrics", "http://", "file://host/metrics.prom"} {
+		if _, err := NewScraper([]string{target}, 0); err == nil {
+			t.Errorf("NewScraper(%q) succeeded, want error", target)
+		}
+	}
+}
+
+func TestWithGatherer(t *testing.T) {
+	target := newTestTarget(t, "remote_up 1\n")
+	scraper, err := NewScraper([]string{target.URL}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, srv := newTestServer(t, WithNopLogger(), WithGatherer(scraper))
+
+	metrics, errs := s.collectMetrics()
+	if len(errs) != 0 || len(metrics) != 4 || metrics[0].Name != "remote_up" {
+		t.Errorf("collectMetrics() = %+v, %v; want remote_up and health series", metrics, errs)
+	}
+
+	resp, err := http.Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("GET /metrics: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(body), `remote_up{instance="`+mustHost(t, target.URL)+`"} 1`) {
+		t.Errorf("/metrics does not include the scraped series:\n%s", body)
+	}
+}
+
+func TestScraperTargetRelabelAndFiles(t *testing.T) {
+	remote := newTestTarget(t, `go_goroutines 12
+jobs_total{queue="fast"} 3
+`)
+	path := filepath.Join(t.TempDir(), "batch.prom")
+	if err := os.WriteFile(path, []byte("# TYPE batch_last_success_seconds gauge\nbatch_last_success_seconds 1700000000\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	scraper, err := NewScraper(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = scraper.SetTargets([]Target{
+		{URL: remote.URL + "/metrics", Labels: map[string]string{"job": "api"}, Relabel: []RelabelConfig{
+			{SourceLabels: []string{"__name__"}, Regex: "go_.*", Action: RelabelDrop},
+			{SourceLabels: []string{"job", "queue"}, Separator: "/", TargetLabel: "queue"},
+		}},
+		{URL: "file://" + path},
+	})
+	if err != nil {
+		t.Fatalf("SetTargets: %v", err)
+	}
+	mfs, err := scraper.Gather()
+	if err != nil {
+		t.Fatalf("Gather: %v", err)
+	}
+
+	got := map[string]Metric{}
+	for _, m := range convertMetrics(mfs) {
+		got[m.Name+"@"+m.Labels["instance"]] = m
+	}
+	if _, ok := got["go_goroutines@"+mustHost(t, remote.URL)]; ok {
+		t.Error("go_goroutines was not dropped by the target's relabel rule")
+	}
+	if m := got["jobs_total@"+mustHost(t, remote.URL)]; m.Labels["queue"] != "api/fast" {
+		t.Errorf("jobs_total labels = %v, want queue relabeled to api/fast", m.Labels)
+	}
+	if m := got["batch_last_success_seconds@"+path]; m.Value != 1700000000 {
+		t.Errorf("file target series = %+v", m)
+	}
+	if m := got["up@"+path]; m.Value != 1 {
+		t.Errorf("up for the file target = %+v, want 1", m)
+	}
+
+	err = scraper.SetTargets([]Target{{URL: remote.URL, Relabel: []RelabelConfig{{Action: "keep"}}}})
+	if err == nil || len(scraper.Targets()) != 2 {
+		t.Errorf("SetTargets with an invalid rule = %v, want an error and the targets unchanged", err)
+	}
+}
@@ -0,0 +1,253 @@
+package prommy
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// internalsSection is the dashboard section title for prommy's own metrics.
+const internalsSection = "prommy internals"
+
+// selfMetrics holds prommy's own instrumentation. The collectors live on a
+// private registry that is merged into /metrics and the dashboard feed when
+// self-metrics are enabled. All methods are safe to call on a nil receiver,
+// which is how disabled instrumentation is represented.
+type selfMetrics struct {
+	registry *prometheus.Registry
+
+	gatherDuration prometheus.Histogram
+	series         prometheus.Gauge
+	payloadBytes   prometheus.Gauge
+	gatherErrors   *prometheus.CounterVec
+	cacheRequests  *prometheus.CounterVec
+
+	connectionsAccepted prometheus.Counter
+	connectionsRejected *prometheus.CounterVec
+	clientsKicked       prometheus.Counter
+	framesDropped       prometheus.Counter
+	writeErrors         prometheus.Counter
+
+	httpRequests *prometheus.CounterVec
+
+	remoteWrite *prometheus.CounterVec
+}
+
+// newSelfMetrics creates the internal collectors and reports the number of
+// clients connected to hub and the durations of the timed collectors in
+// timings.
+func newSelfMetrics(hub *Hub, timings *timingTable) *selfMetrics {
+	m := &selfMetrics{
+		registry: prometheus.NewRegistry(),
+		gatherDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "prommy_gather_duration_seconds",
+			Help:    "Time spent gathering and converting metrics for one dashboard tick.",
+			Buckets: prometheus.ExponentialBuckets(0.0005, 2, 12),
+		}),
+		series: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "prommy_series",
+			Help: "Series sent to dashboard clients on the last tick.",
+		}),
+		payloadBytes: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "prommy_broadcast_payload_bytes",
+			Help: "Size of the metrics payload broadcast on the last tick.",
+		}),
+		gatherErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "prommy_gather_errors_total",
+			Help: "Problems reported while gathering metrics, by kind.",
+		}, []string{"kind"}),
+		cacheRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "prommy_snapshot_cache_requests_total",
+			Help: "Gather requests answered from the shared snapshot cache (hit) or by gathering (miss).",
+		}, []string{"result"}),
+		connectionsAccepted: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "prommy_connections_accepted_total",
+			Help: "Dashboard clients admitted by prommy: WebSocket and SSE connections, and polling clients on their first poll.",
+		}),
+		connectionsRejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "prommy_connections_rejected_total",
+			Help: "Dashboard clients refused because of a connection limit, by the limit that was hit.",
+		}, []string{"limit"}),
+		clientsKicked: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "prommy_clients_kicked_total",
+			Help: "WebSocket and SSE clients disconnected for falling behind.",
+		}),
+		framesDropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "prommy_frames_dropped_total",
+			Help: "Snapshots discarded from slow clients' queues.",
+		}),
+		writeErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "prommy_client_write_errors_total",
+			Help: "Errors writing to WebSocket and SSE clients.",
+		}),
+		httpRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "prommy_http_requests_total",
+			Help: "HTTP requests served by prommy, by route and status code.",
+		}, []string{"route", "code"}),
+		remoteWrite: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "prommy_remote_write_samples_total",
+			Help: "Samples forwarded with remote_write, by result: sent, retried, rejected by the receiver or dropped from a full buffer.",
+		}, []string{"result"}),
+	}
+
+	m.registry.MustRegister(
+		m.gatherDuration,
+		m.series,
+		m.payloadBytes,
+		m.gatherErrors,
+		m.cacheRequests,
+		m.connectionsAccepted,
+		m.connectionsRejected,
+		m.clientsKicked,
+		m.framesDropped,
+		m.writeErrors,
+		m.httpRequests,
+		m.remoteWrite,
+		collectorDurations{timings: timings, desc: prometheus.NewDesc(
+			"prommy_collector_duration_seconds",
+			"Duration of the last Collect call of each timed collector, or the time spent so far if one is running longer.",
+			[]string{"collector"}, nil,
+		)},
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "prommy_clients",
+			Help: "WebSocket and SSE clients currently connected to prommy.",
+		}, func() float64 {
+			return float64(hub.clientCount())
+		}),
+	)
+
+	// Pre-create every limit so rejections show up as a change from zero
+	for _, limit := range []string{limitGlobal, limitIP, limitUser} {
+		m.connectionsRejected.WithLabelValues(limit)
+	}
+	return m
+}
+
+// observeTick records the cost of producing one dashboard update.
+func (m *selfMetrics) observeTick(duration time.Duration, series, payloadBytes int) {
+	if m == nil {
+		return
+	}
+	m.gatherDuration.Observe(duration.Seconds())
+	m.series.Set(float64(series))
+	m.payloadBytes.Set(float64(payloadBytes))
+}
+
+// gatherError records a problem reported by Gather.
+func (m *selfMetrics) gatherError(kind string) {
+	if m == nil {
+		return
+	}
+	m.gatherErrors.WithLabelValues(kind).Inc()
+}
+
+// snapshotCacheHit records whether a gather request was served from the snapshot cache.
+func (m *selfMetrics) snapshotCacheHit(hit bool) {
+	if m == nil {
+		return
+	}
+	if hit {
+		m.cacheRequests.WithLabelValues("hit").Inc()
+	} else {
+		m.cacheRequests.WithLabelValues("miss").Inc()
+	}
+}
+
+// connectionAccepted records an admitted client.
+func (m *selfMetrics) connectionAccepted() {
+	if m == nil {
+		return
+	}
+	m.connectionsAccepted.Inc()
+}
+
+// connectionRejected records a client refused because of limit.
+func (m *selfMetrics) connectionRejected(limit string) {
+	if m == nil {
+		return
+	}
+	m.connectionsRejected.WithLabelValues(limit).Inc()
+}
+
+// clientKicked records a client disconnected by the slow-client policy.
+func (m *selfMetrics) clientKicked() {
+	if m == nil {
+		return
+	}
+	m.clientsKicked.Inc()
+}
+
+// framesDiscarded records snapshots dropped from a slow client's queue.
+func (m *selfMetrics) framesDiscarded(n int) {
+	if m == nil || n == 0 {
+		return
+	}
+	m.framesDropped.Add(float64(n))
+}
+
+// writeError records a failed write to a client.
+func (m *selfMetrics) writeError() {
+	if m == nil {
+		return
+	}
+	m.writeErrors.Inc()
+}
+
+// remoteWriteSamples records n samples forwarded with remote_write with the
+// given result.
+func (m *selfMetrics) remoteWriteSamples(result string, n int) {
+	if m == nil || n == 0 {
+		return
+	}
+	m.remoteWrite.WithLabelValues(result).Add(float64(n))
+}
+
+// instrumentRoute counts requests served by handler under the given route name.
+func (m *selfMetrics) instrumentRoute(route string, handler http.Handler) http.Handler {
+	if m == nil {
+		return handler
+	}
+	counter := m.httpRequests.MustCurryWith(prometheus.Labels{"route": route})
+	return promhttp.InstrumentHandlerCounter(counter, handler)
+}
+
+// dashboardSection returns the dashboard rows showing prommy's own metrics.
+func (m *selfMetrics) dashboardSection() [][]interface{} {
+	if m == nil {
+		return nil
+	}
+	return [][]interface{}{
+		{
+			map[string]string{"name": "prommy_gather_duration_seconds", "short": "GATHER", "section": internalsSection},
+			map[string]string{"name": "prommy_series", "short": "SERIES"},
+			map[string]string{"name": "prommy_broadcast_payload_bytes", "short": "PAYLOAD"},
+			map[string]string{"name": "prommy_clients", "short": "CLIENTS"},
+		},
+		{
+			map[string]string{"name": "prommy_clients_kicked_total", "short": "KICKED"},
+			map[string]string{"name": "prommy_frames_dropped_total", "short": "DROPPED"},
+			map[string]string{"name": "prommy_client_write_errors_total", "short": "WRITE ERR"},
+			map[string]string{"name": "prommy_http_requests_total", "short": "HTTP"},
+		},
+	}
+}
+
+// collectorDurations exports the timings recorded by timed collectors.
+type collectorDurations struct {
+	desc    *prometheus.Desc
+	timings *timingTable
+}
+
+// Describe implements prometheus.Collector.
+func (c collectorDurations) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+// Collect implements prometheus.Collector.
+func (c collectorDurations) Collect(ch chan<- prometheus.Metric) {
+	for name, d := range c.timings.durations() {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, d.Seconds(), name)
+	}
+}
@@ -1,16 +1,22 @@
 package prommy
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/fs"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	dto "github.com/prometheus/client_model/go"
 )
@@ -26,18 +32,72 @@ type Metric struct {
 
 // Server handles HTTP requests and WebSocket connections.
 type Server struct {
-	config    *Config
-	hub       *Hub
-	upgrader  websocket.Upgrader
-	mux       *http.ServeMux
+	config   *Config
+	hub      *Hub
+	upgrader websocket.Upgrader
+	mux      *http.ServeMux
+	metrics  *selfMetrics       // Internal instrumentation, nil when disabled
+	gather   *gatherCoordinator // Gathers the configured registry with a timeout
+	pushed   *seriesStore       // Series received through remote_write, nil when disabled
+	forward  *remoteWriter      // Sends gathered samples with remote_write, nil when disabled
+	pushes   *pushStore         // Groups pushed by short-lived jobs, nil when disabled
+	logger   *slog.Logger
+
+	// Latest fresh gather of the broadcaster, sent on by the forwarder
+	latestMu sync.Mutex
+	latest   *gatherResult
+
+	// Canceled by Close to stop the background goroutines
+	ctx  context.Context
+	stop context.CancelFunc
+
+	// Settings a config file reload can change while serving
+	liveMu    sync.RWMutex
+	auth      *BasicAuth
 	dashboard [][]interface{} // Dashboard layout configuration
+	interval  time.Duration   // Default update interval
+	relabel   []*relabelRule  // Compiled Config.Relabel
+	fileData  []byte          // Config file contents last applied
+	applied   *Config         // Configuration from the last applied file, for restart-only changes
+
+	// Problems reported by the most recent gather, served on /api/errors
+	errMu      sync.Mutex
+	lastErrors []GatherError
+	lastGather time.Time
+
+	// Connection slots held by clients polling /api/snapshot
+	pollMu  sync.Mutex
+	pollers map[string]*pollLease
 }
 
-// newServer creates a new server with the given configuration.
+// pollLease is the connection slot of a polling client, held until the
+// client has not polled for a while.
+type pollLease struct {
+	lease   *connLease
+	expires time.Time
+}
+
+// connectionRetryAfter is the Retry-After hint sent when a connection limit is hit.
+const connectionRetryAfter = 5 * time.Second
+
+// pollGrace is how long past two of its update intervals a polling client
+// keeps its connection slot, to allow for slow requests.
+const pollGrace = 5 * time.Second
+
+// maxPollClientID limits the length of the client query parameter pollers
+// identify themselves with.
+const maxPollClientID = 64
+
+// newServer applies the config file, validates the configuration and
+// creates a server from it.
 func newServer(config *Config) (*Server, error) {
+	config.loadConfigFile()
+	if err := config.check(); err != nil {
+		return nil, err
+	}
+
 	// Create a new WebSocket hub
-	hub := newHub()
-	go hub.run()
+	hub := newHub(config)
 
 	// Create the server
 	s := &Server{
@@ -49,8 +109,68 @@ func newServer(config *Config) (*Server, error) {
 			CheckOrigin: func(r *http.Request) bool {
 				return true // Allow all origins
 			},
+			Subprotocols:      []string{subprotocolJSON},
+			EnableCompression: config.Compression,
 		},
-		mux: http.NewServeMux(),
+		mux:       http.NewServeMux(),
+		logger:    config.logger(),
+		auth:      config.BasicAuth,
+		dashboard: config.Dashboard,
+		interval:  config.TickerInterval,
+		fileData:  config.fileData,
+		applied:   config,
+		pollers:   make(map[string]*pollLease),
+	}
+	s.ctx, s.stop = context.WithCancel(context.Background())
+
+	// Gather the registry in the background so slow collectors cannot stall requests
+	var source prometheus.Gatherer = config.Registry
+	if len(config.Gatherers) > 0 {
+		source = append(prometheus.Gatherers{config.Registry}, config.Gatherers...)
+	}
+	if config.RemoteWrite {
+		s.pushed = newSeriesStore(config.RemoteWriteRetention)
+		source = prometheus.Gatherers{source, s.pushed}
+	}
+	if config.Push {
+		s.pushes = newPushStore(config.PushTTL)
+		source = prometheus.Gatherers{source, s.pushes}
+	}
+	s.relabel, _ = compileRelabel(config.Relabel) // Checked by validate
+	s.gather = newGatherCoordinator(s.relabeled(source), config.GatherTimeout, s.snapshotMaxAge(config.TickerInterval))
+
+	// Time the collectors of this server alone, so that other servers in the
+	// process do not see them
+	names := make([]string, 0, len(config.TimedCollectors))
+	for name := range config.TimedCollectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		timed := &timedCollector{Collector: config.TimedCollectors[name], name: name, timings: s.gather.timings}
+		if err := config.Registry.Register(timed); err != nil {
+			return nil, fmt.Errorf("registering timed collector %q: %w", name, err)
+		}
+	}
+
+	// Offer the binary feed ahead of JSON to clients that support both
+	if config.BinaryEncoding {
+		s.upgrader.Subprotocols = []string{subprotocolCBOR, subprotocolJSON}
+	}
+
+	// Set up self-instrumentation if enabled
+	if config.SelfMetrics {
+		s.metrics = newSelfMetrics(hub, s.gather.timings)
+		hub.metrics = s.metrics
+		s.gather.metrics = s.metrics
+	}
+
+	// Forward gathered samples to a remote_write receiver if configured
+	if config.RemoteWriteTo != nil {
+		s.forward = newRemoteWriter(*config.RemoteWriteTo, s.logger, s.metrics)
+		hub.gatherDefault = true
+		go s.forward.run(s.ctx)
+		go s.forwardMetrics()
 	}
 
 	// Set up static file serving
@@ -61,26 +181,51 @@ func newServer(config *Config) (*Server, error) {
 		staticFS = embeddedFiles
 	}
 
-	// Set the dashboard configuration
-	if config.Dashboard != nil {
-		s.dashboard = config.Dashboard
-	}
-
 	// Set up routes
 	s.setupRoutes(staticFS)
 
 	// Start metrics broadcaster
 	go s.broadcastMetrics()
 
+	// Pick up config file changes without a restart
+	if config.ConfigFile != "" {
+		go s.watchConfig()
+	}
+
 	return s, nil
 }
 
+// relabeled applies the relabel rules to everything source gathers. The
+// rules are read on every gather so that config file changes apply to the
+// next one.
+func (s *Server) relabeled(source prometheus.Gatherer) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		mfs, err := source.Gather()
+		s.liveMu.RLock()
+		rules := s.relabel
+		s.liveMu.RUnlock()
+		return relabelFamilies(mfs, rules), err
+	})
+}
+
+// Close stops the server's background work: the metrics broadcaster, the
+// config file watcher and remote_write forwarding, dropping samples not sent
+// yet. It does not close connections, which is up to the http.Server
+// serving it.
+func (s *Server) Close() error {
+	s.stop()
+	return nil
+}
+
 // ServeHTTP implements the http.Handler interface.
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Apply basic auth if configured
-	if s.config.BasicAuth != nil {
+	s.liveMu.RLock()
+	auth := s.auth
+	s.liveMu.RUnlock()
+	if auth != nil {
 		user, pass, ok := r.BasicAuth()
-		if !ok || user != s.config.BasicAuth.Username || pass != s.config.BasicAuth.Password {
+		if !ok || user != auth.Username || pass != auth.Password {
 			w.Header().Set("WWW-Authenticate", `Basic realm="Restricted"`)
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
@@ -97,38 +242,101 @@ func (s *Server) setupRoutes(staticFS fs.FS) {
 	prefix = strings.TrimSuffix(prefix, "/")
 
 	// Metrics endpoint using promhttp
-	s.mux.Handle(prefix+"/metrics", http.StripPrefix(prefix, promhttp.HandlerFor(
-		s.config.Registry,
+	s.handle("metrics", prefix+"/metrics", http.StripPrefix(prefix, promhttp.HandlerFor(
+		s.gatherer(),
 		promhttp.HandlerOpts{
 			EnableOpenMetrics: true,
 		},
 	)))
 
 	// WebSocket endpoint
-	s.mux.HandleFunc(prefix+"/ws", func(w http.ResponseWriter, r *http.Request) {
+	s.handleFunc("ws", prefix+"/ws", func(w http.ResponseWriter, r *http.Request) {
+		// Reserve a connection slot before upgrading so over-quota clients get a plain HTTP error
+		lease := s.admit(w, r, "ws")
+		if lease == nil {
+			return
+		}
+
 		// trim the prefix
 		conn, err := s.upgrader.Upgrade(w, r, nil)
 		if err != nil {
-			log.Printf("Error upgrading connection: %v", err)
+			s.hub.release(lease)
+			s.logger.Warn("WebSocket upgrade failed", "route", "ws", "remote", r.RemoteAddr, "error", err)
 			return
 		}
-		s.hub.ServeWebSocket(conn)
+
+		// Reconnecting clients pass the last snapshot they saw so missed ticks can be replayed
+		s.hub.serveClient(conn, lease, resumeFrom(r), intervalFrom(r))
 	})
 
+	// Server-Sent Events fallback for proxies that strip WebSocket upgrades
+	s.handleFunc("events", prefix+"/events", func(w http.ResponseWriter, r *http.Request) {
+		lease := s.admit(w, r, "events")
+		if lease == nil {
+			return
+		}
+		s.hub.serveEvents(w, r, lease, resumeFrom(r), intervalFrom(r))
+	})
+
+	// Latest snapshot for clients that can only poll
+	s.handleFunc("snapshot", prefix+"/api/snapshot", func(w http.ResponseWriter, r *http.Request) {
+		if !s.admitPoll(w, r) {
+			return
+		}
+		latest := s.hub.latest()
+		if latest == nil {
+			// Nothing has been gathered yet
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		// Pollers pass the last snapshot they saw and get nothing until there is a newer one
+		if resume := resumeFrom(r); resume != nil && resume.epoch == s.hub.epoch && resume.seq >= latest.seq {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Write(latest.data)
+	})
+
+	// Prometheus remote_write receiver
+	if s.pushed != nil {
+		s.handleFunc("write", prefix+"/api/v1/write", s.receiveRemoteWrite)
+	}
+
+	// Pushgateway API for short-lived jobs
+	if s.pushes != nil {
+		s.handleFunc("push", prefix+"/metrics/", s.servePush(prefix+"/metrics"))
+	}
+
 	// Dashboard configuration endpoint
-	s.mux.HandleFunc(prefix+"/dashboard", func(w http.ResponseWriter, r *http.Request) {
+	s.handleFunc("dashboard", prefix+"/dashboard", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		// trim the prefix
 		r.URL.Path = strings.TrimPrefix(r.URL.Path, prefix)
 		r.URL.RawPath = strings.TrimPrefix(r.URL.RawPath, prefix)
 		// If no dashboard is configured, create a default layout
+		s.liveMu.RLock()
 		dashboard := s.dashboard
+		s.liveMu.RUnlock()
 		if dashboard == nil {
 			// Create a default dashboard with all metrics in separate rows
-			metrics, err := s.collectMetrics()
-			if err == nil {
+			metrics, _ := s.collectMetrics()
+			if len(metrics) > 0 {
 				dashboard = make([][]interface{}, 0, len(metrics))
+				seen := make(map[string]bool)
 				for _, metric := range metrics {
+					// Internal metrics get their own section below
+					if s.metrics != nil && strings.HasPrefix(metric.Name, "prommy_") {
+						continue
+					}
+					// Scraped and federated metrics repeat once per instance
+					if seen[metric.Name] {
+						continue
+					}
+					seen[metric.Name] = true
+
 					// For default dashboard, extract a better short name based on metric type
 					shortName := metric.Name
 					if strings.HasSuffix(metric.Name, "_bytes") {
@@ -161,14 +369,40 @@ func (s *Server) setupRoutes(staticFS fs.FS) {
 			}
 		}
 
+		// Show prommy's own metrics in a separate section when enabled
+		if section := s.metrics.dashboardSection(); section != nil {
+			dashboard = append(dashboard[:len(dashboard):len(dashboard)], section...)
+		}
+
 		// Marshal and send the dashboard layout
 		if err := json.NewEncoder(w).Encode(dashboard); err != nil {
 			http.Error(w, "Error encoding dashboard", http.StatusInternalServerError)
 		}
 	})
 
+	// Errors from the most recent gather
+	s.handleFunc("errors", prefix+"/api/errors", func(w http.ResponseWriter, r *http.Request) {
+		s.errMu.Lock()
+		resp := struct {
+			Timestamp int64         `json:"ts"`
+			Errors    []GatherError `json:"errors"`
+		}{
+			Timestamp: s.lastGather.UnixMilli(),
+			Errors:    s.lastErrors,
+		}
+		s.errMu.Unlock()
+		if resp.Errors == nil {
+			resp.Errors = []GatherError{}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			http.Error(w, "Error encoding errors", http.StatusInternalServerError)
+		}
+	})
+
 	// Handle tailwind.css file
-	s.mux.HandleFunc(prefix+"/tailwind.css", func(w http.ResponseWriter, r *http.Request) {
+	s.handleFunc("tailwind", prefix+"/tailwind.css", func(w http.ResponseWriter, r *http.Request) {
 		// Check if Tailwind CSS is embedded in this build
 		if IsTailwindEmbedded() {
 			// Serve the embedded gzipped file
@@ -185,7 +419,7 @@ func (s *Server) setupRoutes(staticFS fs.FS) {
 				file, err := tailwindFS.Open("static/tailwind.css.gz")
 				if err != nil {
 					// If something went wrong with embedded file, redirect to CDN
-					log.Printf("Error opening embedded tailwind.css.gz: %v", err)
+					s.logger.Error("Error opening embedded tailwind.css.gz", "route", "tailwind", "error", err)
 					http.Redirect(w, r, "https://cdn.tailwindcss.com", http.StatusTemporaryRedirect)
 					return
 				}
@@ -195,7 +429,7 @@ func (s *Server) setupRoutes(staticFS fs.FS) {
 				stat, err := file.Stat()
 				if err != nil {
 					// If something went wrong, redirect to CDN
-					log.Printf("Error reading embedded tailwind.css.gz stats: %v", err)
+					s.logger.Error("Error reading embedded tailwind.css.gz stats", "route", "tailwind", "error", err)
 					http.Redirect(w, r, "https://cdn.tailwindcss.com", http.StatusTemporaryRedirect)
 					return
 				}
@@ -218,38 +452,300 @@ func (s *Server) setupRoutes(staticFS fs.FS) {
 	})
 
 	// Static files
-	s.mux.Handle(prefix+"/", http.StripPrefix(prefix, http.FileServer(http.FS(staticFS))))
+	s.handle("static", prefix+"/", http.StripPrefix(prefix, http.FileServer(http.FS(staticFS))))
+}
+
+// admit reserves a connection slot for a client on route. If a limit is
+// hit it replies with 503 and a Retry-After hint and returns nil.
+func (s *Server) admit(w http.ResponseWriter, r *http.Request, route string) *connLease {
+	s.expirePollers()
+	user, _, _ := r.BasicAuth()
+	lease, limit := s.hub.admit(remoteIP(r), user)
+	if lease == nil {
+		s.logger.Info("Connection refused", "route", route, "remote", r.RemoteAddr, "limit", limit)
+		w.Header().Set("Retry-After", strconv.Itoa(int(connectionRetryAfter.Seconds())))
+		http.Error(w, "Too many connections ("+limit+" limit), try again later", http.StatusServiceUnavailable)
+	}
+	return lease
+}
+
+// admitPoll holds a connection slot for a client polling /api/snapshot, so
+// pollers count against the same limits as streaming clients. Pollers are
+// told apart by address, user and the client query parameter the dashboard
+// sends, and keep their slot until they have not polled for two of their
+// update intervals. It reports false if the poll was refused.
+func (s *Server) admitPoll(w http.ResponseWriter, r *http.Request) bool {
+	user, _, _ := r.BasicAuth()
+	client := r.URL.Query().Get("client")
+	if len(client) > maxPollClientID {
+		client = client[:maxPollClientID]
+	}
+	key := remoteIP(r) + "\x00" + user + "\x00" + client
+	expires := time.Now().Add(2*s.hub.intervalFor(intervalFrom(r)) + pollGrace)
+
+	s.pollMu.Lock()
+	poller, ok := s.pollers[key]
+	if ok {
+		poller.expires = expires
+	}
+	s.pollMu.Unlock()
+	if ok {
+		return true
+	}
+
+	lease := s.admit(w, r, "snapshot")
+	if lease == nil {
+		return false
+	}
+	s.pollMu.Lock()
+	defer s.pollMu.Unlock()
+	if poller, ok := s.pollers[key]; ok {
+		// A concurrent poll of the same client got a slot first
+		poller.expires = expires
+		s.hub.release(lease)
+		return true
+	}
+	s.pollers[key] = &pollLease{lease: lease, expires: expires}
+	return true
+}
+
+// expirePollers releases the slots of clients that stopped polling.
+func (s *Server) expirePollers() {
+	now := time.Now()
+	s.pollMu.Lock()
+	defer s.pollMu.Unlock()
+	for key, poller := range s.pollers {
+		if now.After(poller.expires) {
+			delete(s.pollers, key)
+			s.hub.release(poller.lease)
+		}
+	}
+}
+
+// resumeFrom returns the last snapshot a reconnecting client has seen, taken
+// from the since and epoch query parameters or, for EventSource clients,
+// the Last-Event-ID header. It returns nil for fresh clients.
+func resumeFrom(r *http.Request) *resumePoint {
+	query := r.URL.Query()
+	if since, err := strconv.ParseUint(query.Get("since"), 10, 64); err == nil {
+		return &resumePoint{epoch: query.Get("epoch"), seq: since}
+	}
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		epoch, seq, ok := strings.Cut(id, ":")
+		if since, err := strconv.ParseUint(seq, 10, 64); ok && err == nil {
+			return &resumePoint{epoch: epoch, seq: since}
+		}
+	}
+	return nil
+}
+
+// intervalFrom returns the update interval requested through the interval
+// query parameter in milliseconds, or zero for the default.
+func intervalFrom(r *http.Request) time.Duration {
+	ms, err := strconv.ParseInt(r.URL.Query().Get("interval"), 10, 64)
+	if err != nil || ms <= 0 {
+		return 0
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// handle registers handler for pattern, counting its requests under route.
+func (s *Server) handle(route, pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, s.metrics.instrumentRoute(route, handler))
+}
+
+// handleFunc registers a handler function for pattern, counting its requests under route.
+func (s *Server) handleFunc(route, pattern string, handler http.HandlerFunc) {
+	s.handle(route, pattern, handler)
 }
 
 // broadcastMetrics periodically collects metrics and broadcasts them to connected clients.
 func (s *Server) broadcastMetrics() {
-	ticker := time.NewTicker(s.config.TickerInterval)
+	interval := s.hub.updateGatherInterval()
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
-	for range ticker.C {
-		metrics, err := s.collectMetrics()
-		if err != nil {
-			log.Printf("Error collecting metrics: %v", err)
+	// Reused across ticks to avoid re-encoding unchanged label sets
+	encoder := newMetricEncoder()
+	var binaryEncoder *binaryEncoder
+	if s.config.BinaryEncoding {
+		binaryEncoder = newBinaryEncoder()
+	}
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		case <-s.hub.intervalChanged:
+			// Gather only as often as the fastest client needs
+			if d := s.hub.updateGatherInterval(); d != interval {
+				interval = d
+				ticker.Reset(d)
+				s.gather.setMaxAge(s.snapshotMaxAge(d))
+			}
 			continue
 		}
 
-		jsonData, err := json.Marshal(metrics)
-		if err != nil {
-			log.Printf("Error marshaling metrics: %v", err)
+		start := time.Now()
+		// Gather errors still come with partial results, so report them and send what we have
+		mfs, at, err := s.gatherSnapshot()
+		gatherErrs := gatherErrors(err)
+		s.recordGatherErrors(start, gatherErrs)
+		if s.forward != nil && !at.IsZero() {
+			s.latestMu.Lock()
+			s.latest = &gatherResult{mfs: mfs, at: at}
+			s.latestMu.Unlock()
+		}
+
+		jsonData, series := encoder.encode(mfs)
+		s.metrics.observeTick(time.Since(start), series, len(jsonData))
+
+		t := &tick{json: jsonData, errors: gatherErrs}
+		if binaryEncoder != nil {
+			t.cbor = binaryEncoder.encode(mfs)
+		}
+		s.hub.publish(t)
+	}
+}
+
+// forwardMetrics queues the broadcaster's latest gather for remote_write on
+// a ticker of its own at the default interval, however often dashboard
+// clients are updated. It never gathers itself, so forwarding adds no load
+// on collectors or scrape targets; the broadcaster gathers at least this
+// often while forwarding is enabled. A gather already queued, such as one
+// served again by the snapshot cache, is skipped so that no sample is sent
+// twice, and slow gathers replaced by an earlier snapshot are never sent.
+func (s *Server) forwardMetrics() {
+	interval := s.defaultInterval()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var last time.Time
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		// Follow interval changes from config file reloads
+		if d := s.defaultInterval(); d != interval {
+			interval = d
+			ticker.Reset(d)
+		}
+
+		s.latestMu.Lock()
+		latest := s.latest
+		s.latestMu.Unlock()
+		if latest == nil || !latest.at.After(last) {
 			continue
 		}
+		last = latest.at
+		s.forward.enqueue(latest.mfs, latest.at)
+	}
+}
 
-		s.hub.Broadcast(jsonData)
+// defaultInterval returns the update interval of clients that did not
+// request one.
+func (s *Server) defaultInterval() time.Duration {
+	s.liveMu.RLock()
+	defer s.liveMu.RUnlock()
+	return s.interval
+}
+
+// snapshotMaxAge returns the snapshot cache lifetime for ticks every
+// interval. A cache as old as a tick would make the next tick reuse the
+// previous snapshot, so it is capped at half the interval.
+func (s *Server) snapshotMaxAge(interval time.Duration) time.Duration {
+	return min(s.config.SnapshotMaxAge, interval/2)
+}
+
+// gatherSnapshot gathers like gatherer and also returns when the registry
+// was gathered, which is zero if a slow gather was replaced by an earlier
+// snapshot.
+func (s *Server) gatherSnapshot() ([]*dto.MetricFamily, time.Time, error) {
+	var at time.Time
+	var registry prometheus.Gatherer = prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		mfs, gathered, err := s.gather.snapshot()
+		at = gathered
+		return mfs, err
+	})
+	if s.metrics != nil {
+		registry = prometheus.Gatherers{registry, s.metrics.registry}
 	}
+	mfs, err := registry.Gather()
+	return mfs, at, err
 }
 
-// collectMetrics collects metrics from the Prometheus registry.
-func (s *Server) collectMetrics() ([]Metric, error) {
-	mfs, err := s.config.Registry.Gather()
+// gatherer returns the source of metric families for /metrics and the
+// dashboard feed: the configured registry plus prommy's own metrics when enabled.
+// Internal metrics bypass the coordinator so they stay fresh while a slow
+// gather is in flight.
+func (s *Server) gatherer() prometheus.Gatherer {
+	var registry prometheus.Gatherer = s.config.Registry
+	if s.gather != nil {
+		registry = s.gather
+	}
+	if s.metrics == nil {
+		return registry
+	}
+	return prometheus.Gatherers{registry, s.metrics.registry}
+}
+
+// remoteIP returns the IP address of the client that sent r.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
-		return nil, fmt.Errorf("error gathering metrics: %w", err)
+		return r.RemoteAddr
 	}
+	return host
+}
+
+// recordGatherErrors stores the outcome of a gather for /api/errors and logs new problems.
+func (s *Server) recordGatherErrors(at time.Time, errs []GatherError) {
+	s.errMu.Lock()
+	defer s.errMu.Unlock()
+
+	// Only log when the set of problems changes to avoid flooding the log every tick
+	if !equalGatherErrors(s.lastErrors, errs) {
+		for _, e := range errs {
+			s.logger.Warn("Error gathering metrics", "kind", e.Kind, "collector", e.Collector, "error", e.Message)
+		}
+	}
+	for _, e := range errs {
+		s.metrics.gatherError(e.Kind)
+	}
+	s.lastErrors = errs
+	s.lastGather = at
+}
+
+// equalGatherErrors reports whether a and b describe the same problems.
+func equalGatherErrors(a, b []GatherError) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// collectMetrics collects metrics from the Prometheus registry.
+// Gather reports problems alongside whatever it could collect, so the
+// partial result is returned together with the classified errors.
+func (s *Server) collectMetrics() ([]Metric, []GatherError) {
+	mfs, err := s.gatherer().Gather()
+	return convertMetrics(mfs), gatherErrors(err)
+}
 
+// convertMetrics flattens metric families into one Metric per series.
+// Summaries and histograms become a _count series, one _bucket series per
+// histogram bucket and a series carrying the sum under the family name.
+// The dashboard feed uses metricEncoder, which produces the same document
+// without building the intermediate slice.
+func convertMetrics(mfs []*dto.MetricFamily) []Metric {
 	var metrics []Metric
 
 	for _, mf := range mfs {
@@ -327,7 +823,7 @@ func (s *Server) collectMetrics() ([]Metric, error) {
 		}
 	}
 
-	return metrics, nil
+	return metrics
 }
 
 // metricTypeToString converts a Prometheus metric type to a string representation.
@@ -0,0 +1,640 @@
+package prommy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// newTestServer starts a prommy server with a fresh registry and the given options.
+func newTestServer(t *testing.T, opts ...Option) (*Server, *httptest.Server) {
+	t.Helper()
+	cfg := &Config{
+		Registry:       prometheus.NewRegistry(),
+		TickerInterval: time.Hour,
+	}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	s, err := newServer(cfg)
+	if err != nil {
+		t.Fatalf("newServer: %v", err)
+	}
+	srv := httptest.NewServer(s)
+	t.Cleanup(func() {
+		srv.Close()
+		s.Close()
+	})
+	return s, srv
+}
+
+func TestWebSocketConnectionLimit(t *testing.T) {
+	_, srv := newTestServer(t, WithMaxConnections(1), WithSelfMetrics())
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("first dial: %v", err)
+	}
+	defer conn.Close()
+
+	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	if err == nil {
+		t.Fatal("second dial succeeded, want rejection")
+	}
+	if resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("second dial response = %v, want 503", resp)
+	}
+	if resp.Header.Get("Retry-After") == "" {
+		t.Error("rejection is missing Retry-After")
+	}
+
+	resp, err = http.Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("GET /metrics: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	for _, want := range []string{
+		`prommy_connections_rejected_total{limit="global"} 1`,
+		`prommy_connections_accepted_total 1`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("/metrics is missing %q", want)
+		}
+	}
+}
+
+func TestPollingConnectionLimit(t *testing.T) {
+	s, srv := newTestServer(t, WithMaxConnections(1))
+	poll := func(client string) int {
+		t.Helper()
+		resp, err := http.Get(srv.URL + "/api/snapshot?client=" + client)
+		if err != nil {
+			t.Fatalf("GET /api/snapshot: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// A poller holds its slot between polls
+	if status := poll("a"); status != http.StatusNoContent {
+		t.Fatalf("first poll status = %d, want 204", status)
+	}
+	if status := poll("a"); status != http.StatusNoContent {
+		t.Errorf("repeated poll status = %d, want 204", status)
+	}
+	if status := poll("b"); status != http.StatusServiceUnavailable {
+		t.Errorf("second poller status = %d, want 503", status)
+	}
+	_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", nil)
+	if err == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("dial while a poller holds the slot: %v, want 503", err)
+	}
+
+	// and releases it once it stops polling
+	s.pollMu.Lock()
+	for _, poller := range s.pollers {
+		poller.expires = time.Now().Add(-time.Second)
+	}
+	s.pollMu.Unlock()
+	if status := poll("b"); status != http.StatusNoContent {
+		t.Errorf("poll after the first poller expired status = %d, want 204", status)
+	}
+}
+
+func TestSelfMetrics(t *testing.T) {
+	s, srv := newTestServer(t, WithSelfMetrics(), WithDashboardStrings([][]string{{"app_metric"}}))
+
+	// Simulate one tick so the gather metrics have values
+	s.metrics.observeTick(3*time.Millisecond, 7, 512)
+
+	resp, err := http.Get(srv.URL + "/dashboard")
+	if err != nil {
+		t.Fatalf("GET /dashboard: %v", err)
+	}
+	var raw [][]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&raw); err != nil {
+		t.Fatalf("decode dashboard: %v", err)
+	}
+	resp.Body.Close()
+	if len(raw) != 3 {
+		t.Fatalf("dashboard rows = %d, want configured row plus 2 internals rows", len(raw))
+	}
+	if item, ok := raw[1][0].(map[string]interface{}); !ok || item["section"] != internalsSection {
+		t.Errorf("internals row starts with %v, want section %q", raw[1][0], internalsSection)
+	}
+
+	resp, err = http.Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("GET /metrics: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	for _, want := range []string{
+		`prommy_http_requests_total{code="200",route="dashboard"} 1`,
+		`prommy_series 7`,
+		`prommy_broadcast_payload_bytes 512`,
+		`prommy_gather_duration_seconds_count 1`,
+		`prommy_clients 0`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("/metrics is missing %q", want)
+		}
+	}
+}
+
+func TestSelfMetricsDisabled(t *testing.T) {
+	_, srv := newTestServer(t)
+
+	resp, err := http.Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("GET /metrics: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if strings.Contains(string(body), "prommy_") {
+		t.Errorf("/metrics exposes internal metrics without WithSelfMetrics:\n%s", body)
+	}
+}
+
+// failingCollector reports one good gauge and one invalid metric.
+type failingCollector struct {
+	good *prometheus.Desc
+	bad  *prometheus.Desc
+}
+
+func newFailingCollector() *failingCollector {
+	return &failingCollector{
+		good: prometheus.NewDesc("test_good", "A healthy metric.", nil, nil),
+		bad:  prometheus.NewDesc("test_db_rows", "A metric whose collection fails.", nil, nil),
+	}
+}
+
+func (c *failingCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.good
+	ch <- c.bad
+}
+
+func (c *failingCollector) Collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(c.good, prometheus.GaugeValue, 1)
+	ch <- prometheus.NewInvalidMetric(c.bad, errors.New("database unavailable"))
+}
+
+func TestCollectMetricsKeepsPartialResults(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(newFailingCollector())
+
+	// A second registry exposing the same series simulates a duplicate registration
+	dup := prometheus.NewRegistry()
+	dup.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{Name: "test_good", Help: "A healthy metric."}, func() float64 { return 2 }))
+
+	s := &Server{config: &Config{Registry: reg}}
+	metrics, errs := s.collectMetrics()
+	if len(metrics) != 1 || metrics[0].Name != "test_good" {
+		t.Errorf("partial metrics = %+v, want test_good", metrics)
+	}
+	if len(errs) != 1 {
+		t.Fatalf("errors = %+v, want one collector error", errs)
+	}
+	if errs[0].Kind != GatherErrorCollector || errs[0].Collector != "test_db_rows" {
+		t.Errorf("error = %+v, want collector error for test_db_rows", errs[0])
+	}
+	if !strings.Contains(errs[0].Message, "database unavailable") {
+		t.Errorf("message %q does not contain the collector error", errs[0].Message)
+	}
+
+	_, err := prometheus.Gatherers{reg, dup}.Gather()
+	var dupErr *GatherError
+	for _, e := range gatherErrors(err) {
+		if e.Kind == GatherErrorDuplicate {
+			dupErr = &e
+		}
+	}
+	if dupErr == nil || dupErr.Collector != "test_good" {
+		t.Errorf("gather errors %q do not report test_good as duplicate", err)
+	}
+}
+
+func TestGatherErrorsEndpointAndEnvelope(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(newFailingCollector())
+	_, srv := newTestServer(t, WithRegistry(reg), WithTickerInterval(10*time.Millisecond))
+
+	dialer := websocket.Dialer{Subprotocols: []string{subprotocolJSON}}
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	var env struct {
+		Metrics []Metric      `json:"metrics"`
+		Errors  []GatherError `json:"errors"`
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if err := conn.ReadJSON(&env); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if len(env.Metrics) != 1 {
+		t.Errorf("envelope metrics = %+v, want the partial result", env.Metrics)
+	}
+	if len(env.Errors) != 1 || env.Errors[0].Collector != "test_db_rows" {
+		t.Errorf("envelope errors = %+v, want test_db_rows", env.Errors)
+	}
+
+	resp, err := http.Get(srv.URL + "/api/errors")
+	if err != nil {
+		t.Fatalf("GET /api/errors: %v", err)
+	}
+	defer resp.Body.Close()
+	var body struct {
+		Errors []GatherError `json:"errors"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(body.Errors) != 1 || body.Errors[0].Kind != GatherErrorCollector {
+		t.Errorf("/api/errors = %+v, want one collector error", body.Errors)
+	}
+}
+
+func TestSnapshotCacheSharesGather(t *testing.T) {
+	counting := newBlockingCollector()
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(counting)
+	s, srv := newTestServer(t, WithRegistry(reg), WithTickerInterval(time.Hour), WithSnapshotCache(time.Minute))
+
+	// A dashboard tick gathers once...
+	if metrics, _ := s.collectMetrics(); len(metrics) != 1 {
+		t.Fatalf("tick collected %d metrics, want 1", len(metrics))
+	}
+
+	// ...and scrapes in either format reuse it
+	tests := []struct {
+		accept      string
+		contentType string
+		body        string
+	}{
+		{accept: "", contentType: "text/plain; version=0.0.4", body: "test_slow_query_rows 42"},
+		{accept: "application/openmetrics-text; version=1.0.0", contentType: "application/openmetrics-text", body: "# EOF"},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/metrics", nil)
+		if tt.accept != "" {
+			req.Header.Set("Accept", tt.accept)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET /metrics: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, tt.contentType) {
+			t.Errorf("Accept %q: Content-Type = %q, want %q", tt.accept, ct, tt.contentType)
+		}
+		if !strings.Contains(string(body), tt.body) {
+			t.Errorf("Accept %q: body is missing %q:\n%s", tt.accept, tt.body, body)
+		}
+	}
+
+	if calls := counting.calls.Load(); calls != 1 {
+		t.Errorf("registry gathered %d times, want 1 shared gather", calls)
+	}
+}
+
+func TestBinaryEncodingNegotiation(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     []Option
+		offer    []string
+		protocol string
+		msgType  int
+	}{
+		{"default", nil, nil, "", websocket.TextMessage},
+		{"json", []Option{WithBinaryEncoding()}, []string{subprotocolJSON}, subprotocolJSON, websocket.TextMessage},
+		{"cbor", []Option{WithBinaryEncoding()}, []string{subprotocolCBOR, subprotocolJSON}, subprotocolCBOR, websocket.BinaryMessage},
+		{"cbor disabled", nil, []string{subprotocolCBOR, subprotocolJSON}, subprotocolJSON, websocket.TextMessage},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg := prometheus.NewRegistry()
+			reg.MustRegister(prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_gauge"}))
+			opts := append([]Option{WithRegistry(reg), WithTickerInterval(10 * time.Millisecond)}, tt.opts...)
+			_, srv := newTestServer(t, opts...)
+
+			dialer := websocket.Dialer{Subprotocols: tt.offer}
+			conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", nil)
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			defer conn.Close()
+			if got := conn.Subprotocol(); got != tt.protocol {
+				t.Errorf("subprotocol = %q, want %q", got, tt.protocol)
+			}
+
+			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			msgType, data, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatalf("read: %v", err)
+			}
+			if msgType != tt.msgType {
+				t.Fatalf("message type = %d, want %d", msgType, tt.msgType)
+			}
+			if msgType == websocket.BinaryMessage {
+				fields := decodeTestCBOR(t, data).([]interface{})
+				metrics := decodeTestMetrics(fields[6].([]interface{}), fields[7].([]interface{}))
+				if len(metrics) != 1 || metrics[0].Name != "test_gauge" {
+					t.Errorf("binary metrics = %+v, want test_gauge", metrics)
+				}
+			}
+		})
+	}
+}
+
+func TestWebSocketBareArray(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_gauge"}))
+	_, srv := newTestServer(t, WithRegistry(reg), WithTickerInterval(10*time.Millisecond))
+
+	// Clients written before the envelope existed ask for no subprotocol
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	var metrics []Metric
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if err := conn.ReadJSON(&metrics); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if len(metrics) != 1 || metrics[0].Name != "test_gauge" {
+		t.Errorf("metrics = %+v, want test_gauge", metrics)
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	_, srv := newTestServer(t, WithTickerInterval(10*time.Millisecond), WithBasicAuth("admin", "secret"))
+
+	resp, err := http.Get(srv.URL + "/events")
+	if err != nil {
+		t.Fatalf("GET /events: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("unauthenticated /events = %d, want 401", resp.StatusCode)
+	}
+
+	// readEvent opens the stream and returns the id and envelope of its first event
+	readEvent := func(lastEventID string) (string, testEnvelope) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/events", nil)
+		req.SetBasicAuth("admin", "secret")
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET /events: %v", err)
+		}
+		defer resp.Body.Close()
+		if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+			t.Fatalf("Content-Type = %q, want text/event-stream", ct)
+		}
+
+		var id string
+		scanner := bufio.NewScanner(resp.Body)
+		scanner.Buffer(nil, 1<<20)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if v, ok := strings.CutPrefix(line, "id: "); ok {
+				id = v
+			}
+			if v, ok := strings.CutPrefix(line, "data: "); ok {
+				var env testEnvelope
+				if err := json.Unmarshal([]byte(v), &env); err != nil {
+					t.Fatalf("unmarshal %q: %v", v, err)
+				}
+				return id, env
+			}
+		}
+		t.Fatalf("stream ended without an event: %v", scanner.Err())
+		return "", testEnvelope{}
+	}
+
+	id, env := readEvent("")
+	if want := env.Epoch + ":" + strconv.FormatUint(env.Seq, 10); id != want {
+		t.Errorf("event id = %q, want %q", id, want)
+	}
+
+	// Resuming through Last-Event-ID continues after the acknowledged snapshot
+	_, next := readEvent(id)
+	if next.Seq != env.Seq+1 || next.Resync {
+		t.Errorf("resumed event seq = %d resync = %v, want %d without resync", next.Seq, next.Resync, env.Seq+1)
+	}
+}
+
+func TestEventStreamMultilinePayload(t *testing.T) {
+	rec := httptest.NewRecorder()
+	transport := &sseTransport{w: rec, flusher: rec, epoch: "e"}
+	f := newFrame(websocket.TextMessage, []byte("{\n\"a\": 1,\r\n\"b\": 2\r}"))
+	f.seq = 3
+	if err := transport.write(f); err != nil {
+		t.Fatal(err)
+	}
+	want := "id: e:3\ndata: {\ndata: \"a\": 1,\ndata: \"b\": 2\ndata: }\n\n"
+	if got := rec.Body.String(); got != want {
+		t.Errorf("event = %q, want %q", got, want)
+	}
+}
+
+func TestSnapshotEndpoint(t *testing.T) {
+	s, srv := newTestServer(t)
+
+	get := func(query string) (int, []byte) {
+		t.Helper()
+		resp, err := http.Get(srv.URL + "/api/snapshot" + query)
+		if err != nil {
+			t.Fatalf("GET /api/snapshot: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, body
+	}
+
+	if code, _ := get(""); code != http.StatusNoContent {
+		t.Errorf("before the first tick: status %d, want 204", code)
+	}
+
+	s.hub.Broadcast([]byte(`[{"name":"up","type":"gauge","value":1}]`))
+	code, body := get("")
+	if code != http.StatusOK {
+		t.Fatalf("status %d, want 200", code)
+	}
+	var env testEnvelope
+	if err := json.Unmarshal(body, &env); err != nil {
+		t.Fatalf("unmarshal %q: %v", body, err)
+	}
+	if env.Seq != 1 || string(env.Metrics) != `[{"name":"up","type":"gauge","value":1}]` {
+		t.Errorf("snapshot = %s", body)
+	}
+
+	if code, _ := get("?since=1&epoch=" + env.Epoch); code != http.StatusNoContent {
+		t.Errorf("polling with the latest seq: status %d, want 204", code)
+	}
+	if code, _ := get("?since=1&epoch=other"); code != http.StatusOK {
+		t.Errorf("polling after a restart: status %d, want 200", code)
+	}
+}
+
+func TestPerClientIntervals(t *testing.T) {
+	counting := newBlockingCollector()
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(counting)
+	s, srv := newTestServer(t, WithRegistry(reg), WithIntervalBounds(10*time.Millisecond, time.Second))
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+
+	fast, _, err := websocket.DefaultDialer.Dial(url+"?interval=20", nil)
+	if err != nil {
+		t.Fatalf("dial fast: %v", err)
+	}
+	defer fast.Close()
+	slow, _, err := websocket.DefaultDialer.Dial(url+"?interval=200", nil)
+	if err != nil {
+		t.Fatalf("dial slow: %v", err)
+	}
+	defer slow.Close()
+
+	// Count frames for a fixed window on both connections
+	const window = time.Second
+	count := func(conn *websocket.Conn, n *int, wg *sync.WaitGroup) {
+		defer wg.Done()
+		conn.SetReadDeadline(time.Now().Add(window))
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+			*n++
+		}
+	}
+	var fastFrames, slowFrames int
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go count(fast, &fastFrames, &wg)
+	go count(slow, &slowFrames, &wg)
+	wg.Wait()
+
+	// The hour-long ticker would send nothing; the fast client drives the gathers
+	if fastFrames < 20 {
+		t.Errorf("fast client got %d frames in %v, want about 50", fastFrames, window)
+	}
+	if slowFrames < 3 || slowFrames > 7 {
+		t.Errorf("slow client got %d frames in %v, want about 5", slowFrames, window)
+	}
+	if gathers := int(counting.calls.Load()); gathers > fastFrames+3 {
+		t.Errorf("%d gathers for %d frames to the fastest client", gathers, fastFrames)
+	}
+
+	// Slowing the fast client down slows the gathers to the next fastest client
+	fast.SetReadDeadline(time.Time{})
+	if err := fast.WriteJSON(map[string]int{"interval": 1000}); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		s.hub.mu.Lock()
+		tick := s.hub.tickInterval
+		s.hub.mu.Unlock()
+		if tick == 200*time.Millisecond {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("gather interval = %v, want 200ms", tick)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil))
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(newFailingCollector())
+	_, srv := newTestServer(t,
+		WithRegistry(reg),
+		WithTickerInterval(10*time.Millisecond),
+		WithDashboardJSON(`[["unterminated"`),
+		WithLogger(logger),
+	)
+
+	// A plain GET cannot be upgraded
+	resp, err := http.Get(srv.URL + "/ws")
+	if err != nil {
+		t.Fatalf("GET /ws: %v", err)
+	}
+	resp.Body.Close()
+
+	// Wait for a tick to report the failing collector
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, _, err := conn.ReadMessage(); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	conn.Close()
+
+	records := map[string]map[string]interface{}{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var rec map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatalf("log line %q is not JSON: %v", line, err)
+		}
+		records[rec["msg"].(string)] = rec
+	}
+
+	if rec := records["Ignoring invalid option"]; rec == nil || rec["field"] != "Dashboard" {
+		t.Errorf("dashboard JSON error not logged: %v", rec)
+	}
+	if rec := records["WebSocket upgrade failed"]; rec == nil || rec["route"] != "ws" || rec["remote"] == nil {
+		t.Errorf("upgrade failure record = %v, want route and remote", rec)
+	}
+	if rec := records["Error gathering metrics"]; rec == nil || rec["collector"] != "test_db_rows" || rec["kind"] != string(GatherErrorCollector) {
+		t.Errorf("gather error record = %v, want collector and kind", rec)
+	}
+}
+
+func TestNopLogger(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	_, srv := newTestServer(t, WithNopLogger(), WithDashboardJSON(`{`))
+	resp, err := http.Get(srv.URL + "/ws")
+	if err != nil {
+		t.Fatalf("GET /ws: %v", err)
+	}
+	resp.Body.Close()
+
+	if buf.Len() > 0 {
+		t.Errorf("nop logger wrote to the standard logger: %s", buf.String())
+	}
+}
@@ -0,0 +1,107 @@
+package prommy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// sseTransport streams frames as Server-Sent Events, for clients behind
+// proxies that do not pass WebSocket upgrades. Every event carries the JSON
+// envelope and an id of the form "<epoch>:<seq>", so an EventSource that
+// reconnects on its own resumes through the Last-Event-ID header.
+type sseTransport struct {
+	w       io.Writer
+	flusher http.Flusher
+	epoch   string
+	head    []byte // Scratch space for the event header
+}
+
+// write sends one frame as an event and flushes it past any buffering.
+func (t *sseTransport) write(f *frame) error {
+	t.head = t.head[:0]
+	if f.seq > 0 {
+		// Announcements have no id so they do not move the resume point
+		t.head = append(t.head, "id: "...)
+		t.head = append(t.head, t.epoch...)
+		t.head = append(t.head, ':')
+		t.head = strconv.AppendUint(t.head, f.seq, 10)
+		t.head = append(t.head, '\n')
+	}
+	if _, err := t.w.Write(t.head); err != nil {
+		return err
+	}
+	// A line break would end the data field, so every line of the payload,
+	// which Hub.Broadcast callers may pass with line breaks, goes on a data
+	// line of its own and the client joins them back with newlines
+	data := f.data
+	for {
+		end := bytes.IndexAny(data, "\r\n")
+		line := data
+		if end >= 0 {
+			line = data[:end]
+		}
+		if _, err := io.WriteString(t.w, "data: "); err != nil {
+			return err
+		}
+		if _, err := t.w.Write(line); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(t.w, "\n"); err != nil {
+			return err
+		}
+		if end < 0 {
+			break
+		}
+		if bytes.HasPrefix(data[end:], []byte("\r\n")) {
+			end++
+		}
+		data = data[end+1:]
+	}
+	if _, err := io.WriteString(t.w, "\n"); err != nil {
+		return err
+	}
+	t.flusher.Flush()
+	return nil
+}
+
+// close does nothing; the stream ends when serveEvents returns.
+func (t *sseTransport) close() error {
+	return nil
+}
+
+// serveEvents streams JSON snapshots every interval, zero for the default,
+// to an EventSource client holding lease until the request ends or the hub
+// drops the client. Unlike WebSocket clients, the writer runs on the calling
+// goroutine because the response is finished as soon as the handler returns.
+func (h *Hub) serveEvents(w http.ResponseWriter, r *http.Request, lease *connLease, resume *resumePoint, interval time.Duration) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		h.release(lease)
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // Keep nginx from buffering the stream
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	client := newClient(h, &sseTransport{w: w, flusher: flusher, epoch: h.epoch}, resume)
+	client.log = client.log.With("transport", "sse", "remote", r.RemoteAddr)
+	client.lease = lease
+	client.requested = interval
+	h.register(client)
+
+	// An idle stream only notices a departed browser through the request context
+	stop := context.AfterFunc(r.Context(), func() {
+		h.unregister(client)
+	})
+	defer stop()
+
+	client.writePump()
+}
@@ -25,6 +25,7 @@ document.addEventListener('DOMContentLoaded', () => {
     const toggleTheme = document.getElementById('toggle-theme');
     const lightIcon = document.getElementById('light-icon');
     const darkIcon = document.getElementById('dark-icon');
+    const errorBanner = document.getElementById('error-banner');
     
     // State
     let isPaused = false;
@@ -34,9 +35,11 @@ document.addEventListener('DOMContentLoaded', () => {
     let allMetricNames = new Set(); // Store all unique metric names
     let filterText = '';
     let interval = parseInt(refreshInterval.value, 10);
+    let intervalChosen = false; // Until the slider is moved we follow the server's default
     let timeWindowMs = parseInt(timeWindow.value, 10);
     let dashboardLayout = [];
     let metricTiles = new Map(); // Maps metric name to tile element
+    let comparisonTiles = []; // Tiles comparing a metric across label values, see createComparisonTile
     let lastValues = new Map(); // Maps metric name to its last value for comparison
     let metricHistory = new Map(); // Maps metric name to array of {timestamp, value} objects
     let sortColumn = 'name'; // Default sort column
@@ -48,11 +51,25 @@ document.addEventListener('DOMContentLoaded', () => {
     // Constants for line graph
     const MAX_HISTORY_POINTS = 100; // Maximum number of points to store in history
     
-    // WebSocket setup
+    // Line colors of the series in a comparison tile, in order
+    const COMPARISON_COLORS = ['var(--blue-color)', 'var(--purple-color)', 'var(--green-color)', 'var(--yellow-color)', 'var(--red-color)'];
+    
+    // Connection setup
+    const transports = ['websocket', 'sse', 'poll']; // In order of preference
+    let transportIndex = 0; // Transport currently in use
+    let transportWorked = false; // Whether the current transport has ever delivered a snapshot
     let ws = null;
+    let eventSource = null;
+    let pollTimer = null;
     let reconnectTimer = null;
     let reconnectAttempts = 0;
     const maxReconnectAttempts = 5;
+    let lastSeq = null; // Sequence number of the last snapshot received
+    let serverEpoch = null; // Identifies the server instance that issued lastSeq
+    let snapshotTime = null; // Server timestamp of the snapshot being applied, in local clock
+    let clockOffset = Infinity; // Smallest observed (local - server) time, i.e. live delivery skew
+    let wireSchema = null; // Binary frame layout from protocol.json, null to use JSON only
+    const clientId = Math.random().toString(36).slice(2); // Tells this tab's polls apart from others behind the same address
     
     // Check if we're in compact mode
     const isCompactMode = () => window.matchMedia('(max-width: 512px)').matches;
@@ -124,81 +141,402 @@ document.addEventListener('DOMContentLoaded', () => {
         }
     }
     
-    // Initialize the WebSocket connection
-    function connectWebSocket() {
-        // Close existing connection if any
+    // Connect using the current transport, replacing any existing connection
+    function connect() {
+        closeTransport();
+        
+        switch (transports[transportIndex]) {
+            case 'websocket':
+                connectWebSocket();
+                break;
+            case 'sse':
+                connectEventSource();
+                break;
+            default:
+                startPolling();
+        }
+    }
+    
+    // Tear down the current connection without triggering a reconnect
+    function closeTransport() {
+        clearTimeout(reconnectTimer);
+        clearTimeout(pollTimer);
+        pollTimer = null;
         if (ws) {
-            ws.close();
+            const socket = ws;
+            ws = null;
+            socket.close();
+        }
+        if (eventSource) {
+            eventSource.close();
+            eventSource = null;
+        }
+    }
+    
+    // Build a URL for path carrying our update interval, and asking the server
+    // to replay snapshots missed while we were disconnected. Paths are relative
+    // to the page so that a server prefix is kept.
+    function streamUrl(path) {
+        const params = new URLSearchParams();
+        if (intervalChosen) {
+            params.set('interval', interval);
+        }
+        if (lastSeq !== null) {
+            params.set('since', lastSeq);
+            params.set('epoch', serverEpoch || '');
+        }
+        return `${path}?${params}`;
+    }
+    
+    // Show that the connection is up and fade the status out
+    function onTransportOpen() {
+        const name = transports[transportIndex];
+        showConnectionStatus(name === 'websocket' ? 'Connected' : `Connected (${name === 'sse' ? 'event stream' : 'polling'})`, 'bg-green');
+        setTimeout(() => {
+            connectionStatus.style.opacity = '0';
+        }, 2000);
+        reconnectAttempts = 0;
+    }
+    
+    // Handle a lost or refused connection
+    function handleDisconnect() {
+        // A transport that never delivered a snapshot is likely blocked by a proxy; try the next one
+        if (!transportWorked && transportIndex < transports.length - 1) {
+            transportIndex++;
+            reconnectAttempts = 0;
+            console.warn(`Falling back to ${transports[transportIndex]} transport`);
+            connect();
+            return;
         }
         
+        if (reconnectAttempts < maxReconnectAttempts) {
+            reconnectAttempts++;
+            const delay = Math.min(1000 * reconnectAttempts, 5000);
+            showConnectionStatus(`Reconnecting (${reconnectAttempts}/${maxReconnectAttempts})...`, 'bg-yellow');
+            
+            // Schedule reconnection
+            clearTimeout(reconnectTimer);
+            reconnectTimer = setTimeout(connect, delay);
+        } else {
+            showConnectionStatus('Connection failed. Refresh the page to retry.', 'bg-red');
+        }
+    }
+    
+    // Initialize the WebSocket connection
+    function connectWebSocket() {
         // Calculate WebSocket URL based on current location
-        const protocol = location.protocol === 'https:' ? 'wss' : 'ws';
-        const wsUrl = `${protocol}://${location.host}/ws`;
+        const wsUrl = new URL(streamUrl('ws'), location.href);
+        wsUrl.protocol = location.protocol === 'https:' ? 'wss:' : 'ws:';
+        
+        // Offer the binary encoding when its schema is available, unless #encoding=json asks for JSON
+        const hashParams = new URLSearchParams(window.location.hash.substring(1));
+        const protocols = wireSchema && hashParams.get('encoding') !== 'json' ?
+            [wireSchema.subprotocol, 'prommy.json'] : ['prommy.json'];
         
         // Create new WebSocket connection
-        ws = new WebSocket(wsUrl);
+        const socket = new WebSocket(wsUrl.href, protocols);
+        socket.binaryType = 'arraybuffer';
+        ws = socket;
         
         // Connection opened
-        ws.addEventListener('open', () => {
-            showConnectionStatus('Connected', 'bg-green');
-            setTimeout(() => {
-                connectionStatus.style.opacity = '0';
-            }, 2000);
-            reconnectAttempts = 0;
-        });
+        socket.addEventListener('open', onTransportOpen);
         
-        // Connection closed
-        ws.addEventListener('close', (event) => {
-            if (reconnectAttempts < maxReconnectAttempts) {
-                reconnectAttempts++;
-                const delay = Math.min(1000 * reconnectAttempts, 5000);
-                showConnectionStatus(`Reconnecting (${reconnectAttempts}/${maxReconnectAttempts})...`, 'bg-yellow');
-                
-                // Schedule reconnection
-                clearTimeout(reconnectTimer);
-                reconnectTimer = setTimeout(connectWebSocket, delay);
-            } else {
-                showConnectionStatus('Connection failed. Refresh the page to retry.', 'bg-red');
+        // Connection closed, ignored if we closed it ourselves
+        socket.addEventListener('close', () => {
+            if (ws === socket) {
+                ws = null;
+                handleDisconnect();
             }
         });
         
         // Handle errors
-        ws.addEventListener('error', (error) => {
+        socket.addEventListener('error', (error) => {
             console.error('WebSocket error:', error);
             showConnectionStatus('Connection error', 'bg-red');
         });
         
         // Handle incoming messages
-        ws.addEventListener('message', (event) => {
-            if (isPaused) return;
-            
+        socket.addEventListener('message', (event) => handleMessage(event.data));
+    }
+    
+    // Stream snapshots over Server-Sent Events when WebSockets are blocked
+    function connectEventSource() {
+        const source = new EventSource(streamUrl('events'));
+        eventSource = source;
+        
+        source.addEventListener('open', onTransportOpen);
+        source.addEventListener('message', (event) => handleMessage(event.data));
+        source.addEventListener('error', () => {
+            // Reconnect ourselves so the server replays from our last snapshot
+            if (eventSource === source) {
+                source.close();
+                eventSource = null;
+                handleDisconnect();
+            }
+        });
+    }
+    
+    // Poll for the latest snapshot when no streaming transport gets through
+    function startPolling() {
+        let failing = true;
+        const poll = async () => {
             try {
-                // Save relevant scroll positions
-                const windowScrollPosition = window.scrollY;
-                const tableContainer = document.getElementById('table-view');
-                const tableScrollPosition = tableContainer ? tableContainer.scrollTop : 0;
-                
-                metrics = JSON.parse(event.data);
-                console.log('Received metrics:', metrics.length);
-                
-                // Update available metrics list
-                updateAvailableMetricsList();
-                
-                if (isGridView) {
-                    updateDashboard();
-                    // Restore window scroll for grid view
-                    window.scrollTo({
-                        top: windowScrollPosition,
-                        behavior: 'auto'
-                    });
-                } else {
-                    // Table view - renderMetrics handles its own scroll position
-                    renderMetrics();
+                const url = new URL(streamUrl('api/snapshot'), location.href);
+                url.searchParams.set('client', clientId);
+                const response = await fetch(url, { cache: 'no-store' });
+                if (response.status === 200) {
+                    handleMessage(await response.text());
+                } else if (response.status !== 204) {
+                    throw new Error(`HTTP ${response.status}`);
+                }
+                if (failing) {
+                    onTransportOpen();
+                    failing = false;
                 }
             } catch (error) {
-                console.error('Error parsing message:', error);
+                console.error('Polling error:', error);
+                showConnectionStatus('Connection error', 'bg-red');
+                failing = true;
+            }
+            if (transports[transportIndex] === 'poll') {
+                pollTimer = setTimeout(poll, interval);
+            }
+        };
+        poll();
+    }
+    
+    // Decode a message from any transport and apply it
+    function handleMessage(data) {
+        let envelope;
+        try {
+            envelope = typeof data === 'string' ? JSON.parse(data) : decodeBinaryEnvelope(data);
+        } catch (error) {
+            console.error('Error parsing message:', error);
+            return;
+        }
+        transportWorked = true;
+        
+        // Announcements from the server carry no snapshot
+        if (envelope.event) {
+            handleServerEvent(envelope);
+            return;
+        }
+        
+        // Track our position even while paused so reconnects resume correctly
+        lastSeq = envelope.seq;
+        serverEpoch = envelope.epoch;
+        
+        // A resync means we fell too far behind; drop history that would span the gap
+        if (envelope.resync) {
+            metricHistory.clear();
+        }
+        
+        // Gather problems are reported with every snapshot until they are fixed
+        showGatherErrors(envelope.errors || []);
+        
+        if (isPaused) return;
+        
+        try {
+            // Save relevant scroll positions
+            const windowScrollPosition = window.scrollY;
+            const tableContainer = document.getElementById('table-view');
+            const tableScrollPosition = tableContainer ? tableContainer.scrollTop : 0;
+            
+            metrics = envelope.metrics || [];
+            
+            // Non-finite values arrive as "NaN", "+Inf" or "-Inf" strings
+            metrics.forEach(metric => {
+                if (typeof metric.value === 'string') {
+                    metric.value = metric.value === '+Inf' ? Infinity :
+                        metric.value === '-Inf' ? -Infinity : NaN;
+                }
+            });
+            // Replayed snapshots arrive late, so the minimum delta tracks live frames
+            clockOffset = Math.min(clockOffset, Date.now() - envelope.ts);
+            snapshotTime = envelope.ts + clockOffset;
+            
+            // Update available metrics list
+            updateAvailableMetricsList();
+            
+            if (isGridView) {
+                updateDashboard();
+                // Restore window scroll for grid view
+                window.scrollTo({
+                    top: windowScrollPosition,
+                    behavior: 'auto'
+                });
+            } else {
+                // Table view - renderMetrics handles its own scroll position
+                renderMetrics();
             }
+        } catch (error) {
+            console.error('Error parsing message:', error);
+        }
+    }
+    
+    // Apply a configuration change announced by the server
+    function handleServerEvent(event) {
+        switch (event.event) {
+            case 'dashboard':
+                // A layout saved in this browser takes precedence over the server's
+                if (!customLayout) {
+                    fetchDashboard();
+                }
+                break;
+            case 'interval':
+                if (!intervalChosen) {
+                    interval = event.interval;
+                    refreshInterval.value = interval;
+                    refreshValue.textContent = `${(interval / 1000).toFixed(1)}s`;
+                }
+                break;
+        }
+    }
+    
+    // Load the binary frame layout shared with the server
+    async function loadWireSchema() {
+        try {
+            const response = await fetch('protocol.json');
+            if (!response.ok) {
+                throw new Error(`HTTP ${response.status}`);
+            }
+            const schema = await response.json();
+            // Position of every field within its array
+            const positions = fields => Object.fromEntries(fields.map((field, i) => [field, i]));
+            wireSchema = {
+                subprotocol: schema.subprotocol,
+                version: schema.version,
+                envelope: positions(schema.envelope),
+                metric: positions(schema.metric),
+                error: positions(schema.error)
+            };
+        } catch (error) {
+            console.warn('Binary encoding unavailable, using JSON:', error);
+            wireSchema = null;
+        }
+    }
+    
+    // Decode a single CBOR item (RFC 8949). Only the types the server emits are supported.
+    function decodeCBOR(buffer) {
+        const view = new DataView(buffer);
+        const bytes = new Uint8Array(buffer);
+        const textDecoder = new TextDecoder();
+        let offset = 0;
+        
+        function readArgument(info) {
+            let value;
+            if (info < 24) {
+                return info;
+            } else if (info === 24) {
+                value = view.getUint8(offset);
+                offset += 1;
+            } else if (info === 25) {
+                value = view.getUint16(offset);
+                offset += 2;
+            } else if (info === 26) {
+                value = view.getUint32(offset);
+                offset += 4;
+            } else if (info === 27) {
+                value = Number(view.getBigUint64(offset));
+                offset += 8;
+            } else {
+                throw new Error(`Unsupported CBOR argument ${info}`);
+            }
+            return value;
+        }
+        
+        function readItem() {
+            const initial = view.getUint8(offset++);
+            const major = initial >> 5;
+            const info = initial & 0x1f;
+            
+            switch (major) {
+                case 0: // Unsigned integer
+                    return readArgument(info);
+                case 1: // Negative integer
+                    return -1 - readArgument(info);
+                case 3: { // Text string
+                    const length = readArgument(info);
+                    const text = textDecoder.decode(bytes.subarray(offset, offset + length));
+                    offset += length;
+                    return text;
+                }
+                case 4: { // Array
+                    const length = readArgument(info);
+                    const items = new Array(length);
+                    for (let i = 0; i < length; i++) {
+                        items[i] = readItem();
+                    }
+                    return items;
+                }
+                case 7: // Simple values and floats
+                    if (info === 20) return false;
+                    if (info === 21) return true;
+                    if (info === 22) return null;
+                    if (info === 26) {
+                        offset += 4;
+                        return view.getFloat32(offset - 4);
+                    }
+                    if (info === 27) {
+                        offset += 8;
+                        return view.getFloat64(offset - 8);
+                    }
+                    break;
+            }
+            throw new Error(`Unsupported CBOR item 0x${initial.toString(16)}`);
+        }
+        
+        return readItem();
+    }
+    
+    // Turn a binary frame into the same envelope object the JSON encoding produces
+    function decodeBinaryEnvelope(buffer) {
+        if (!wireSchema) {
+            throw new Error('Received a binary frame without a schema');
+        }
+        const fields = decodeCBOR(buffer);
+        const at = wireSchema.envelope;
+        if (fields[at.version] !== wireSchema.version) {
+            throw new Error(`Unsupported binary frame version ${fields[at.version]}`);
+        }
+        
+        const strings = fields[at.strings];
+        const m = wireSchema.metric;
+        const metrics = fields[at.metrics].map(entry => {
+            const metric = {
+                name: strings[entry[m.name]],
+                type: strings[entry[m.type]]
+            };
+            // Empty help and labels are omitted, as in JSON frames
+            const help = strings[entry[m.help]];
+            if (help) {
+                metric.help = help;
+            }
+            const labels = entry[m.labels];
+            if (labels.length > 0) {
+                metric.labels = {};
+                for (let i = 0; i < labels.length; i += 2) {
+                    metric.labels[strings[labels[i]]] = strings[labels[i + 1]];
+                }
+            }
+            metric.value = entry[m.value];
+            return metric;
         });
+        
+        const e = wireSchema.error;
+        const errors = fields[at.errors];
+        return {
+            seq: fields[at.seq],
+            ts: fields[at.ts],
+            epoch: fields[at.epoch],
+            resync: fields[at.resync],
+            errors: errors ? errors.map(entry => ({
+                collector: entry[e.collector],
+                kind: entry[e.kind],
+                message: entry[e.message]
+            })) : undefined,
+            metrics
+        };
     }
     
     // Update the list of available metrics for the customization modal
@@ -279,6 +617,46 @@ document.addEventListener('DOMContentLoaded', () => {
         }
     }
     
+    // Show a banner naming the collectors that failed during the last gather
+    function showGatherErrors(errors) {
+        if (errors.length === 0) {
+            errorBanner.style.display = 'none';
+            errorBanner.dataset.key = '';
+            return;
+        }
+        
+        // Skip rebuilding the banner if nothing changed since the last tick
+        const key = JSON.stringify(errors);
+        if (errorBanner.dataset.key === key) return;
+        errorBanner.dataset.key = key;
+        
+        const kindLabels = {
+            collector: 'Collector failed',
+            duplicate: 'Duplicate registration',
+            mismatch: 'Inconsistent metric family',
+            timeout: 'Gather timed out',
+            scrape: 'Scrape failed',
+            peer: 'Peer unavailable',
+            other: 'Gather error'
+        };
+        
+        errorBanner.innerHTML = '';
+        const title = document.createElement('strong');
+        title.textContent = `Metrics are incomplete: ${errors.length} problem${errors.length === 1 ? '' : 's'} while gathering`;
+        errorBanner.appendChild(title);
+        
+        const list = document.createElement('ul');
+        errors.forEach(err => {
+            const item = document.createElement('li');
+            const label = kindLabels[err.kind] || kindLabels.other;
+            item.textContent = err.collector ? `${label}: ${err.collector}` : label;
+            item.title = err.message;
+            list.appendChild(item);
+        });
+        errorBanner.appendChild(list);
+        errorBanner.style.display = 'block';
+    }
+    
     // Show connection status
     function showConnectionStatus(message, bgColor) {
         connectionStatus.textContent = message;
@@ -317,7 +695,7 @@ document.addEventListener('DOMContentLoaded', () => {
             }
             
             // If no custom layout, fetch from server
-            const response = await fetch('/dashboard');
+            const response = await fetch('dashboard');
             if (!response.ok) {
                 throw new Error(`HTTP error! Status: ${response.status}`);
             }
@@ -340,6 +718,7 @@ document.addEventListener('DOMContentLoaded', () => {
         board.innerHTML = '';
         metricTiles.clear();
         lastValues.clear();
+        comparisonTiles = [];
         
         if (!dashboardLayout || dashboardLayout.length === 0) {
             board.innerHTML = '<div style="grid-column: 1 / -1; grid-row: 1 / -1; display: flex; align-items: center; justify-content: center; color: var(--text-light);">No dashboard layout available</div>';
@@ -355,13 +734,29 @@ document.addEventListener('DOMContentLoaded', () => {
             return;
         }
         
-        board.style.gridTemplateRows = `repeat(${rows}, 1fr)`;
         board.style.gridTemplateColumns = `repeat(${cols}, 1fr)`;
         
+        // Rows whose first item names a section get a compact header row above them
+        const rowTemplate = [];
+        let gridRow = 0;
+        
         // Create tiles for each metric in the layout
-        dashboardLayout.forEach((row, rowIndex) => {
+        dashboardLayout.forEach((row) => {
             if (!Array.isArray(row)) return;
             
+            const first = row[0];
+            if (first && typeof first === 'object' && first.section) {
+                const header = document.createElement('div');
+                header.className = 'section-header';
+                header.textContent = first.section;
+                header.style.gridRow = `${++gridRow}`;
+                header.style.gridColumn = '1 / -1';
+                board.appendChild(header);
+                rowTemplate.push('auto');
+            }
+            const rowIndex = gridRow++;
+            rowTemplate.push('1fr');
+            
             row.forEach((item, colIndex) => {
                 // Skip empty items
                 if (!item) return;
@@ -385,6 +780,15 @@ document.addEventListener('DOMContentLoaded', () => {
                     return;
                 }
                 
+                // Items with "compare" show the metric once per label value
+                if (typeof item === 'object' && item.compare) {
+                    const tile = createComparisonTile(item, metricName, shortName);
+                    tile.style.gridRow = `${rowIndex + 1}`;
+                    tile.style.gridColumn = `${colIndex + 1}`;
+                    board.appendChild(tile);
+                    return;
+                }
+                
                 // Add support for both base metric name and _count/_sum variations
                 const baseMetricName = metricName.replace(/_sum$|_count$/, '');
                 
@@ -430,6 +834,8 @@ document.addEventListener('DOMContentLoaded', () => {
                 lastValues.set(metricName, null);
             });
         });
+        
+        board.style.gridTemplateRows = rowTemplate.join(' ');
     }
     
     // Create layout for editor based on current dashboard
@@ -463,6 +869,10 @@ document.addEventListener('DOMContentLoaded', () => {
                     }
                     
                     const cell = createEditorCell(metricName);
+                    // Keep settings the editor has no controls for, such as comparisons
+                    if (metricName && typeof item === 'object') {
+                        cell.dataset.item = JSON.stringify(item);
+                    }
                     row.appendChild(cell);
                 });
             }
@@ -572,6 +982,7 @@ document.addEventListener('DOMContentLoaded', () => {
         cell.innerHTML = '';
         cell.classList.remove('empty');
         cell.dataset.metricName = metricName;
+        delete cell.dataset.item;
         
         // Create metric display
         const metricDisplay = document.createElement('div');
@@ -586,6 +997,7 @@ document.addEventListener('DOMContentLoaded', () => {
             cell.innerHTML = 'Drop metric here';
             cell.classList.add('empty');
             delete cell.dataset.metricName;
+            delete cell.dataset.item;
         });
         
         cell.appendChild(metricDisplay);
@@ -613,7 +1025,9 @@ document.addEventListener('DOMContentLoaded', () => {
             
             // Process each cell in the row
             Array.from(rowElement.querySelectorAll('.layout-cell')).forEach(cellElement => {
-                if (cellElement.dataset.metricName) {
+                if (cellElement.dataset.item) {
+                    rowData.push(JSON.parse(cellElement.dataset.item));
+                } else if (cellElement.dataset.metricName) {
                     // Use object format with name field
                     rowData.push({
                         name: cellElement.dataset.metricName,
@@ -856,6 +1270,209 @@ document.addEventListener('DOMContentLoaded', () => {
                 }
             });
         }
+        
+        comparisonTiles.forEach(comparison => {
+            comparison.tile.classList.toggle('faded',
+                Boolean(filterText) && !filteredMetrics.some(m => m.name === comparison.metricName));
+            updateComparisonTile(comparison);
+        });
+    }
+    
+    // Create a tile showing one metric side by side or overlaid for several
+    // values of a label, such as the instance or a track label that target
+    // files give to canary and baseline targets. The first value is the
+    // reference the others' difference or ratio is computed against.
+    function createComparisonTile(item, metricName, shortName) {
+        const tile = document.createElement('div');
+        tile.className = 'metric-tile compare-tile';
+        tile.dataset.metricName = metricName;
+        
+        const comparison = {
+            tile,
+            metricName,
+            shortName,
+            label: item.compare,
+            values: Array.isArray(item.values) && item.values.length > 0 ? item.values.map(String) : null,
+            view: item.view === 'split' ? 'split' : 'overlay',
+            delta: item.delta === 'ratio' ? 'ratio' : 'difference',
+            historyKey: `compare:${comparisonTiles.length}:`, // Prefix of the metricHistory keys of each value
+            lastCounters: new Map(), // Last counter sample per label value, for rates
+        };
+        
+        if (comparison.view === 'split') {
+            tile.classList.add('compare-split');
+            const parts = document.createElement('div');
+            parts.className = 'compare-parts';
+            const delta = document.createElement('div');
+            delta.className = 'compare-delta';
+            tile.appendChild(parts);
+            tile.appendChild(delta);
+        } else {
+            const graph = document.createElement('div');
+            graph.className = 'line-graph-bg';
+            const value = document.createElement('div');
+            value.className = 'value';
+            value.textContent = '...';
+            const label = document.createElement('div');
+            label.className = 'label';
+            label.textContent = shortName;
+            const legend = document.createElement('div');
+            legend.className = 'compare-legend';
+            tile.appendChild(graph);
+            tile.appendChild(value);
+            tile.appendChild(label);
+            tile.appendChild(legend);
+        }
+        tile.title = metricName;
+        
+        comparisonTiles.push(comparison);
+        return tile;
+    }
+    
+    // Sum the series of a comparison's metric per label value. Counters are
+    // compared by their per-second rate, since their totals depend on how
+    // long each target has been running.
+    function comparisonValues(comparison) {
+        let matching = metrics.filter(m => m.name === comparison.metricName);
+        if (matching.length === 0) {
+            matching = metrics.filter(m => m.name === `${comparison.metricName}_sum`);
+        }
+        
+        const totals = new Map();
+        matching.forEach(m => {
+            const key = m.labels && m.labels[comparison.label];
+            if (key === undefined) return;
+            totals.set(key, (totals.get(key) || 0) + m.value);
+        });
+        
+        const isCounter = matching.length > 0 && matching[0].type === 'counter';
+        const now = snapshotTime || Date.now();
+        const keys = comparison.values || [...totals.keys()].sort();
+        return keys.map(key => {
+            let value = totals.has(key) ? totals.get(key) : null;
+            if (isCounter && value !== null) {
+                const last = comparison.lastCounters.get(key);
+                comparison.lastCounters.set(key, {total: value, at: now});
+                // A reset or the first sample has no rate yet
+                value = last && value >= last.total && now > last.at ?
+                    (value - last.total) / ((now - last.at) / 1000) : null;
+            }
+            return {key, value};
+        });
+    }
+    
+    // Format the difference or ratio of value against reference
+    function formatComparisonDelta(comparison, value, reference) {
+        if (value === null || reference === null) return '...';
+        if (comparison.delta === 'ratio') {
+            return reference === 0 ? '\u2013' : `\u00D7${formatValue(value / reference)}`;
+        }
+        const difference = value - reference;
+        return (difference < 0 ? '\u2212' : '+') + formatValue(Math.abs(difference), comparison.metricName);
+    }
+    
+    // Refresh a comparison tile from the current snapshot
+    function updateComparisonTile(comparison) {
+        const entries = comparisonValues(comparison);
+        entries.forEach(entry => {
+            if (entry.value !== null) {
+                updateMetricHistory(comparison.historyKey + entry.key, entry.value);
+            }
+        });
+        
+        const tile = comparison.tile;
+        const reference = entries.length > 0 ? entries[0].value : null;
+        const formatEntry = entry => entry.value === null ? '...' : formatValue(entry.value, comparison.metricName);
+        const deltaText = entries.length > 1 ? formatComparisonDelta(comparison, entries[1].value, reference) : '...';
+        
+        // Full breakdown on hover, including the delta of every value against the first
+        tile.title = [comparison.metricName, ...entries.map((entry, i) => {
+            const delta = i > 0 ? ` (${formatComparisonDelta(comparison, entry.value, reference)})` : '';
+            return `${comparison.label}=${entry.key}: ${formatEntry(entry)}${delta}`;
+        })].join('\n');
+        
+        if (comparison.view === 'split') {
+            const parts = tile.querySelector('.compare-parts');
+            parts.innerHTML = '';
+            entries.forEach((entry, i) => {
+                const part = document.createElement('div');
+                part.className = 'compare-part';
+                const graph = document.createElement('div');
+                graph.className = 'line-graph-bg';
+                graph.appendChild(comparisonGraph([{
+                    history: metricHistory.get(comparison.historyKey + entry.key) || [],
+                    color: COMPARISON_COLORS[i % COMPARISON_COLORS.length],
+                }]));
+                const value = document.createElement('div');
+                value.className = 'value';
+                value.textContent = formatEntry(entry);
+                const label = document.createElement('div');
+                label.className = 'label';
+                label.textContent = `${comparison.shortName} ${entry.key}`;
+                part.appendChild(graph);
+                part.appendChild(value);
+                part.appendChild(label);
+                parts.appendChild(part);
+            });
+            tile.querySelector('.compare-delta').textContent = deltaText;
+            return;
+        }
+        
+        tile.querySelector('.value').textContent = deltaText;
+        const legend = tile.querySelector('.compare-legend');
+        legend.innerHTML = '';
+        entries.forEach((entry, i) => {
+            const item = document.createElement('span');
+            item.style.color = COMPARISON_COLORS[i % COMPARISON_COLORS.length];
+            item.textContent = `${entry.key} ${formatEntry(entry)}`;
+            legend.appendChild(item);
+        });
+        const graph = tile.querySelector('.line-graph-bg');
+        graph.innerHTML = '';
+        graph.appendChild(comparisonGraph(entries.map((entry, i) => ({
+            history: metricHistory.get(comparison.historyKey + entry.key) || [],
+            color: COMPARISON_COLORS[i % COMPARISON_COLORS.length],
+        }))));
+    }
+    
+    // Draw lines for several histories on a shared scale across the time
+    // window, in the bottom half of a tile like renderLineGraph
+    function comparisonGraph(lines) {
+        const svgNS = "http://www.w3.org/2000/svg";
+        const svg = document.createElementNS(svgNS, "svg");
+        svg.setAttribute("preserveAspectRatio", "none");
+        svg.setAttribute("viewBox", "0 0 100 100");
+        svg.setAttribute("width", "100%");
+        svg.setAttribute("height", "100%");
+        
+        const now = Date.now();
+        const visible = lines.map(line => ({
+            color: line.color,
+            points: line.history.filter(point => point.timestamp >= now - timeWindowMs && isFinite(point.value)),
+        }));
+        const values = visible.flatMap(line => line.points.map(point => point.value));
+        if (values.length < 2) return svg;
+        
+        const minValue = Math.min(0, ...values);
+        const maxValue = Math.max(...values);
+        const range = maxValue - minValue || Math.abs(maxValue) || 1;
+        
+        visible.forEach(line => {
+            if (line.points.length < 2) return;
+            const pathData = line.points.map((point, i) => {
+                const x = Math.min(100, Math.max(0, 100 - (now - point.timestamp) / timeWindowMs * 100));
+                const y = 50 + 50 * (1 - (point.value - minValue) / range);
+                return (i === 0 ? "M" : "L") + x + "," + y;
+            }).join(" ");
+            const path = document.createElementNS(svgNS, "path");
+            path.setAttribute("d", pathData);
+            path.setAttribute("vector-effect", "non-scaling-stroke");
+            path.style.stroke = line.color;
+            path.style.strokeWidth = "1.5px";
+            path.style.fill = "none";
+            svg.appendChild(path);
+        });
+        return svg;
     }
     
     // Filter metrics based on search text
@@ -1284,7 +1901,7 @@ document.addEventListener('DOMContentLoaded', () => {
         
         const history = metricHistory.get(metricName);
         history.push({
-            timestamp: Date.now(),
+            timestamp: snapshotTime || Date.now(),
             value: value
         });
         
@@ -2033,9 +2650,21 @@ document.addEventListener('DOMContentLoaded', () => {
     // Refresh interval slider
     refreshInterval.addEventListener('input', (e) => {
         interval = parseInt(e.target.value, 10);
+        intervalChosen = true;
         refreshValue.textContent = `${(interval / 1000).toFixed(1)}s`;
     });
     
+    // Ask the server for the new interval once the slider is released
+    refreshInterval.addEventListener('change', () => {
+        if (ws && ws.readyState === WebSocket.OPEN) {
+            ws.send(JSON.stringify({ interval }));
+        } else if (eventSource) {
+            // An event stream cannot talk back, so reconnect with the new interval
+            connect();
+        }
+        // Polling picks up the new interval on its next round
+    });
+    
     // Time window select
     timeWindow.addEventListener('change', (e) => {
         timeWindowMs = parseInt(e.target.value, 10);
@@ -2062,9 +2691,9 @@ document.addEventListener('DOMContentLoaded', () => {
     
     // Initialize
     initUIState();
-    fetchDashboard().then(() => {
-        // Initialize WebSocket connection
-        connectWebSocket();
+    Promise.all([fetchDashboard(), loadWireSchema()]).then(() => {
+        // Connect, falling back from WebSocket to SSE and polling as needed
+        connect();
         
         // Initialize table header sort functionality
         initTableSorting();
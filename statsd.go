@@ -0,0 +1,470 @@
+package prommy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+	"gopkg.in/yaml.v3"
+)
+
+// statsdSetWindow is how long a value received for a set counts towards
+// its number of distinct values, standing in for a StatsD flush interval.
+const statsdSetWindow = time.Minute
+
+// statsdMaxSeries limits the series a StatsD listener keeps, so a client
+// sending unbounded tag values cannot exhaust memory.
+const statsdMaxSeries = 100000
+
+// statsdMaxSetValues limits the distinct values a set counts within
+// statsdSetWindow, so a client sending unique values cannot exhaust memory.
+const statsdMaxSetValues = 10000
+
+// StatsDMapping is a rule giving StatsD metrics a Prometheus name and
+// labels, like a statsd_exporter mapping. Match is a dot-separated glob
+// where * matches one name component, or a regular expression if
+// MatchType is "regex"; it must match the whole StatsD name. Name and the
+// label values may refer to the components matched by * or the regex's
+// capture groups as $1, $2 or ${name}.
+type StatsDMapping struct {
+	Match     string            `json:"match" yaml:"match"`
+	MatchType string            `json:"match_type" yaml:"match_type"` // "glob", the default, or "regex"
+	Name      string            `json:"name" yaml:"name"`             // Prometheus name, empty to keep the StatsD name
+	Labels    map[string]string `json:"labels" yaml:"labels"`         // Labels added to the series, replacing tags of the same name
+	Help      string            `json:"help" yaml:"help"`
+	Buckets   []float64         `json:"buckets" yaml:"buckets"` // Histogram buckets for timers and histograms, empty uses prometheus.DefBuckets
+	Drop      bool              `json:"drop" yaml:"drop"`       // Ignore matching metrics
+}
+
+// statsdRule is a StatsDMapping with its pattern compiled.
+type statsdRule struct {
+	StatsDMapping
+	regex *regexp.Regexp
+}
+
+// StatsD is a prometheus.Gatherer for metrics received over UDP in the
+// StatsD line protocol, including DogStatsD tags, for services that
+// cannot expose Prometheus metrics. Pass it to WithGatherer and call
+// Listen.
+//
+// Counters (c) add up, and gauges (g) are set or, with a leading sign,
+// changed. Timers (ms) become histograms in seconds, and histograms (h) and
+// distributions (d) histograms of the values sent. Sets (s) become gauges
+// counting the distinct values received in the last minute. Sample rates
+// scale counters and repeat observations. Metrics that no mapping names
+// keep their StatsD name with invalid characters such as dots replaced by
+// underscores, and DogStatsD tags become labels.
+type StatsD struct {
+	rules []*statsdRule
+
+	mu       sync.Mutex
+	families map[string]*statsdFamily
+	series   int
+	failure  string // Last problem logged, to log each problem once
+	now      func() time.Time
+}
+
+// statsdFamily holds the series of one Prometheus name.
+type statsdFamily struct {
+	kind    byte // c, g, h or s; timers and distributions are histograms
+	help    string
+	buckets []float64
+	series  map[string]*statsdSeries // By seriesKey
+}
+
+type statsdSeries struct {
+	labels []*dto.LabelPair
+	value  float64              // Counters and gauges
+	counts []uint64             // Histogram observations per bucket, not cumulative
+	count  uint64               // Histogram observations
+	sum    float64              // Histogram sum
+	seen   map[string]time.Time // Set values by when they were last received
+}
+
+// NewStatsD creates a StatsD listener applying the first matching mapping
+// to every metric it receives.
+func NewStatsD(mappings []StatsDMapping) (*StatsD, error) {
+	d := &StatsD{families: make(map[string]*statsdFamily), now: time.Now}
+	for i, m := range mappings {
+		rule := &statsdRule{StatsDMapping: m}
+		var expr string
+		switch m.MatchType {
+		case "", "glob":
+			parts := strings.Split(m.Match, "*")
+			for j := range parts {
+				parts[j] = regexp.QuoteMeta(parts[j])
+			}
+			expr = strings.Join(parts, "([^.]*)")
+		case "regex":
+			expr = m.Match
+		default:
+			return nil, fmt.Errorf("statsd mapping %d: unknown match_type %q", i, m.MatchType)
+		}
+		regex, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("statsd mapping %d: invalid match %q: %w", i, m.Match, err)
+		}
+		rule.regex = regex
+		for name := range m.Labels {
+			if !labelNamePattern.MatchString(name) || strings.HasPrefix(name, "__") {
+				return nil, fmt.Errorf("statsd mapping %d: invalid label name %q", i, name)
+			}
+		}
+		if !sort.Float64sAreSorted(m.Buckets) {
+			return nil, fmt.Errorf("statsd mapping %d: buckets must be sorted", i)
+		}
+		d.rules = append(d.rules, rule)
+	}
+	return d, nil
+}
+
+// LoadStatsDMappings reads mappings from a YAML or JSON file listing them
+// under "mappings", as statsd_exporter mapping files do.
+func LoadStatsDMappings(path string) ([]StatsDMapping, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Mappings []StatsDMapping `yaml:"mappings"`
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&file); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return file.Mappings, nil
+}
+
+// Listen receives StatsD packets on the UDP address addr, such as ":8125",
+// until ctx is done, logging malformed metrics to logger, or slog.Default()
+// if it is nil. It returns the address listened on once the socket is
+// bound.
+func (d *StatsD) Listen(ctx context.Context, addr string, logger *slog.Logger) (net.Addr, error) {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	context.AfterFunc(ctx, func() { conn.Close() })
+	go d.serve(conn, logger)
+	return conn.LocalAddr(), nil
+}
+
+// serve reads packets from conn until it is closed.
+func (d *StatsD) serve(conn net.PacketConn, logger *slog.Logger) {
+	buf := make([]byte, 64<<10)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			logger.Warn("Cannot read StatsD packet", "error", err)
+			continue
+		}
+		for _, err := range d.handlePacket(buf[:n]) {
+			d.mu.Lock()
+			repeated := err.Error() == d.failure
+			d.failure = err.Error()
+			d.mu.Unlock()
+			if !repeated {
+				logger.Warn("Dropped StatsD metric", "error", err)
+			}
+		}
+	}
+}
+
+// handlePacket records every metric of a packet, one per line, and returns
+// the problems with those it dropped.
+func (d *StatsD) handlePacket(packet []byte) []error {
+	var errs []error
+	for _, line := range bytes.Split(packet, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		// DogStatsD events and service checks are not metrics
+		if len(line) == 0 || bytes.HasPrefix(line, []byte("_e{")) || bytes.HasPrefix(line, []byte("_sc|")) {
+			continue
+		}
+		if err := d.handleLine(string(line)); err != nil {
+			errs = append(errs, fmt.Errorf("%q: %w", line, err))
+		}
+	}
+	return errs
+}
+
+// handleLine records one metric in the form
+// name:value[:value...]|type[|@rate][|#tag:value,...].
+func (d *StatsD) handleLine(line string) error {
+	name, rest, ok := strings.Cut(line, ":")
+	if !ok || name == "" {
+		return errors.New("missing value")
+	}
+	sections := strings.Split(rest, "|")
+	if len(sections) < 2 {
+		return errors.New("missing type")
+	}
+	values, typ := strings.Split(sections[0], ":"), sections[1]
+	rate := 1.0
+	tags := make(map[string]string)
+	for _, section := range sections[2:] {
+		switch {
+		case strings.HasPrefix(section, "@"):
+			r, err := strconv.ParseFloat(section[1:], 64)
+			if err != nil || r <= 0 || r > 1 {
+				return fmt.Errorf("invalid sample rate %q", section)
+			}
+			rate = r
+		case strings.HasPrefix(section, "#"):
+			for _, tag := range strings.Split(section[1:], ",") {
+				// Tags without a value would be labels with an empty value,
+				// which Prometheus treats as absent
+				if key, value, ok := strings.Cut(tag, ":"); ok && key != "" && value != "" {
+					tags[sanitizeName(key, false)] = value
+				}
+			}
+		}
+		// Other sections, such as DogStatsD container IDs and timestamps, are ignored
+	}
+
+	var kind byte
+	switch typ {
+	case "c", "g", "h", "s":
+		kind = typ[0]
+	case "ms", "d":
+		kind = 'h'
+	default:
+		return fmt.Errorf("unknown metric type %q", typ)
+	}
+
+	var rule *statsdRule
+	var match []int
+	for _, r := range d.rules {
+		if match = r.regex.FindStringSubmatchIndex(name); match != nil {
+			rule = r
+			break
+		}
+	}
+	promName, help, buckets := sanitizeName(name, true), "", prometheus.DefBuckets
+	labels := tags
+	if rule != nil {
+		if rule.Drop {
+			return nil
+		}
+		if rule.Name != "" {
+			promName = sanitizeName(string(rule.regex.ExpandString(nil, rule.Name, name, match)), true)
+		}
+		if promName == "" {
+			return errors.New("mapping gives an empty name")
+		}
+		for label, template := range rule.Labels {
+			if value := string(rule.regex.ExpandString(nil, template, name, match)); value != "" {
+				labels[label] = value
+			} else {
+				delete(labels, label)
+			}
+		}
+		help = rule.Help
+		if len(rule.Buckets) > 0 {
+			buckets = rule.Buckets
+		}
+	}
+
+	// The bucket label of histograms cannot also come from a tag
+	if _, ok := labels["le"]; ok && kind == 'h' {
+		return errors.New(`tag "le" is reserved for histogram buckets`)
+	}
+
+	// Parse every value before recording any, so a bad line changes nothing
+	parsed := make([]float64, len(values))
+	for i, v := range values {
+		if kind == 's' {
+			continue
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return fmt.Errorf("invalid value %q", v)
+		}
+		if typ == "ms" {
+			f /= 1000
+		}
+		parsed[i] = f
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	family, ok := d.families[promName]
+	if !ok {
+		if help == "" {
+			help = statsdHelp(typ)
+		}
+		family = &statsdFamily{kind: kind, help: help, buckets: buckets, series: make(map[string]*statsdSeries)}
+		d.families[promName] = family
+	} else if family.kind != kind {
+		return fmt.Errorf("%s was received as another type before", promName)
+	}
+	pairs := labelPairs(labels)
+	key := seriesKey("", pairs)
+	series, ok := family.series[key]
+	if !ok {
+		if d.series >= statsdMaxSeries {
+			return fmt.Errorf("more than %d series", statsdMaxSeries)
+		}
+		series = &statsdSeries{labels: pairs}
+		switch kind {
+		case 'h':
+			series.counts = make([]uint64, len(family.buckets)+1)
+		case 's':
+			series.seen = make(map[string]time.Time)
+		}
+		family.series[key] = series
+		d.series++
+	}
+	if kind == 's' {
+		if err := series.makeRoom(values, d.now().Add(-statsdSetWindow)); err != nil {
+			return fmt.Errorf("set %s: %w", promName, err)
+		}
+	}
+
+	// A sampled metric stands for 1/rate metrics
+	repeat := uint64(max(1, math.Round(1/rate)))
+	for i, v := range values {
+		switch kind {
+		case 'c':
+			series.value += parsed[i] / rate
+		case 'g':
+			if strings.HasPrefix(v, "+") || strings.HasPrefix(v, "-") {
+				series.value += parsed[i]
+			} else {
+				series.value = parsed[i]
+			}
+		case 'h':
+			bucket := sort.SearchFloat64s(family.buckets, parsed[i])
+			series.counts[bucket] += repeat
+			series.count += repeat
+			series.sum += parsed[i] * float64(repeat)
+		case 's':
+			series.seen[v] = d.now()
+		}
+	}
+	return nil
+}
+
+// makeRoom checks that the set can count values, first forgetting those
+// seen before cutoff if it would grow past statsdMaxSetValues.
+func (s *statsdSeries) makeRoom(values []string, cutoff time.Time) error {
+	added := 0
+	for _, v := range values {
+		if _, ok := s.seen[v]; !ok {
+			added++
+		}
+	}
+	if len(s.seen)+added <= statsdMaxSetValues {
+		return nil
+	}
+	for value, seen := range s.seen {
+		if seen.Before(cutoff) {
+			delete(s.seen, value)
+		}
+	}
+	if len(s.seen)+added > statsdMaxSetValues {
+		return fmt.Errorf("more than %d distinct values in %s", statsdMaxSetValues, statsdSetWindow)
+	}
+	return nil
+}
+
+// Gather returns the received metrics as families sorted by name.
+func (d *StatsD) Gather() ([]*dto.MetricFamily, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	cutoff := d.now().Add(-statsdSetWindow)
+	result := make([]*dto.MetricFamily, 0, len(d.families))
+	for name, family := range d.families {
+		mf := &dto.MetricFamily{Name: proto.String(name), Help: proto.String(family.help)}
+		switch family.kind {
+		case 'c':
+			mf.Type = dto.MetricType_COUNTER.Enum()
+		case 'h':
+			mf.Type = dto.MetricType_HISTOGRAM.Enum()
+		default:
+			mf.Type = dto.MetricType_GAUGE.Enum()
+		}
+		for _, series := range family.series {
+			m := &dto.Metric{Label: series.labels}
+			switch family.kind {
+			case 'c':
+				m.Counter = &dto.Counter{Value: proto.Float64(series.value)}
+			case 'g':
+				m.Gauge = &dto.Gauge{Value: proto.Float64(series.value)}
+			case 's':
+				for value, seen := range series.seen {
+					if seen.Before(cutoff) {
+						delete(series.seen, value)
+					}
+				}
+				m.Gauge = &dto.Gauge{Value: proto.Float64(float64(len(series.seen)))}
+			case 'h':
+				h := &dto.Histogram{SampleCount: proto.Uint64(series.count), SampleSum: proto.Float64(series.sum)}
+				var cumulative uint64
+				for i, upper := range family.buckets {
+					cumulative += series.counts[i]
+					h.Bucket = append(h.Bucket, &dto.Bucket{UpperBound: proto.Float64(upper), CumulativeCount: proto.Uint64(cumulative)})
+				}
+				m.Histogram = h
+			}
+			mf.Metric = append(mf.Metric, m)
+		}
+		sort.Slice(mf.Metric, func(i, j int) bool {
+			return seriesKey("", mf.Metric[i].Label) < seriesKey("", mf.Metric[j].Label)
+		})
+		result = append(result, mf)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].GetName() < result[j].GetName() })
+	return result, nil
+}
+
+// statsdHelp describes a family that no mapping gave help for.
+func statsdHelp(typ string) string {
+	switch typ {
+	case "c":
+		return "StatsD counter."
+	case "g":
+		return "StatsD gauge."
+	case "ms":
+		return "StatsD timer, in seconds."
+	case "s":
+		return "Distinct values of a StatsD set in the last minute."
+	}
+	return "StatsD histogram."
+}
+
+// sanitizeName replaces the characters Prometheus does not allow in metric
+// names, or label names if metric is false, with underscores.
+func sanitizeName(name string, metric bool) string {
+	b := []byte(name)
+	for i, c := range b {
+		valid := c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' ||
+			c >= '0' && c <= '9' && i > 0 || c == ':' && metric
+		if !valid {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
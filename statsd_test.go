@@ -0,0 +1,222 @@
+package prommy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// statsdValues returns the gathered series of d by name and labels.
+func statsdValues(t *testing.T, d *StatsD) map[string]float64 {
+	t.Helper()
+	mfs, err := d.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[string]float64)
+	for _, m := range convertMetrics(mfs) {
+		key := m.Name
+		if len(m.Labels) > 0 {
+			var labels []string
+			for _, lp := range labelPairs(m.Labels) {
+				labels = append(labels, lp.GetName()+"="+lp.GetValue())
+			}
+			key += "{" + strings.Join(labels, ",") + "}"
+		}
+		values[key] = m.Value
+	}
+	return values
+}
+
+func TestStatsDLines(t *testing.T) {
+	d, err := NewStatsD([]StatsDMapping{
+		{Match: "api.*.requests", Name: "api_requests_total", Labels: map[string]string{"endpoint": "$1"}},
+		{Match: `db\.(\w+)\.query_time`, MatchType: "regex", Name: "db_query_seconds", Labels: map[string]string{"db": "$1"}, Buckets: []float64{0.01, 0.1}},
+		{Match: "debug.*.*", Drop: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1700000000, 0)
+	d.now = func() time.Time { return now }
+
+	errs := d.handlePacket([]byte(strings.Join([]string{
+		"api.users.requests:1|c",
+		"api.users.requests:2|c|@0.5",
+		"api.orders.requests:1|c|#region:eu,canary",
+		"page.views:3|c|#env:prod",
+		"queue.depth:10|g",
+		"queue.depth:-4|g",
+		"pool.size:5|g",
+		"pool.size:+2|g",
+		"db.users.query_time:5:50|ms",
+		"db.users.query_time:500|ms|@0.5",
+		"debug.cache.hits:1|c",
+		"visitors:alice|s",
+		"visitors:bob|s",
+		"visitors:alice|s",
+		"_e{5,4}:title|text",
+		"_sc|redis|0",
+		"",
+	}, "\n")))
+	if len(errs) > 0 {
+		t.Fatalf("handlePacket: %v", errs)
+	}
+
+	want := map[string]float64{
+		"api_requests_total{endpoint=users}":            5,
+		"api_requests_total{endpoint=orders,region=eu}": 1,
+		"page_views{env=prod}":                          3,
+		"queue_depth":                                   6,
+		"pool_size":                                     7,
+		"db_query_seconds_bucket{db=users,le=0.01}":     1,
+		"db_query_seconds_bucket{db=users,le=0.1}":      2,
+		"db_query_seconds_count{db=users}":              4,
+		"db_query_seconds{db=users}":                    1.055,
+		"visitors":                                      2,
+	}
+	got := statsdValues(t, d)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("gathered %v, want %v", got, want)
+	}
+
+	// Set values count for a minute
+	now = now.Add(2 * time.Minute)
+	d.handleLine("visitors:carol|s")
+	if got := statsdValues(t, d)["visitors"]; got != 1 {
+		t.Errorf("visitors after a minute = %v, want 1", got)
+	}
+}
+
+func TestStatsDRejects(t *testing.T) {
+	d, err := NewStatsD(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.handleLine("jobs:1|c"); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"jobs",
+		"jobs:1",
+		"jobs:1|x",
+		"jobs:1|",
+		"jobs:one|c",
+		"jobs:1|c|@2",
+		"jobs:1|g",
+		"latency:5|ms|#le:0.1",
+	} {
+		if err := d.handleLine(line); err == nil {
+			t.Errorf("handleLine(%q) succeeded, want error", line)
+		}
+	}
+
+	for _, mappings := range [][]StatsDMapping{
+		{{Match: "a.*", MatchType: "prefix"}},
+		{{Match: "(", MatchType: "regex"}},
+		{{Match: "a.*", Labels: map[string]string{"bad-name": "x"}}},
+		{{Match: "a.*", Buckets: []float64{1, 0.5}}},
+	} {
+		if _, err := NewStatsD(mappings); err == nil {
+			t.Errorf("NewStatsD(%+v) succeeded, want error", mappings)
+		}
+	}
+}
+
+func TestStatsDSetLimit(t *testing.T) {
+	d, err := NewStatsD(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1700000000, 0)
+	d.now = func() time.Time { return now }
+
+	for i := 0; i < statsdMaxSetValues; i++ {
+		if err := d.handleLine("users:" + strconv.Itoa(i) + "|s"); err != nil {
+			t.Fatalf("value %d: %v", i, err)
+		}
+	}
+	if err := d.handleLine("users:0|s"); err != nil {
+		t.Errorf("repeating a counted value: %v", err)
+	}
+	if err := d.handleLine("users:new|s"); err == nil {
+		t.Error("handleLine succeeded with a full set, want error")
+	}
+
+	// Values from before the window make room again
+	now = now.Add(2 * time.Minute)
+	if err := d.handleLine("users:new|s"); err != nil {
+		t.Errorf("after the window: %v", err)
+	}
+	if got := statsdValues(t, d)["users"]; got != 1 {
+		t.Errorf("users = %v, want 1", got)
+	}
+}
+
+func TestLoadStatsDMappings(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mapping.yml")
+	data := "mappings:\n  - match: api.*.requests\n    name: api_requests_total\n    labels:\n      endpoint: $1\n"
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	mappings, err := LoadStatsDMappings(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []StatsDMapping{{Match: "api.*.requests", Name: "api_requests_total", Labels: map[string]string{"endpoint": "$1"}}}
+	if !reflect.DeepEqual(mappings, want) {
+		t.Errorf("mappings = %+v, want %+v", mappings, want)
+	}
+
+	if err := os.WriteFile(path, []byte("mappings:\n  - mach: api.*\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadStatsDMappings(path); err == nil {
+		t.Error("LoadStatsDMappings succeeded with an unknown field, want error")
+	}
+}
+
+func TestStatsDListen(t *testing.T) {
+	d, err := NewStatsD(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	addr, err := d.Listen(ctx, "127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, srv := newTestServer(t, WithNopLogger(), WithGatherer(d))
+
+	conn, err := net.Dial("udp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var body []byte
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if _, err := conn.Write([]byte("app.started:1|g|#service:billing\n")); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.Get(srv.URL + "/metrics")
+		if err != nil {
+			t.Fatalf("GET /metrics: %v", err)
+		}
+		body, _ = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if strings.Contains(string(body), `app_started{service="billing"} 1`) {
+			return
+		}
+	}
+	t.Errorf("/metrics does not show the StatsD gauge:\n%s", body)
+}
@@ -0,0 +1,159 @@
+package prommy
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// defaultSeriesRetention is how long a pushed series is kept after its last
+// sample, matching the five minute lookback of Prometheus queries.
+const defaultSeriesRetention = 5 * time.Minute
+
+// maxStoredSeries limits the series a store keeps, so a sender writing
+// unbounded label values cannot exhaust memory.
+const maxStoredSeries = 100000
+
+// seriesStore keeps the latest value of series pushed to prommy, such as
+// remote_write samples, and serves them as a prometheus.Gatherer. A series
+// that receives no sample for the retention period is forgotten.
+type seriesStore struct {
+	retention time.Duration
+	now       func() time.Time
+
+	mu       sync.Mutex
+	series   map[string]*storedSeries // By seriesKey
+	families map[string]storedFamily  // Type and help by family name
+}
+
+// storedSeries is the latest sample of one pushed series.
+type storedSeries struct {
+	name      string
+	labels    []*dto.LabelPair
+	value     float64
+	timestamp int64     // Sample time in milliseconds, to ignore older samples arriving late
+	updated   time.Time // When the sample was received, for retention
+}
+
+// storedFamily is the metadata pushed for a family.
+type storedFamily struct {
+	typ     dto.MetricType
+	help    string
+	updated time.Time
+}
+
+// newSeriesStore creates an empty store; a retention of 0 uses the default.
+func newSeriesStore(retention time.Duration) *seriesStore {
+	if retention <= 0 {
+		retention = defaultSeriesRetention
+	}
+	return &seriesStore{
+		retention: retention,
+		now:       time.Now,
+		series:    make(map[string]*storedSeries),
+		families:  make(map[string]storedFamily),
+	}
+}
+
+// set records a sample, unless the series already has a newer one. labels
+// must not include the metric name. It returns false without storing the
+// sample if the series is new and the store already holds maxStoredSeries.
+func (s *seriesStore) set(name string, labels map[string]string, value float64, timestamp int64) bool {
+	pairs := labelPairs(labels)
+	key := seriesKey(name, pairs)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if stored, ok := s.series[key]; ok {
+		if timestamp >= stored.timestamp {
+			stored.value, stored.timestamp, stored.updated = value, timestamp, s.now()
+		}
+		return true
+	}
+	if len(s.series) >= maxStoredSeries {
+		return false
+	}
+	s.series[key] = &storedSeries{name: name, labels: pairs, value: value, timestamp: timestamp, updated: s.now()}
+	return true
+}
+
+// remove forgets a series, as when a stale marker is received for it.
+func (s *seriesStore) remove(name string, labels map[string]string) {
+	key := seriesKey(name, labelPairs(labels))
+	s.mu.Lock()
+	delete(s.series, key)
+	s.mu.Unlock()
+}
+
+// describe records the type and help of a family. Types other than counter
+// and gauge are stored as gauges, since every stored series is a single
+// value. Metadata of new families is dropped once maxStoredSeries families
+// are described, as every family needs at least one series to be shown.
+func (s *seriesStore) describe(name string, typ dto.MetricType, help string) {
+	if typ != dto.MetricType_COUNTER {
+		typ = dto.MetricType_GAUGE
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.families[name]; !ok && len(s.families) >= maxStoredSeries {
+		return
+	}
+	s.families[name] = storedFamily{typ: typ, help: help, updated: s.now()}
+}
+
+// Gather returns the stored series as families sorted by name, dropping
+// those past their retention. Series of families without metadata are
+// gauges.
+func (s *seriesStore) Gather() ([]*dto.MetricFamily, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cutoff := s.now().Add(-s.retention)
+	byName := make(map[string]*dto.MetricFamily)
+	var result []*dto.MetricFamily
+	for key, stored := range s.series {
+		if stored.updated.Before(cutoff) {
+			delete(s.series, key)
+			continue
+		}
+		mf, ok := byName[stored.name]
+		if !ok {
+			meta, described := s.families[stored.name]
+			if !described {
+				meta.typ = dto.MetricType_GAUGE
+			}
+			mf = &dto.MetricFamily{Name: proto.String(stored.name), Type: meta.typ.Enum()}
+			if meta.help != "" {
+				mf.Help = proto.String(meta.help)
+			}
+			byName[stored.name] = mf
+			result = append(result, mf)
+		}
+		m := &dto.Metric{Label: stored.labels}
+		if mf.GetType() == dto.MetricType_COUNTER {
+			m.Counter = &dto.Counter{Value: proto.Float64(stored.value)}
+		} else {
+			m.Gauge = &dto.Gauge{Value: proto.Float64(stored.value)}
+		}
+		mf.Metric = append(mf.Metric, m)
+	}
+
+	// Metadata may arrive apart from samples, so it is kept as long as
+	// either is fresh
+	for name, meta := range s.families {
+		if _, ok := byName[name]; !ok && meta.updated.Before(cutoff) {
+			delete(s.families, name)
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].GetName() < result[j].GetName() })
+	for _, mf := range result {
+		sort.Slice(mf.Metric, func(i, j int) bool {
+			return seriesKey("", mf.Metric[i].Label) < seriesKey("", mf.Metric[j].Label)
+		})
+	}
+	return result, nil
+}